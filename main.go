@@ -7,13 +7,31 @@ import (
 	"github.com/rvk01/deflux/pkg/deflux"
 	"log/slog"
 	"os"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "pair":
+			os.Exit(runPair(os.Args[2:]))
+		case "apikeys":
+			os.Exit(runAPIKeys(os.Args[2:]))
+		case "check-config":
+			os.Exit(runCheckConfig(os.Args[2:]))
+		case "record":
+			os.Exit(runRecord(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
+
 	flagLoglevel := flag.String("loglevel", "warn", "debug | error | warn | info")
 	flagConfigGen := flag.Bool("config-gen", false, "generate a default config and print it on stdout")
 	flagConfig := flag.String("config", "", "specify the location of the config file (default: ./deflux.yml or /etc/deflux.yml)")
 	flagOnce := flag.Bool("1", false, "write sensor state from REST API once and exit")
+	flagPrintConfig := flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	flag.Usage = usage
 	flag.Parse()
 
 	initLogging(flagLoglevel)
@@ -25,10 +43,18 @@ func main() {
 
 	cfg, err := config.LoadConfiguration(*flagConfig)
 	if err != nil {
-		slog.Error("No config file: %s", err)
+		slog.Error(fmt.Sprintf("No config file: %s", err))
 		os.Exit(deflux.ExitFailConfig)
 	}
 
+	if *flagPrintConfig {
+		if err := cfg.OutputConfiguration(); err != nil {
+			slog.Error(err.Error())
+			os.Exit(deflux.ExitFailConfig)
+		}
+		os.Exit(deflux.ExitOK)
+	}
+
 	if *flagOnce {
 		os.Exit(deflux.RunOnce(cfg))
 	}
@@ -36,6 +62,162 @@ func main() {
 	os.Exit(deflux.RunWebsocket(cfg))
 }
 
+// usage prints the usage of deflux and its commands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s <command> [flags]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Commands:")
+	fmt.Fprintln(out, "  pair          pair with a deCONZ gateway and print the API key")
+	fmt.Fprintln(out, "  apikeys       list, verify, revoke or prune API keys of the gateways")
+	fmt.Fprintln(out, "  check-config  validate the configuration and test the connections to deCONZ and InfluxDB")
+	fmt.Fprintln(out, "  record        record the websocket messages and sensors of the gateways into a JSONL file")
+	fmt.Fprintln(out, "  replay        decode a recording and write the sensor events to the configured sinks")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// runPair runs the pair command
+func runPair(args []string) int {
+	fs := flag.NewFlagSet("pair", flag.ExitOnError)
+	flagLoglevel := fs.String("loglevel", "warn", "debug | error | warn | info")
+	flagAddr := fs.String("addr", "", "address of the deCONZ REST API, e.g. http://127.0.0.1/api (default: from -config or discovered)")
+	flagConfig := fs.String("config", "", "existing config file to write the API key to")
+	flagGateway := fs.String("gateway", "", "name of the gateway in the config file's gateways list")
+	flagTimeout := fs.Duration("timeout", 60*time.Second, "time to wait for the gateway to be unlocked")
+	flagUsername := fs.String("username", "", "Phoscon App user for HTTP basic auth, e.g. delight; no unlocking required")
+	flagPassword := fs.String("password", "", "Phoscon App password for HTTP basic auth")
+	flagCA := fs.String("tls-ca", "", "PEM file of CA certificates trusted for an https address (default: from -config)")
+	flagCert := fs.String("tls-cert", "", "PEM file of a client certificate (default: from -config)")
+	flagKey := fs.String("tls-key", "", "PEM file of the private key of the client certificate (default: from -config)")
+	flagInsecure := fs.Bool("tls-insecure-skip-verify", false, "accept any server certificate, only for testing")
+	_ = fs.Parse(args)
+
+	initLogging(flagLoglevel)
+
+	return deflux.RunPair(deflux.PairOptions{
+		Addr:       *flagAddr,
+		ConfigFile: *flagConfig,
+		Gateway:    *flagGateway,
+		Timeout:    *flagTimeout,
+		Username:   *flagUsername,
+		Password:   *flagPassword,
+		TLS: config.TLSConfig{
+			CA:                 *flagCA,
+			Cert:               *flagCert,
+			Key:                *flagKey,
+			InsecureSkipVerify: *flagInsecure,
+		},
+	})
+}
+
+// runAPIKeys runs the apikeys command
+func runAPIKeys(args []string) int {
+	fs := flag.NewFlagSet("apikeys", flag.ExitOnError)
+	flagLoglevel := fs.String("loglevel", "warn", "debug | error | warn | info")
+	flagConfig := fs.String("config", "", "specify the location of the config file (default: ./deflux.yml or /etc/deflux.yml)")
+	flagGateway := fs.String("gateway", "", "name of the gateway (default: all gateways)")
+	flagUnused := fs.Duration("unused", 30*24*time.Hour, "prune: revoke deflux keys that have not been used for this duration")
+	flagDryRun := fs.Bool("dry-run", false, "prune: only print the keys that would be revoked")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s apikeys list|verify|revoke|prune [flags] [keys to revoke...]\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		fs.Usage()
+		return deflux.ExitFailConfig
+	}
+	command := args[0]
+	_ = fs.Parse(args[1:])
+
+	initLogging(flagLoglevel)
+
+	cfg, err := config.LoadConfiguration(*flagConfig)
+	if err != nil {
+		slog.Error(fmt.Sprintf("No config file: %s", err))
+		return deflux.ExitFailConfig
+	}
+
+	return deflux.RunAPIKeys(cfg, deflux.APIKeysOptions{
+		Command: command,
+		Gateway: *flagGateway,
+		Keys:    fs.Args(),
+		Unused:  *flagUnused,
+		DryRun:  *flagDryRun,
+	})
+}
+
+// runCheckConfig runs the check-config command
+func runCheckConfig(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	flagLoglevel := fs.String("loglevel", "warn", "debug | error | warn | info")
+	flagConfig := fs.String("config", "", "specify the location of the config file (default: ./deflux.yml or /etc/deflux.yml)")
+	_ = fs.Parse(args)
+
+	initLogging(flagLoglevel)
+
+	return deflux.RunCheckConfig(*flagConfig)
+}
+
+// runRecord runs the record command
+func runRecord(args []string) int {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	flagLoglevel := fs.String("loglevel", "warn", "debug | error | warn | info")
+	flagConfig := fs.String("config", "", "specify the location of the config file (default: ./deflux.yml or /etc/deflux.yml)")
+	flagGateway := fs.String("gateway", "", "name of the gateway (default: all gateways)")
+	flagOutput := fs.String("o", "", "file to write the recording to (default: deflux-record-<time>.jsonl)")
+	flagDuration := fs.Duration("duration", 0, "stop recording after this duration (default: until interrupted)")
+	_ = fs.Parse(args)
+
+	initLogging(flagLoglevel)
+
+	cfg, err := config.LoadConfiguration(*flagConfig)
+	if err != nil {
+		slog.Error(fmt.Sprintf("No config file: %s", err))
+		return deflux.ExitFailConfig
+	}
+
+	return deflux.RunRecord(cfg, deflux.RecordOptions{
+		File:     *flagOutput,
+		Gateway:  *flagGateway,
+		Duration: *flagDuration,
+	})
+}
+
+// runReplay runs the replay command
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	flagLoglevel := fs.String("loglevel", "warn", "debug | error | warn | info")
+	flagConfig := fs.String("config", "", "specify the location of the config file (default: ./deflux.yml or /etc/deflux.yml)")
+	flagSink := fs.String("sink", "", "name of the sink to write to (default: all configured sinks)")
+	flagRealtime := fs.Bool("realtime", false, "replay with the delays between the recorded messages instead of as fast as possible")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] <recording>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	initLogging(flagLoglevel)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return deflux.ExitFailConfig
+	}
+
+	cfg, err := config.LoadConfiguration(*flagConfig)
+	if err != nil {
+		slog.Error(fmt.Sprintf("No config file: %s", err))
+		return deflux.ExitFailConfig
+	}
+
+	return deflux.RunReplay(cfg, deflux.ReplayOptions{
+		File:     fs.Arg(0),
+		Sink:     *flagSink,
+		Realtime: *flagRealtime,
+	})
+}
+
 // initLogging initializes slog
 func initLogging(flagLoglevel *string) {
 	var logLevel = new(slog.LevelVar)
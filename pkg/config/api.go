@@ -1,18 +1,52 @@
 package config
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
+	"github.com/rvk01/deflux/pkg/deconz/rest"
 	"net/url"
 	"path"
+	"time"
 )
 
+// DefaultGatewayName is the name of a gateway that has no name configured
+const DefaultGatewayName = "default"
+
 // APIConfig holds properties of the deCONZ API
 type APIConfig struct {
+	// Name identifies the gateway. It is added as gateway tag to all points.
+	Name   string `yaml:",omitempty"`
 	Addr   string
 	APIKey string
 	WsAddr string
+
+	// TLS configures the connections to https:// and wss:// addresses
+	TLS TLSConfig `yaml:",omitempty"`
+
+	// Timeout is the timeout of a single request to the REST API, rest.DefaultTimeout if not set
+	Timeout time.Duration `yaml:",omitempty"`
+
+	// Retries is the number of retries of failed GET requests to the REST API, rest.DefaultRetries if not set.
+	// A negative number disables retries.
+	Retries int `yaml:",omitempty"`
+}
+
+// NameOrDefault returns the configured name of the gateway or "default"
+func (c APIConfig) NameOrDefault() string {
+	if c.Name == "" {
+		return DefaultGatewayName
+	}
+	return c.Name
+}
+
+// Client returns a client of the REST API using the TLS, timeout and retry settings
+func (c APIConfig) Client() (*rest.Client, error) {
+	client, err := c.TLS.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return rest.New(client, rest.Options{Timeout: c.Timeout, Retries: c.Retries}), nil
 }
 
 // config is used to parse the things we need from the deCONZ config endpoint
@@ -21,30 +55,30 @@ type config struct {
 }
 
 // DiscoverWebsocket tries to retrieve the websocket address from the deCONZ REST API
-// using the /config endpoint
-func (c *APIConfig) DiscoverWebsocket() error {
+// using the /config endpoint. The websocket uses wss:// if the REST API uses https://.
+func (c *APIConfig) DiscoverWebsocket(ctx context.Context) error {
 	u, err := url.Parse(c.Addr)
 	if err != nil {
 		return fmt.Errorf("unable to discover websocket while parsing config: %s", err)
 	}
 	u.Path = path.Join(u.Path, c.APIKey, "config")
 
-	resp, err := http.Get(u.String())
+	client, err := c.Client()
 	if err != nil {
-		return fmt.Errorf("unable to discover websocket while getting config: %s", err)
+		return fmt.Errorf("unable to discover websocket: %s", err)
 	}
-	defer resp.Body.Close()
-
-	dec := json.NewDecoder(resp.Body)
 
 	var conf config
-	err = dec.Decode(&conf)
-	if err != nil {
-		return fmt.Errorf("unable to discover websocket while decoding response: %s", err)
+	if err := client.Get(ctx, u.String(), &conf); err != nil {
+		return fmt.Errorf("unable to discover websocket while getting config: %w", err)
 	}
 
 	// change our old parsed URL to websocket, it should connect to the websocket endpoint of deCONZ
-	u.Scheme = "ws"
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
 	u.Path = "/"
 	u.Host = fmt.Sprintf("%s:%d", u.Hostname(), conf.Websocketport)
 
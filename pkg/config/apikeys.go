@@ -0,0 +1,125 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// whitelistDateLayout is the layout of dates in the whitelist of the deCONZ config, in UTC
+const whitelistDateLayout = "2006-01-02T15:04:05"
+
+// WhitelistEntry is an API key registered at the gateway
+type WhitelistEntry struct {
+	Key APIKey
+	// Name is the devicetype given when the key was created, "Deflux" for keys created by deflux
+	Name        string
+	CreateDate  time.Time
+	LastUseDate time.Time
+}
+
+// Redacted returns the first characters of the key, e.g. for error messages that end up in logs
+func (k APIKey) Redacted() string {
+	if len(k) <= 4 {
+		return redacted
+	}
+	return string(k[:4]) + "..."
+}
+
+// IsDeflux returns true if the key has been created by deflux
+func (e WhitelistEntry) IsDeflux() bool {
+	return strings.HasPrefix(strings.ToLower(e.Name), "deflux")
+}
+
+// whitelistConfig is used to parse the whitelist from the deCONZ config endpoint
+// The whitelist is only included if the request is authorized.
+type whitelistConfig struct {
+	Whitelist map[string]struct {
+		Name        string `json:"name"`
+		CreateDate  string `json:"create date"`
+		LastUseDate string `json:"last use date"`
+	} `json:"whitelist"`
+}
+
+// Whitelist returns the API keys registered at the gateway, sorted by creation date
+func (c *APIConfig) Whitelist(ctx context.Context) ([]WhitelistEntry, error) {
+	var conf whitelistConfig
+	if err := c.apiRequest(ctx, http.MethodGet, "config", &conf); err != nil {
+		return nil, fmt.Errorf("unable to get whitelist: %w", err)
+	}
+	if conf.Whitelist == nil {
+		return nil, fmt.Errorf("unable to get whitelist: API key %s is not authorized",
+			APIKey(c.APIKey).Redacted())
+	}
+
+	entries := make([]WhitelistEntry, 0, len(conf.Whitelist))
+	for key, w := range conf.Whitelist {
+		e := WhitelistEntry{Key: APIKey(key), Name: w.Name}
+		// dates are missing for keys that have never been used
+		if t, err := time.ParseInLocation(whitelistDateLayout, w.CreateDate, time.UTC); err == nil {
+			e.CreateDate = t
+		}
+		if t, err := time.ParseInLocation(whitelistDateLayout, w.LastUseDate, time.UTC); err == nil {
+			e.LastUseDate = t
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreateDate.Before(entries[j].CreateDate)
+	})
+
+	return entries, nil
+}
+
+// VerifyAPIKey returns nil if the configured API key is accepted by the gateway
+func (c *APIConfig) VerifyAPIKey(ctx context.Context) error {
+	var conf whitelistConfig
+	if err := c.apiRequest(ctx, http.MethodGet, "config", &conf); err != nil {
+		return err
+	}
+
+	// deCONZ returns a reduced config without whitelist for unknown keys
+	if _, ok := conf.Whitelist[c.APIKey]; !ok {
+		return fmt.Errorf("API key %s is not authorized", APIKey(c.APIKey).Redacted())
+	}
+
+	return nil
+}
+
+// RevokeAPIKey deletes an API key from the whitelist of the gateway
+func (c *APIConfig) RevokeAPIKey(ctx context.Context, key APIKey) error {
+	if err := c.apiRequest(ctx, http.MethodDelete, path.Join("config", "whitelist", string(key)), nil); err != nil {
+		return fmt.Errorf("unable to revoke API key %s: %w", key.Redacted(), err)
+	}
+
+	return nil
+}
+
+// apiRequest sends a request to an endpoint of the REST API, authorized by the configured API key, and decodes the
+// response into v, if it is not nil. Error responses of deCONZ are returned as *APIError, see rest.Client.Do for the
+// other error types.
+func (c *APIConfig) apiRequest(ctx context.Context, method, endpoint string, v interface{}) error {
+	u, err := url.Parse(c.Addr)
+	if err != nil {
+		return fmt.Errorf("unable to parse address: %s", err)
+	}
+	u.Path = path.Join(u.Path, c.APIKey, endpoint)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %s", err)
+	}
+
+	client, err := c.Client()
+	if err != nil {
+		return err
+	}
+
+	return client.Do(req, v)
+}
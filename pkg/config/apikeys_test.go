@@ -0,0 +1,92 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeWhitelistServer(t *testing.T) (*httptest.Server, map[string]bool) {
+	whitelist := map[string]bool{"83A0C7D1E2": true, "1234567890": true, "ABCDEF0123": true}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 3 || parts[0] != "api" || parts[2] != "config" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !whitelist[parts[1]] {
+			// deCONZ returns a reduced config for unknown keys
+			_, _ = w.Write([]byte(`{"apiversion": "1.16.0", "name": "Phoscon-GW"}`))
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && len(parts) == 3:
+			var entries []string
+			for key := range whitelist {
+				entries = append(entries, fmt.Sprintf(`"%s": {"create date": "2022-01-0%dT10:00:00", "last use date": "2022-01-10T12:00:00", "name": "Deflux"}`, key, len(entries)+1))
+			}
+			_, _ = w.Write([]byte(`{"name": "Phoscon-GW", "whitelist": {` + strings.Join(entries, ",") + `}}`))
+		case r.Method == http.MethodDelete && len(parts) == 5 && parts[3] == "whitelist":
+			if !whitelist[parts[4]] {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`[{"error": {"type": 3, "address": "/config/whitelist/` + parts[4] + `", "description": "resource not available"}}]`))
+				return
+			}
+			delete(whitelist, parts[4])
+			_, _ = w.Write([]byte(`[{"success": "/config/whitelist/` + parts[4] + ` deleted."}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, whitelist
+}
+
+func TestWhitelist(t *testing.T) {
+	srv, whitelist := fakeWhitelistServer(t)
+	c := APIConfig{Addr: srv.URL + "/api", APIKey: "83A0C7D1E2"}
+
+	entries, err := c.Whitelist(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get whitelist: %s", err)
+	}
+	if len(entries) != 3 || !entries[0].IsDeflux() || !entries[0].CreateDate.Before(entries[1].CreateDate) ||
+		!entries[0].LastUseDate.Equal(time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected whitelist: %+v", entries)
+	}
+
+	if err := c.VerifyAPIKey(context.Background()); err != nil {
+		t.Fatalf("expected valid key, got %s", err)
+	}
+
+	if err := c.RevokeAPIKey(context.Background(), "1234567890"); err != nil {
+		t.Fatalf("failed to revoke key: %s", err)
+	}
+	if whitelist["1234567890"] {
+		t.Fatalf("key not revoked")
+	}
+
+	var apiErr *APIError
+	if err := c.RevokeAPIKey(context.Background(), "1234567890"); !errors.As(err, &apiErr) || apiErr.Type != 3 {
+		t.Fatalf("expected resource not available error, got %v", err)
+	}
+
+	// errors show only the first characters of the key
+	invalid := APIConfig{Addr: srv.URL + "/api", APIKey: "1234567890"}
+	if err := invalid.VerifyAPIKey(context.Background()); err == nil || !strings.Contains(err.Error(), "1234...") ||
+		strings.Contains(err.Error(), "1234567890") {
+		t.Fatalf("expected invalid key with redacted key, got %v", err)
+	}
+	if _, err := invalid.Whitelist(context.Background()); err == nil || strings.Contains(err.Error(), "1234567890") {
+		t.Fatalf("expected error for unauthorized whitelist with redacted key, got %v", err)
+	}
+}
@@ -8,25 +8,331 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strings"
 	"time"
 )
 
 // YmlFileName is the name of the default config file
 const YmlFileName = "deflux.yml"
 
+const (
+	// SinkInfluxDB is the name of the InfluxDB sink
+	SinkInfluxDB = "influxdb"
+	// SinkPrometheus is the name of the Prometheus exporter sink
+	SinkPrometheus = "prometheus"
+	// SinkMQTT is the name of the MQTT publisher sink
+	SinkMQTT = "mqtt"
+)
+
+// TimestampPolicy selects the time of sensor measurements
+type TimestampPolicy string
+
+const (
+	// TimestampReceive uses the time deflux received the measurement
+	TimestampReceive TimestampPolicy = "receive"
+	// TimestampLastUpdated uses the lastupdated time reported by deCONZ
+	TimestampLastUpdated TimestampPolicy = "lastupdated"
+	// TimestampBoth uses the receive time for websocket events and the lastupdated time for values of the REST API
+	TimestampBoth TimestampPolicy = "both"
+)
+
+// UseLastUpdated returns true if the lastupdated time of the sensor shall be used as time of a measurement from the
+// websocket or the REST API
+func (p TimestampPolicy) UseLastUpdated(websocket bool) bool {
+	switch p {
+	case TimestampLastUpdated:
+		return true
+	case TimestampBoth:
+		return !websocket
+	}
+
+	return false
+}
+
+// Valid returns true if the policy is known. An empty policy is valid and equals TimestampReceive.
+func (p TimestampPolicy) Valid() bool {
+	switch p {
+	case "", TimestampReceive, TimestampLastUpdated, TimestampBoth:
+		return true
+	}
+
+	return false
+}
+
+// DefaultPrometheusListen is the default listen address of the Prometheus exporter
+const DefaultPrometheusListen = ":9110"
+
 // InfluxDB stores the InfluxDB configuration
 type InfluxDB struct {
 	URL    string
 	Token  string
 	Org    string
 	Bucket string
+
+	// TLS configures the connection to an https:// URL
+	TLS TLSConfig `yaml:",omitempty"`
+
+	// Buffer configures the on-disk buffer for points that have not been written yet
+	Buffer BufferConfig
+}
+
+// Default limits of the on-disk buffer
+const (
+	DefaultBufferDir     = "/var/lib/deflux/buffer"
+	DefaultBufferMaxSize = 64 << 20
+	DefaultBufferMaxAge  = 7 * 24 * time.Hour
+)
+
+// BufferConfig holds the configuration of the on-disk write-ahead buffer for InfluxDB
+type BufferConfig struct {
+	// Enabled set true persists points on disk before they are sent to InfluxDB. Points are retried until
+	// InfluxDB accepts them, even across restarts of deflux.
+	Enabled bool
+
+	// Dir is the directory that holds the buffered points
+	Dir string
+
+	// MaxSize is the maximum size of the buffer in bytes. The oldest points are dropped when it is exceeded.
+	MaxSize int64
+
+	// MaxAge is the duration after which buffered points are dropped
+	MaxAge time.Duration
+}
+
+// DirOrDefault returns the configured buffer directory or DefaultBufferDir
+func (b BufferConfig) DirOrDefault() string {
+	if b.Dir == "" {
+		return DefaultBufferDir
+	}
+	return b.Dir
+}
+
+// MaxSizeOrDefault returns the configured maximum buffer size or DefaultBufferMaxSize
+func (b BufferConfig) MaxSizeOrDefault() int64 {
+	if b.MaxSize <= 0 {
+		return DefaultBufferMaxSize
+	}
+	return b.MaxSize
+}
+
+// MaxAgeOrDefault returns the configured maximum age of buffered points or DefaultBufferMaxAge
+func (b BufferConfig) MaxAgeOrDefault() time.Duration {
+	if b.MaxAge <= 0 {
+		return DefaultBufferMaxAge
+	}
+	return b.MaxAge
+}
+
+// Prometheus stores the configuration of the Prometheus exporter
+type Prometheus struct {
+	// Listen is the address of the HTTP listener serving /metrics, e.g. ":9110"
+	Listen string
+}
+
+// ListenAddr returns the configured listen address or DefaultPrometheusListen
+func (p Prometheus) ListenAddr() string {
+	if p.Listen == "" {
+		return DefaultPrometheusListen
+	}
+	return p.Listen
+}
+
+// MQTT stores the configuration of the MQTT publisher
+type MQTT struct {
+	// Broker is the URL of the MQTT broker, e.g. tcp://localhost:1883
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+
+	// Topic is the prefix of the topics measurements are published on, default "deflux"
+	Topic string
+	QoS   byte
+	// Retain set true publishes measurements as retained messages
+	Retain bool
+
+	// Discovery set true publishes Home Assistant MQTT discovery configs
+	Discovery bool
+	// DiscoveryPrefix is the Home Assistant discovery prefix, default "homeassistant"
+	DiscoveryPrefix string
+}
+
+// ClientIDOrDefault returns the configured client id or "deflux"
+func (m MQTT) ClientIDOrDefault() string {
+	if m.ClientID == "" {
+		return "deflux"
+	}
+	return m.ClientID
+}
+
+// TopicOrDefault returns the configured topic prefix or "deflux"
+func (m MQTT) TopicOrDefault() string {
+	if m.Topic == "" {
+		return "deflux"
+	}
+	return strings.TrimSuffix(m.Topic, "/")
+}
+
+// DiscoveryPrefixOrDefault returns the configured discovery prefix or "homeassistant"
+func (m MQTT) DiscoveryPrefixOrDefault() string {
+	if m.DiscoveryPrefix == "" {
+		return "homeassistant"
+	}
+	return strings.TrimSuffix(m.DiscoveryPrefix, "/")
+}
+
+// DefaultStatusReadyTimeout is the default duration a websocket may be disconnected before deflux is not ready
+const DefaultStatusReadyTimeout = 2 * time.Minute
+
+// StatusConfig holds the configuration of the HTTP listener serving health, readiness and status
+type StatusConfig struct {
+	// Listen is the address of the HTTP listener, e.g. ":9111". The listener is disabled if it is empty.
+	Listen string
+
+	// ReadyTimeout is the duration a websocket may be disconnected before /readyz fails
+	ReadyTimeout time.Duration
+}
+
+// ReadyTimeoutOrDefault returns the configured ready timeout or DefaultStatusReadyTimeout
+func (s StatusConfig) ReadyTimeoutOrDefault() time.Duration {
+	if s.ReadyTimeout <= 0 {
+		return DefaultStatusReadyTimeout
+	}
+	return s.ReadyTimeout
+}
+
+// Defaults of the websocket connection settings
+const (
+	// DefaultWebsocketBackoffMin is the default delay before the first reconnect attempt
+	DefaultWebsocketBackoffMin = 1 * time.Second
+	// DefaultWebsocketBackoffMax is the default maximum delay between reconnect attempts
+	DefaultWebsocketBackoffMax = 2 * time.Minute
+	// DefaultWebsocketPingInterval is the default interval of ping frames
+	DefaultWebsocketPingInterval = 30 * time.Second
+	// DefaultWebsocketPongTimeout is the default duration to wait for a pong after a ping
+	DefaultWebsocketPongTimeout = 10 * time.Second
+)
+
+// WebsocketConfig holds the connection settings of the deCONZ websockets
+type WebsocketConfig struct {
+	// BackoffMin is the delay before the first reconnect attempt. It doubles with every failed attempt up to
+	// BackoffMax, and a random jitter of up to half the delay is subtracted.
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+
+	// PingInterval is the interval of ping frames sent to deCONZ. The connection is considered dead if neither a
+	// message nor a pong has been received for PingInterval plus PongTimeout.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// WatchdogTimeout reconnects the websocket if no message has been received for this duration, even if deCONZ
+	// answers pings. Zero disables the watchdog.
+	WatchdogTimeout time.Duration
+}
+
+// WithDefaults returns the settings with the defaults in place of durations that are not set
+func (w WebsocketConfig) WithDefaults() WebsocketConfig {
+	if w.BackoffMin <= 0 {
+		w.BackoffMin = DefaultWebsocketBackoffMin
+	}
+	if w.BackoffMax <= 0 {
+		w.BackoffMax = DefaultWebsocketBackoffMax
+	}
+	if w.BackoffMax < w.BackoffMin {
+		w.BackoffMax = w.BackoffMin
+	}
+	if w.PingInterval <= 0 {
+		w.PingInterval = DefaultWebsocketPingInterval
+	}
+	if w.PongTimeout <= 0 {
+		w.PongTimeout = DefaultWebsocketPongTimeout
+	}
+	return w
+}
+
+// DefaultCacheRefreshInterval is the default interval in which the caches are refreshed from the REST API
+const DefaultCacheRefreshInterval = 1 * time.Minute
+
+// CacheConfig holds the settings of the sensor, light and group caches of the gateways
+type CacheConfig struct {
+	// RefreshInterval is the interval in which the caches are refreshed from the REST API. The sensor cache is
+	// refreshed in the background, and serves the previous sensors while the REST API is queried.
+	RefreshInterval time.Duration
+}
+
+// RefreshIntervalOrDefault returns the configured refresh interval or DefaultCacheRefreshInterval
+func (c CacheConfig) RefreshIntervalOrDefault() time.Duration {
+	if c.RefreshInterval <= 0 {
+		return DefaultCacheRefreshInterval
+	}
+	return c.RefreshInterval
 }
 
 // Configuration holds data for Deconz and InfluxDB configuration
 type Configuration struct {
-	Deconz     APIConfig
+	Deconz APIConfig
+
+	// Gateways lists the deCONZ gateways to read from. If it is empty, Deconz is used.
+	Gateways []APIConfig `yaml:",omitempty"`
+
 	InfluxDB   InfluxDB
+	Prometheus Prometheus
+	MQTT       MQTT
 	FillValues FillConfig
+
+	// Health configures the deflux_device_health measurement
+	Health HealthConfig
+
+	// Internal configures the deflux_internal measurement
+	Internal InternalConfig
+
+	// Status configures the HTTP listener serving /healthz, /readyz and /status
+	Status StatusConfig
+
+	// Websocket configures reconnects and liveness checks of the deCONZ websockets
+	Websocket WebsocketConfig
+
+	// Cache configures the caches of sensors, lights and groups of the gateways
+	Cache CacheConfig
+
+	// Timestamp selects the time of sensor measurements: receive, lastupdated or both
+	Timestamp TimestampPolicy
+
+	// Sensors selects the sensors that are written and overrides their properties
+	Sensors SensorsConfig `yaml:",omitempty"`
+
+	// Sinks lists the names of the sinks that measurements are written to.
+	// If it is empty, measurements are written to InfluxDB.
+	Sinks []string
+
+	// File is the config file the configuration has been loaded from, empty if there is none
+	File string `yaml:"-"`
+}
+
+// SinkNames returns the names of the configured sinks
+func (c *Configuration) SinkNames() []string {
+	if len(c.Sinks) == 0 {
+		return []string{SinkInfluxDB}
+	}
+	return c.Sinks
+}
+
+// GatewayConfigs returns the configured deCONZ gateways
+// It returns an error if the names of the gateways are not unique.
+func (c *Configuration) GatewayConfigs() ([]APIConfig, error) {
+	if len(c.Gateways) == 0 {
+		return []APIConfig{c.Deconz}, nil
+	}
+
+	names := make(map[string]bool, len(c.Gateways))
+	for _, gw := range c.Gateways {
+		if names[gw.NameOrDefault()] {
+			return nil, fmt.Errorf("gateway name %q is not unique", gw.NameOrDefault())
+		}
+		names[gw.NameOrDefault()] = true
+	}
+
+	return c.Gateways, nil
 }
 
 // FillConfig holds configuration for polling sensor measurements from the REST API
@@ -47,52 +353,130 @@ type FillConfig struct {
 	LastSeenTimeout time.Duration
 }
 
-// LoadConfiguration loads the deflux configuration from a file.
+// HealthConfig holds configuration for writing the reachable and lastseen state of sensors as time series
+type HealthConfig struct {
+	// Enabled set true writes the deflux_device_health measurement
+	Enabled bool
+
+	// Interval defines the duration after which the health of all sensors is written again.
+	// Changes of the reachable or online state are written immediately.
+	Interval time.Duration
+}
+
+// InternalConfig holds configuration for writing the self-instrumentation metrics of deflux as time series
+type InternalConfig struct {
+	// Enabled set true writes the deflux_internal measurement to InfluxDB
+	Enabled bool
+
+	// Interval defines the duration after which the metrics are written again
+	Interval time.Duration
+}
+
+// SensorsConfig holds rules to filter sensors and to override their properties
+// The rules apply to sensor measurements and device health, both from the websocket and the REST API.
+type SensorsConfig struct {
+	// Include selects the sensors that are written. If it is empty, all sensors are written.
+	Include SensorMatch `yaml:",omitempty"`
+
+	// Exclude selects sensors that are not written, even if they are included
+	Exclude SensorMatch `yaml:",omitempty"`
+
+	// Overrides change properties of the sensors they match. If several overrides match a sensor, later
+	// overrides take precedence.
+	Overrides []SensorOverride `yaml:",omitempty"`
+}
+
+// SensorMatch selects sensors. A sensor matches if any of the criteria matches.
+type SensorMatch struct {
+	// IDs are numeric sensor ids of the deCONZ API
+	IDs []int `yaml:",omitempty"`
+
+	// UniqueIDs are unique ids of sensors, e.g. 00:15:8d:12:34:bd:ff:71-01-0402
+	UniqueIDs []string `yaml:",omitempty"`
+
+	// Names are glob patterns of sensor names as supported by path.Match, e.g. "test-*"
+	Names []string `yaml:",omitempty"`
+
+	// Types are sensor types, e.g. CLIPPresence
+	Types []string `yaml:",omitempty"`
+
+	// Gateways are names of gateways. If set, only sensors of these gateways match.
+	Gateways []string `yaml:",omitempty"`
+}
+
+// SensorOverride overrides properties of the matching sensors
+type SensorOverride struct {
+	Match SensorMatch
+
+	// Measurement replaces the measurement name deflux_<sensor type>
+	Measurement string `yaml:",omitempty"`
+
+	// Tags are added to all measurements of the sensor, e.g. room or floor
+	Tags map[string]string `yaml:",omitempty"`
+
+	// FillInterval replaces fillvalues.fillinterval for the sensor
+	FillInterval time.Duration `yaml:",omitempty"`
+}
+
+// LoadConfiguration loads the deflux configuration from a file and applies DEFLUX_* environment variables on top.
 // The file parameter provides a location. If it is empty, deflux tries the default config file locations
-// ./deflux.yml and /etc/deflux.yml
+// ./deflux.yml and /etc/deflux.yml. Without a config file, the configuration may be given by environment variables
+// alone.
 func LoadConfiguration(file string) (*Configuration, error) {
-	data, err := readConfiguration(file)
-	if err != nil {
+	var config Configuration
+
+	data, file, err := readConfiguration(file)
+	switch {
+	case err == nil:
+		config.File = file
+		// reject unknown keys, a misspelled key would silently leave its value empty
+		err = yaml.UnmarshalStrict(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse configuration: %s", err)
+		}
+	case file == "" && hasEnvironment(os.LookupEnv):
+		slog.Info("No config file found, using configuration from environment")
+	default:
 		return nil, fmt.Errorf("could not read configuration: %s", err)
 	}
 
-	var config Configuration
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse configuration: %s", err)
+	if err := config.ApplyEnvironment(); err != nil {
+		return nil, fmt.Errorf("could not apply environment: %s", err)
 	}
+
 	return &config, nil
 }
 
-// readConfiguration reads the config file.
+// readConfiguration reads the config file and returns its content and path.
 // If file is an empty string, it tries to read $(pwd)/deflux.yml and /etc/deflux.yml
-func readConfiguration(file string) ([]byte, error) {
+func readConfiguration(file string) ([]byte, string, error) {
 	if file != "" {
-		return ioutil.ReadFile(file)
+		data, err := ioutil.ReadFile(file)
+		return data, file, err
 	}
 
 	// first try to load ${pwd}/deflux.yml
 	pwd, err := os.Getwd()
 	if err != nil {
-		return nil, fmt.Errorf("unable to get current work directory: %s", err)
+		return nil, "", fmt.Errorf("unable to get current work directory: %s", err)
 	}
 
 	pwdPath := path.Join(pwd, YmlFileName)
 	data, pwdErr := ioutil.ReadFile(pwdPath)
 	if pwdErr == nil {
 		slog.Info(fmt.Sprintf("Using configuration %s", pwdPath))
-		return data, nil
+		return data, pwdPath, nil
 	}
 
 	// ${pwd}/deflux.yml does not exist, try from /etc/deflux.yml
 	etcPath := path.Join("/etc", YmlFileName)
 	data, etcErr := ioutil.ReadFile(etcPath)
 	if etcErr != nil {
-		return nil, fmt.Errorf("\n%s\n%s", pwdErr, etcErr)
+		return nil, "", fmt.Errorf("\n%s\n%s", pwdErr, etcErr)
 	}
 
 	slog.Info(fmt.Sprintf("Using configuration %s", etcPath))
-	return data, nil
+	return data, etcPath, nil
 }
 
 // OutputDefaultConfiguration tries to pair with deCONZ and prints the default config to stdout
@@ -109,7 +493,7 @@ func OutputDefaultConfiguration() {
 			if _, err := fmt.Fprintf(os.Stderr, "## Could not pair with deconz: %s\n", err); err != nil {
 				panic(err)
 			}
-			if _, err := fmt.Fprintln(os.Stderr, "## Please add the API key manually"); err != nil {
+			if _, err := fmt.Fprintln(os.Stderr, "## Please add the API key manually, or run `deflux pair -config <file>`"); err != nil {
 				panic(err)
 			}
 		}
@@ -118,7 +502,7 @@ func OutputDefaultConfiguration() {
 
 	yml, err := yaml.Marshal(c)
 	if err != nil {
-		slog.Error("Unable to generate default configuration: %s", err)
+		slog.Error(fmt.Sprintf("Unable to generate default configuration: %s", err))
 		os.Exit(1)
 	}
 
@@ -138,6 +522,23 @@ func defaultConfiguration() *Configuration {
 			Token:  "SECRET",
 			Org:    "organization",
 			Bucket: "default",
+			Buffer: BufferConfig{
+				Enabled: false,
+				Dir:     DefaultBufferDir,
+				MaxSize: DefaultBufferMaxSize,
+				MaxAge:  DefaultBufferMaxAge,
+			},
+		},
+		Prometheus: Prometheus{
+			Listen: DefaultPrometheusListen,
+		},
+		MQTT: MQTT{
+			Broker:          "tcp://localhost:1883",
+			ClientID:        "deflux",
+			Topic:           "deflux",
+			Retain:          true,
+			Discovery:       false,
+			DiscoveryPrefix: "homeassistant",
 		},
 		FillValues: FillConfig{
 			Enabled:         false,
@@ -145,6 +546,29 @@ func defaultConfiguration() *Configuration {
 			FillInterval:    30 * time.Minute,
 			LastSeenTimeout: 2 * time.Hour,
 		},
+		Health: HealthConfig{
+			Enabled:  false,
+			Interval: 15 * time.Minute,
+		},
+		Internal: InternalConfig{
+			Enabled:  false,
+			Interval: 1 * time.Minute,
+		},
+		Status: StatusConfig{
+			ReadyTimeout: DefaultStatusReadyTimeout,
+		},
+		Websocket: WebsocketConfig{
+			BackoffMin:      DefaultWebsocketBackoffMin,
+			BackoffMax:      DefaultWebsocketBackoffMax,
+			PingInterval:    DefaultWebsocketPingInterval,
+			PongTimeout:     DefaultWebsocketPongTimeout,
+			WatchdogTimeout: 10 * time.Minute,
+		},
+		Cache: CacheConfig{
+			RefreshInterval: DefaultCacheRefreshInterval,
+		},
+		Timestamp: TimestampReceive,
+		Sinks:     []string{SinkInfluxDB},
 	}
 
 	// let's see if we are able to discover a gateway, and overwrite parts of the
@@ -162,19 +586,13 @@ func defaultConfiguration() *Configuration {
 			panic(err1)
 		}
 		for i, di := range discovered {
-			if _, err1 := fmt.Fprintf(os.Stderr, "### %d - http://%s:%d\n", i+1, di.InternalIPAddress, di.InternalPort); err1 != nil {
+			if _, err1 := fmt.Fprintf(os.Stderr, "### %d - %s http://%s:%d\n", i+1, di.Name, di.InternalIPAddress, di.InternalPort); err1 != nil {
 				panic(err1)
 			}
 		}
 	}
 
-	d := discovered[0]
-	addr := url.URL{
-		Scheme: "http",
-		Host:   fmt.Sprintf("%s:%d", d.InternalIPAddress, d.InternalPort),
-		Path:   "/api",
-	}
-	c.Deconz.Addr = addr.String()
+	c.Deconz.Addr = discovered[0].Addr()
 
 	return &c
 }
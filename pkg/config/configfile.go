@@ -0,0 +1,143 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SetAPIKey writes the API key of a gateway into an existing config file
+// Other parts of the file, including comments, are preserved. If gateway is empty, the key is set in the deconz
+// section, otherwise in the entry of the gateways list with that name.
+func SetAPIKey(file, gateway string, key APIKey) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %s", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("unable to parse config file: %s", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("config file %s is not a YAML mapping", file)
+	}
+
+	section, err := gatewayNode(doc.Content[0], gateway)
+	if err != nil {
+		return err
+	}
+	setMappingValue(section, "apikey", string(key))
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return fmt.Errorf("unable to encode config file: %s", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("unable to encode config file: %s", err)
+	}
+
+	return writeFileAtomic(file, buf.Bytes())
+}
+
+// gatewayNode returns the mapping node of the configuration of a gateway
+func gatewayNode(root *yaml.Node, gateway string) (*yaml.Node, error) {
+	gateways := mappingValue(root, "gateways")
+	hasGateways := gateways != nil && gateways.Kind == yaml.SequenceNode && len(gateways.Content) > 0
+
+	if gateway == "" {
+		if hasGateways {
+			return nil, fmt.Errorf("config file lists several gateways, select one by name")
+		}
+
+		deconz := mappingValue(root, "deconz")
+		if deconz == nil {
+			deconz = &yaml.Node{Kind: yaml.MappingNode}
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "deconz"}, deconz)
+		}
+		if deconz.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("deconz section of config file is not a mapping")
+		}
+		return deconz, nil
+	}
+
+	if hasGateways {
+		for _, gw := range gateways.Content {
+			if gw.Kind != yaml.MappingNode {
+				continue
+			}
+
+			name := DefaultGatewayName
+			if n := mappingValue(gw, "name"); n != nil && n.Value != "" {
+				name = n.Value
+			}
+			if name == gateway {
+				return gw, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("gateway %q not found in config file", gateway)
+}
+
+// mappingValue returns the value of a key of a mapping node, or nil if the key does not exist
+// Keys are compared case-insensitively, like the YAML decoder of the configuration does.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if strings.EqualFold(n.Content[i].Value, key) {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue sets a key of a mapping node to a quoted string
+func setMappingValue(n *yaml.Node, key, value string) {
+	v := mappingValue(n, key)
+	if v == nil {
+		v = &yaml.Node{}
+		n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, v)
+	}
+
+	v.Kind = yaml.ScalarNode
+	v.Tag = "!!str"
+	v.Style = yaml.DoubleQuotedStyle
+	v.Value = value
+}
+
+// writeFileAtomic replaces the content of file, keeping its permissions
+func writeFileAtomic(file string, data []byte) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("unable to stat config file: %s", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write temporary file: %s", err)
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to set permissions of temporary file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write temporary file: %s", err)
+	}
+
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("unable to replace config file: %s", err)
+	}
+
+	return nil
+}
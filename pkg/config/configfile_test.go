@@ -0,0 +1,75 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetAPIKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deflux.yml")
+	content := `# deflux configuration
+deconz:
+  addr: http://127.0.0.1/api
+  apikey: change me # replace by deflux pair
+influxdb:
+  url: http://localhost:8086
+`
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %s", err)
+	}
+
+	if err := SetAPIKey(file, "", "83A0C7D1E2"); err != nil {
+		t.Fatalf("failed to set API key: %s", err)
+	}
+
+	cfg, err := LoadConfiguration(file)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	if cfg.Deconz.APIKey != "83A0C7D1E2" || cfg.Deconz.Addr != "http://127.0.0.1/api" || cfg.InfluxDB.URL != "http://localhost:8086" {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+
+	data, _ := os.ReadFile(file)
+	if !strings.Contains(string(data), "# deflux configuration") {
+		t.Fatalf("comments not preserved:\n%s", data)
+	}
+	if info, _ := os.Stat(file); info.Mode().Perm() != 0o600 {
+		t.Fatalf("permissions not preserved: %s", info.Mode())
+	}
+
+	if err := SetAPIKey(file, "building-a", "83A0C7D1E2"); err == nil {
+		t.Fatalf("expected error for unknown gateway")
+	}
+}
+
+func TestSetAPIKeyGateways(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deflux.yml")
+	content := `gateways:
+- name: building-a
+  addr: http://10.0.1.2/api
+  apikey: "123A4B5C67"
+- name: building-b
+  addr: http://10.0.2.2/api
+`
+	if err := os.WriteFile(file, []byte(content), 0o640); err != nil {
+		t.Fatalf("failed to write config: %s", err)
+	}
+
+	if err := SetAPIKey(file, "", "83A0C7D1E2"); err == nil {
+		t.Fatalf("expected error without gateway name")
+	}
+	if err := SetAPIKey(file, "building-b", "83A0C7D1E2"); err != nil {
+		t.Fatalf("failed to set API key: %s", err)
+	}
+
+	cfg, err := LoadConfiguration(file)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	if len(cfg.Gateways) != 2 || cfg.Gateways[0].APIKey != "123A4B5C67" || cfg.Gateways[1].APIKey != "83A0C7D1E2" {
+		t.Fatalf("unexpected gateways: %+v", cfg.Gateways)
+	}
+}
@@ -1,9 +1,12 @@
 package config
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/rvk01/deflux/pkg/deconz/rest"
 	"net/http"
+	"net/url"
 )
 
 // DeconzDiscoveryEndpoint is the URL used when auto discovering a deCONZ gateway
@@ -23,21 +26,38 @@ type Discovery struct {
 	InternalPort      uint
 }
 
-// Discover discovers deCONZ gateways
-func Discover() (DiscoveryResponse, error) {
-	response, err := http.Get(DeconzDiscoveryEndpoint)
-	if err != nil {
-		return nil, fmt.Errorf("unable to talk to discovery endpoint: %s", err)
+// Addr returns the address of the REST API of the gateway
+func (d Discovery) Addr() string {
+	addr := url.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("%s:%d", d.InternalIPAddress, d.InternalPort),
+		Path:   "/api",
 	}
+	return addr.String()
+}
 
-	var data DiscoveryResponse
+// Discover discovers deCONZ gateways in the local network and using the cloud discovery endpoint
+// Gateways found by both methods are merged. Discover fails only if no gateway has been found at all.
+func Discover() (DiscoveryResponse, error) {
+	local, localErr := LocalDiscoverer{}.Discover()
+	cloud, cloudErr := DiscoverCloud()
+
+	data := mergeDiscoveries(local, cloud)
+	if len(data) == 0 {
+		if localErr == nil {
+			localErr = errors.New("no gateways found")
+		}
+		return nil, fmt.Errorf("local discovery: %s, cloud discovery: %s", localErr, cloudErr)
+	}
 
-	d := json.NewDecoder(response.Body)
-	defer response.Body.Close()
+	return data, nil
+}
 
-	err = d.Decode(&data)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse json from discovery endpoint: %s", err)
+// DiscoverCloud discovers deCONZ gateways using DeconzDiscoveryEndpoint
+func DiscoverCloud() (DiscoveryResponse, error) {
+	var data DiscoveryResponse
+	if err := rest.New(http.DefaultClient, rest.Options{}).Get(context.Background(), DeconzDiscoveryEndpoint, &data); err != nil {
+		return nil, fmt.Errorf("unable to talk to discovery endpoint: %s", err)
 	}
 
 	if len(data) == 0 {
@@ -0,0 +1,218 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of environment variables overriding the configuration
+const EnvPrefix = "DEFLUX"
+
+// envFileSuffix is appended to the name of an environment variable to read its value from a file
+const envFileSuffix = "_FILE"
+
+// redacted replaces secrets in the output of the configuration
+const redacted = "<redacted>"
+
+// lookupFunc looks up an environment variable, see os.LookupEnv
+type lookupFunc func(key string) (string, bool)
+
+// ApplyEnvironment overrides the configuration with DEFLUX_* environment variables
+// Variable names are built from the upper-case names of the config keys, joined by underscores, e.g.
+// DEFLUX_INFLUXDB_TOKEN or DEFLUX_FILLVALUES_FILLINTERVAL. Entries of lists like gateways are addressed by their
+// index, e.g. DEFLUX_GATEWAYS_0_APIKEY. Entries after the last one of the config file are added, as long as the
+// indexes are consecutive. Lists of values are separated by commas.
+// Each variable can be suffixed with _FILE to read the value from a file instead, e.g. from a Docker secret.
+func (c *Configuration) ApplyEnvironment() error {
+	return applyEnvironment(reflect.ValueOf(c).Elem(), EnvPrefix, os.LookupEnv)
+}
+
+// hasEnvironment returns true if an environment variable overriding a config value is set
+// Other DEFLUX_* variables, e.g. of tests, are not taken into account.
+func hasEnvironment(lookup lookupFunc) bool {
+	var found bool
+	var c Configuration
+	// errors are reported when the environment is applied
+	_ = applyEnvironment(reflect.ValueOf(&c).Elem(), EnvPrefix, recordLookup(lookup, &found))
+	return found
+}
+
+// recordLookup returns a lookupFunc that sets found when lookup finds a variable
+func recordLookup(lookup lookupFunc, found *bool) lookupFunc {
+	return func(key string) (string, bool) {
+		value, ok := lookup(key)
+		if ok {
+			*found = true
+		}
+		return value, ok
+	}
+}
+
+// applyEnvironment sets v and its fields from the environment variable name and its descendants
+func applyEnvironment(v reflect.Value, name string, lookup lookupFunc) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() || f.Tag.Get("yaml") == "-" {
+				continue
+			}
+			if err := applyEnvironment(v.Field(i), name+"_"+strings.ToUpper(f.Name), lookup); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len(); i++ {
+				if err := applyEnvironment(v.Index(i), fmt.Sprintf("%s_%d", name, i), lookup); err != nil {
+					return err
+				}
+			}
+
+			// add entries until there is no variable for the next index
+			for i := v.Len(); ; i++ {
+				var found bool
+				elem := reflect.New(v.Type().Elem()).Elem()
+				if err := applyEnvironment(elem, fmt.Sprintf("%s_%d", name, i), recordLookup(lookup, &found)); err != nil {
+					return err
+				}
+				if !found {
+					return nil
+				}
+				v.Set(reflect.Append(v, elem))
+			}
+		}
+
+	case reflect.Map:
+		// maps, e.g. static tags of sensors, can only be set in the config file
+		return nil
+	}
+
+	value, ok, err := lookupEnv(name, lookup)
+	if err != nil || !ok {
+		return err
+	}
+
+	if err := setValue(v, value); err != nil {
+		return fmt.Errorf("invalid value of %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// lookupEnv returns the value of the environment variable name, or the content of the file named by name_FILE
+func lookupEnv(name string, lookup lookupFunc) (string, bool, error) {
+	value, ok := lookup(name)
+	file, fileOK := lookup(name + envFileSuffix)
+
+	if ok && fileOK {
+		return "", false, fmt.Errorf("both %s and %s%s are set", name, name, envFileSuffix)
+	}
+
+	if fileOK {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", false, fmt.Errorf("unable to read %s%s: %s", name, envFileSuffix, err)
+		}
+		// secret files usually end with a newline
+		return strings.TrimRight(string(b), "\r\n"), true, nil
+	}
+
+	return value, ok, nil
+}
+
+// setValue parses s according to the type of v and sets v
+func setValue(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+
+	case reflect.Slice:
+		var parts []string
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+
+		slice := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setValue(slice.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets replaced, e.g. for printing
+func (c Configuration) Redacted() Configuration {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+
+	redact(&c.Deconz.APIKey)
+	redact(&c.InfluxDB.Token)
+	redact(&c.MQTT.Password)
+
+	c.Gateways = append([]APIConfig(nil), c.Gateways...)
+	for i := range c.Gateways {
+		redact(&c.Gateways[i].APIKey)
+	}
+
+	return c
+}
+
+// OutputConfiguration prints the effective configuration with secrets redacted to stdout
+func (c Configuration) OutputConfiguration() error {
+	yml, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return fmt.Errorf("unable to encode configuration: %s", err)
+	}
+
+	fmt.Print(string(yml))
+	return nil
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyEnvironment(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(secret, []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatalf("failed to write secret: %s", err)
+	}
+
+	env := map[string]string{
+		"DEFLUX_DECONZ_ADDR":                     "http://10.0.0.2/api",
+		"DEFLUX_GATEWAYS_1_APIKEY":               "ABCDEF",
+		"DEFLUX_INFLUXDB_TOKEN_FILE":             secret,
+		"DEFLUX_INFLUXDB_BUFFER_ENABLED":         "true",
+		"DEFLUX_MQTT_QOS":                        "1",
+		"DEFLUX_FILLVALUES_FILLINTERVAL":         "10m",
+		"DEFLUX_TIMESTAMP":                       "both",
+		"DEFLUX_SENSORS_EXCLUDE_IDS":             "3, 4",
+		"DEFLUX_SINKS":                           "influxdb,mqtt",
+		"DEFLUX_SENSORS_OVERRIDES_0_MEASUREMENT": "climate",
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	c := Configuration{
+		Deconz:   APIConfig{Addr: "http://127.0.0.1/api", APIKey: "KEY"},
+		Gateways: []APIConfig{{Name: "a"}, {Name: "b"}},
+		InfluxDB: InfluxDB{Token: "from file"},
+		Sensors:  SensorsConfig{Overrides: []SensorOverride{{Tags: map[string]string{"room": "kitchen"}}}},
+	}
+	if err := applyEnvironment(reflect.ValueOf(&c).Elem(), EnvPrefix, lookup); err != nil {
+		t.Fatalf("failed to apply environment: %s", err)
+	}
+
+	if c.Deconz.Addr != "http://10.0.0.2/api" || c.Deconz.APIKey != "KEY" {
+		t.Errorf("unexpected deconz config %+v", c.Deconz)
+	}
+	if c.Gateways[0].APIKey != "" || c.Gateways[1].APIKey != "ABCDEF" {
+		t.Errorf("unexpected gateways %+v", c.Gateways)
+	}
+	if c.InfluxDB.Token != "s3cr3t" || !c.InfluxDB.Buffer.Enabled {
+		t.Errorf("unexpected influxdb config %+v", c.InfluxDB)
+	}
+	if c.MQTT.QoS != 1 {
+		t.Errorf("expected QoS 1, got %d", c.MQTT.QoS)
+	}
+	if c.FillValues.FillInterval != 10*time.Minute {
+		t.Errorf("expected fill interval 10m, got %s", c.FillValues.FillInterval)
+	}
+	if c.Timestamp != TimestampBoth {
+		t.Errorf("expected timestamp policy both, got %s", c.Timestamp)
+	}
+	if !reflect.DeepEqual(c.Sensors.Exclude.IDs, []int{3, 4}) {
+		t.Errorf("unexpected excluded ids %v", c.Sensors.Exclude.IDs)
+	}
+	if !reflect.DeepEqual(c.Sinks, []string{"influxdb", "mqtt"}) {
+		t.Errorf("unexpected sinks %v", c.Sinks)
+	}
+	if o := c.Sensors.Overrides[0]; o.Measurement != "climate" || o.Tags["room"] != "kitchen" {
+		t.Errorf("unexpected override %+v", o)
+	}
+}
+
+func TestApplyEnvironmentErrors(t *testing.T) {
+	tests := map[string]map[string]string{
+		"invalid bool":     {"DEFLUX_HEALTH_ENABLED": "maybe"},
+		"invalid duration": {"DEFLUX_HEALTH_INTERVAL": "15"},
+		"both set":         {"DEFLUX_INFLUXDB_TOKEN": "a", "DEFLUX_INFLUXDB_TOKEN_FILE": "/run/secrets/token"},
+		"missing file":     {"DEFLUX_INFLUXDB_TOKEN_FILE": filepath.Join(t.TempDir(), "missing")},
+	}
+
+	for name, env := range tests {
+		t.Run(name, func(t *testing.T) {
+			lookup := func(key string) (string, bool) {
+				v, ok := env[key]
+				return v, ok
+			}
+
+			var c Configuration
+			if err := applyEnvironment(reflect.ValueOf(&c).Elem(), EnvPrefix, lookup); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestApplyEnvironmentAddsEntries(t *testing.T) {
+	env := map[string]string{
+		"DEFLUX_GATEWAYS_0_ADDR":   "http://10.0.0.2/api",
+		"DEFLUX_GATEWAYS_1_NAME":   "upstairs",
+		"DEFLUX_GATEWAYS_1_APIKEY": "ABCDEF",
+		// not consecutive
+		"DEFLUX_GATEWAYS_3_NAME": "attic",
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	c := Configuration{Gateways: []APIConfig{{Name: "downstairs"}}}
+	if err := applyEnvironment(reflect.ValueOf(&c).Elem(), EnvPrefix, lookup); err != nil {
+		t.Fatalf("failed to apply environment: %s", err)
+	}
+
+	want := []APIConfig{
+		{Name: "downstairs", Addr: "http://10.0.0.2/api"},
+		{Name: "upstairs", APIKey: "ABCDEF"},
+	}
+	if !reflect.DeepEqual(c.Gateways, want) {
+		t.Errorf("expected gateways %+v, got %+v", want, c.Gateways)
+	}
+}
+
+func TestHasEnvironment(t *testing.T) {
+	tests := map[string]struct {
+		env  map[string]string
+		want bool
+	}{
+		"none":        {map[string]string{}, false},
+		"unknown":     {map[string]string{"DEFLUX_TEST_MQTT_BROKER": "tcp://localhost:1883"}, false},
+		"config":      {map[string]string{"DEFLUX_INFLUXDB_URL": "http://localhost:8086"}, true},
+		"file":        {map[string]string{"DEFLUX_INFLUXDB_TOKEN_FILE": "/run/secrets/token"}, true},
+		"new gateway": {map[string]string{"DEFLUX_GATEWAYS_0_APIKEY": "ABCDEF"}, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			lookup := func(key string) (string, bool) {
+				v, ok := test.env[key]
+				return v, ok
+			}
+
+			if got := hasEnvironment(lookup); got != test.want {
+				t.Errorf("expected %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadConfigurationEnvironment(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deflux.yml")
+	content := `deconz:
+  addr: http://127.0.0.1/api
+  apikey: FROMFILE
+`
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %s", err)
+	}
+
+	t.Setenv("DEFLUX_DECONZ_APIKEY", "FROMENV")
+
+	cfg, err := LoadConfiguration(file)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	if cfg.Deconz.APIKey != "FROMENV" || cfg.Deconz.Addr != "http://127.0.0.1/api" {
+		t.Errorf("unexpected deconz config %+v", cfg.Deconz)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := Configuration{
+		Deconz:   APIConfig{Addr: "http://127.0.0.1/api", APIKey: "KEY"},
+		Gateways: []APIConfig{{Name: "a", APIKey: "A"}, {Name: "b"}},
+		InfluxDB: InfluxDB{Token: "TOKEN"},
+		MQTT:     MQTT{Username: "deflux", Password: "PASSWORD"},
+	}
+
+	r := c.Redacted()
+
+	if r.Deconz.APIKey != redacted || r.InfluxDB.Token != redacted || r.MQTT.Password != redacted {
+		t.Errorf("secrets not redacted: %+v", r)
+	}
+	if r.Gateways[0].APIKey != redacted || r.Gateways[1].APIKey != "" {
+		t.Errorf("unexpected gateways %+v", r.Gateways)
+	}
+	if r.Deconz.Addr != c.Deconz.Addr || r.MQTT.Username != "deflux" {
+		t.Errorf("non-secrets changed: %+v", r)
+	}
+	if c.Gateways[0].APIKey != "A" || c.Deconz.APIKey != "KEY" {
+		t.Errorf("original configuration changed: %+v", c)
+	}
+}
@@ -0,0 +1,205 @@
+package config
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSSDPAddr is the multicast address of SSDP
+	DefaultSSDPAddr = "239.255.255.250:1900"
+	// DefaultMDNSAddr is the multicast address of mDNS
+	DefaultMDNSAddr = "224.0.0.251:5353"
+	// DefaultLocalDiscoveryTimeout is the time to wait for responses of gateways in the local network
+	DefaultLocalDiscoveryTimeout = 2 * time.Second
+)
+
+// LocalDiscoverer discovers deCONZ gateways in the local network using SSDP and mDNS
+// Empty fields are replaced by their defaults.
+type LocalDiscoverer struct {
+	// SSDPAddr is the address SSDP M-SEARCH requests are sent to
+	SSDPAddr string
+	// MDNSAddr is the address mDNS queries are sent to
+	MDNSAddr string
+	// Timeout is the time to wait for responses
+	Timeout time.Duration
+}
+
+// upnpDescription holds the parts of the UPnP description of a gateway we are interested in
+// deCONZ serves it at /description.xml
+type upnpDescription struct {
+	URLBase string `xml:"URLBase"`
+	Device  struct {
+		FriendlyName string `xml:"friendlyName"`
+		Manufacturer string `xml:"manufacturer"`
+		ModelName    string `xml:"modelName"`
+		SerialNumber string `xml:"serialNumber"`
+	} `xml:"device"`
+}
+
+// isDeconz returns true if the description belongs to a deCONZ/Phoscon gateway
+func (d upnpDescription) isDeconz() bool {
+	s := strings.ToLower(strings.Join([]string{d.Device.FriendlyName, d.Device.Manufacturer, d.Device.ModelName}, " "))
+	return strings.Contains(s, "deconz") || strings.Contains(s, "phoscon") || strings.Contains(s, "dresden")
+}
+
+// Discover sends SSDP and mDNS requests and returns the gateways that responded
+func (l LocalDiscoverer) Discover() (DiscoveryResponse, error) {
+	var (
+		wg                 sync.WaitGroup
+		ssdpURLs, mdnsURLs []string
+		ssdpErr, mdnsErr   error
+	)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ssdpURLs, ssdpErr = l.searchSSDP()
+	}()
+	go func() {
+		defer wg.Done()
+		mdnsURLs, mdnsErr = l.browseMDNS()
+	}()
+	wg.Wait()
+
+	if ssdpErr != nil && mdnsErr != nil {
+		return nil, fmt.Errorf("local discovery failed: ssdp: %s, mdns: %s", ssdpErr, mdnsErr)
+	}
+
+	var data DiscoveryResponse
+	seen := make(map[string]bool)
+	for _, location := range append(ssdpURLs, mdnsURLs...) {
+		if seen[location] {
+			continue
+		}
+		seen[location] = true
+
+		d, err := l.describe(location)
+		if err != nil {
+			continue
+		}
+		data = mergeDiscoveries(data, DiscoveryResponse{d})
+	}
+
+	return data, nil
+}
+
+// timeout returns the configured timeout or DefaultLocalDiscoveryTimeout
+func (l LocalDiscoverer) timeout() time.Duration {
+	if l.Timeout <= 0 {
+		return DefaultLocalDiscoveryTimeout
+	}
+	return l.Timeout
+}
+
+// describe fetches and parses the UPnP description of a gateway
+// It returns an error if the description does not belong to a deCONZ gateway.
+func (l LocalDiscoverer) describe(location string) (Discovery, error) {
+	client := http.Client{Timeout: l.timeout()}
+	resp, err := client.Get(location)
+	if err != nil {
+		return Discovery{}, fmt.Errorf("unable to get description: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Discovery{}, fmt.Errorf("unable to get description: %s", resp.Status)
+	}
+
+	var desc upnpDescription
+	if err := xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return Discovery{}, fmt.Errorf("unable to parse description: %s", err)
+	}
+
+	if !desc.isDeconz() {
+		return Discovery{}, fmt.Errorf("%s is not a deCONZ gateway", desc.Device.FriendlyName)
+	}
+
+	// the URLBase holds the address of the REST API, fall back to the address of the description
+	base, err := url.Parse(desc.URLBase)
+	if err != nil || base.Host == "" {
+		base, err = url.Parse(location)
+		if err != nil {
+			return Discovery{}, fmt.Errorf("unable to parse location: %s", err)
+		}
+	}
+
+	port := uint64(80)
+	if base.Port() != "" {
+		port, err = strconv.ParseUint(base.Port(), 10, 16)
+		if err != nil {
+			return Discovery{}, fmt.Errorf("unable to parse port: %s", err)
+		}
+	}
+
+	return Discovery{
+		ID:                strings.ToUpper(desc.Device.SerialNumber),
+		Name:              desc.Device.FriendlyName,
+		InternalIPAddress: base.Hostname(),
+		InternalPort:      uint(port),
+	}, nil
+}
+
+// mergeDiscoveries appends the gateways of b to a, unless a already contains them
+// Gateways are identified by their id, or by their address if the id is unknown. Missing properties of gateways in
+// a are completed from b.
+func mergeDiscoveries(a, b DiscoveryResponse) DiscoveryResponse {
+	for _, d := range b {
+		found := false
+		for i := range a {
+			sameID := a[i].ID != "" && strings.EqualFold(a[i].ID, d.ID)
+			sameAddr := a[i].InternalIPAddress == d.InternalIPAddress && a[i].InternalPort == d.InternalPort
+			if !sameID && !sameAddr {
+				continue
+			}
+
+			found = true
+			if a[i].ID == "" {
+				a[i].ID = d.ID
+			}
+			if a[i].Name == "" {
+				a[i].Name = d.Name
+			}
+			if a[i].MacAddress == "" {
+				a[i].MacAddress = d.MacAddress
+			}
+			if a[i].PublicIPAddress == "" {
+				a[i].PublicIPAddress = d.PublicIPAddress
+			}
+			break
+		}
+
+		if !found {
+			a = append(a, d)
+		}
+	}
+
+	return a
+}
+
+// readResponses reads UDP packets from conn until the timeout has passed and calls handle for each packet
+func readResponses(conn net.PacketConn, timeout time.Duration, handle func(b []byte, from net.Addr)) error {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+
+		handle(buf[:n], from)
+	}
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const deconzDescription = `<?xml version="1.0" encoding="UTF-8" ?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<specVersion><major>1</major><minor>0</minor></specVersion>
+	<URLBase>http://%s/</URLBase>
+	<device>
+		<deviceType>urn:schemas-upnp-org:device:Basic:1</deviceType>
+		<friendlyName>Phoscon-GW (127.0.0.1)</friendlyName>
+		<manufacturer>Royal Philips Electronics</manufacturer>
+		<modelName>Philips hue bridge 2015</modelName>
+		<serialNumber>00212eFFFF017fbd</serialNumber>
+	</device>
+</root>`
+
+const hueDescription = `<?xml version="1.0" encoding="UTF-8" ?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<device>
+		<friendlyName>Hue Bridge (127.0.0.1)</friendlyName>
+		<manufacturer>Signify</manufacturer>
+		<modelName>Philips hue bridge 2015</modelName>
+		<serialNumber>ecb5fafffe000001</serialNumber>
+	</device>
+</root>`
+
+// fakeResponder answers UDP requests with the packets returned by respond
+func fakeResponder(t *testing.T, respond func(req []byte) [][]byte) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, resp := range respond(buf[:n]) {
+				_, _ = conn.WriteTo(resp, from)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestLocalDiscoverer(t *testing.T) {
+	gw := httptest.NewServer(nil)
+	defer gw.Close()
+	gwURL, _ := url.Parse(gw.URL)
+	gw.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/description.xml":
+			fmt.Fprintf(w, deconzDescription, gwURL.Host)
+		case "/hue.xml":
+			fmt.Fprint(w, hueDescription)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	// a Hue bridge and the deCONZ gateway respond, the deCONZ gateway twice
+	ssdp := fakeResponder(t, func(req []byte) [][]byte {
+		var packets [][]byte
+		for _, location := range []string{"hue.xml", "description.xml", "description.xml"} {
+			packets = append(packets, []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+				"CACHE-CONTROL: max-age=100\r\n"+
+				"LOCATION: %s/%s\r\n"+
+				"ST: upnp:rootdevice\r\n\r\n", gw.URL, location)))
+		}
+		return packets
+	})
+
+	// the deCONZ gateway is found via mDNS as well
+	port, _ := strconv.Atoi(gwURL.Port())
+	mdns := fakeResponder(t, func(req []byte) [][]byte {
+		var q dnsmessage.Message
+		if err := q.Unpack(req); err != nil || len(q.Questions) != 1 || q.Questions[0].Name.String() != mdnsService {
+			return nil
+		}
+
+		instance := dnsmessage.MustNewName("Phoscon-GW._http._tcp.local.")
+		target := dnsmessage.MustNewName("phoscon.local.")
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true, Authoritative: true},
+			Questions: q.Questions,
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.PTRResource{PTR: instance},
+			}},
+			Additionals: []dnsmessage.Resource{
+				{
+					Header: dnsmessage.ResourceHeader{Name: instance, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: 120},
+					Body:   &dnsmessage.SRVResource{Target: target, Port: uint16(port)},
+				},
+				{
+					Header: dnsmessage.ResourceHeader{Name: target, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 120},
+					Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+				},
+			},
+		}
+		b, err := resp.Pack()
+		if err != nil {
+			t.Errorf("failed to pack mdns response: %s", err)
+			return nil
+		}
+		return [][]byte{b}
+	})
+
+	l := LocalDiscoverer{SSDPAddr: ssdp, MDNSAddr: mdns, Timeout: 200 * time.Millisecond}
+	discovered, err := l.Discover()
+	if err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+
+	want := Discovery{
+		ID:                "00212EFFFF017FBD",
+		Name:              "Phoscon-GW (127.0.0.1)",
+		InternalIPAddress: "127.0.0.1",
+		InternalPort:      uint(port),
+	}
+	if len(discovered) != 1 || discovered[0] != want {
+		t.Fatalf("expected %v, got %v", want, discovered)
+	}
+
+	// merge with the cloud response
+	cloud := DiscoveryResponse{
+		{ID: "00212EFFFF017FBD", MacAddress: "00212E017FBD", PublicIPAddress: "85.191.222.130", InternalIPAddress: "127.0.0.1", InternalPort: uint(port)},
+		{ID: "00212EFFFF017FBE", InternalIPAddress: "192.168.1.91", InternalPort: 80},
+	}
+	merged := mergeDiscoveries(discovered, cloud)
+	if len(merged) != 2 || merged[0].MacAddress != "00212E017FBD" || merged[0].Name != want.Name || merged[1].ID != cloud[1].ID {
+		t.Fatalf("unexpected merge result: %v", merged)
+	}
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+)
+
+// mdnsService is the service browsed for deCONZ gateways. Gateways announce their web app as HTTP service.
+const mdnsService = "_http._tcp.local."
+
+// mdnsInstance is a service instance found by an mDNS query
+type mdnsInstance struct {
+	target string
+	port   uint16
+	// from is the address of the responder; it is used if the response does not include the address of the target
+	from net.IP
+}
+
+// browseMDNS sends an mDNS query for HTTP services and returns the description URLs of deCONZ and Phoscon gateways
+// It sends a legacy unicast query from an ephemeral port, so responders reply directly to us.
+func (l LocalDiscoverer) browseMDNS() ([]string, error) {
+	addr := l.MDNSAddr
+	if addr == "" {
+		addr = DefaultMDNSAddr
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve mdns address: %s", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for mdns responses: %s", err)
+	}
+	defer conn.Close()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return nil, fmt.Errorf("unable to build mdns query: %s", err)
+	}
+	err = b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(mdnsService),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to build mdns query: %s", err)
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("unable to build mdns query: %s", err)
+	}
+
+	if _, err := conn.WriteTo(query, raddr); err != nil {
+		return nil, fmt.Errorf("unable to send mdns query: %s", err)
+	}
+
+	instances := make(map[string]*mdnsInstance)
+	hosts := make(map[string]net.IP)
+
+	err = readResponses(conn, l.timeout(), func(b []byte, from net.Addr) {
+		var m dnsmessage.Message
+		if err := m.Unpack(b); err != nil || !m.Header.Response {
+			return
+		}
+
+		var fromIP net.IP
+		if udp, ok := from.(*net.UDPAddr); ok {
+			fromIP = udp.IP
+		}
+
+		for _, r := range append(m.Answers, m.Additionals...) {
+			name := r.Header.Name.String()
+			switch body := r.Body.(type) {
+			case *dnsmessage.PTRResource:
+				instance := body.PTR.String()
+				if _, ok := instances[instance]; !ok && isDeconzInstance(instance) {
+					instances[instance] = &mdnsInstance{from: fromIP}
+				}
+			case *dnsmessage.SRVResource:
+				if !isDeconzInstance(name) {
+					continue
+				}
+				i, ok := instances[name]
+				if !ok {
+					i = &mdnsInstance{from: fromIP}
+					instances[name] = i
+				}
+				i.target = body.Target.String()
+				i.port = body.Port
+			case *dnsmessage.AResource:
+				hosts[name] = net.IP(body.A[:])
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mdns responses: %s", err)
+	}
+
+	var locations []string
+	for _, i := range instances {
+		ip, ok := hosts[i.target]
+		if !ok {
+			ip = i.from
+		}
+		if ip == nil {
+			continue
+		}
+
+		port := i.port
+		if port == 0 {
+			port = 80
+		}
+
+		locations = append(locations, fmt.Sprintf("http://%s/description.xml", net.JoinHostPort(ip.String(), fmt.Sprint(port))))
+	}
+
+	return locations, nil
+}
+
+// isDeconzInstance returns true if the service instance name belongs to a deCONZ or Phoscon gateway
+func isDeconzInstance(name string) bool {
+	n := strings.ToLower(name)
+	return strings.Contains(n, "deconz") || strings.Contains(n, "phoscon")
+}
@@ -2,38 +2,48 @@ package config
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"github.com/rvk01/deflux/pkg/deconz/rest"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 // APIKey is our apikey type
 type APIKey string
 
+// ErrorTypeLinkButtonNotPressed is the type of the error returned by deCONZ if the gateway is not unlocked
+const ErrorTypeLinkButtonNotPressed = 101
+
 type pairRequest struct {
 	DeviceType string `json:"devicetype"`
 }
 
-type pairResponse []pair
-
-type pair struct {
-	Success struct {
-		Username string
-	}
+// pairResponse is the response of deCONZ to a successful pair request
+// It is a list of results, errors are returned by rest.Client.
+type pairResponse []struct {
+	Success *struct {
+		Username string `json:"username"`
+	} `json:"success"`
 }
 
-type pairFailureResponse []pairFailure
-
-type pairFailure struct {
-	Error struct {
-		Description string
-	}
-}
+// APIError is an error returned by the deCONZ REST API
+type APIError = rest.APIError
 
 // Pair tries to pair with deCONZ and returns an API key when successful
 func Pair(u url.URL) (APIKey, error) {
+	return PairWithAuth(context.Background(), rest.New(http.DefaultClient, rest.Options{}), u, "", "")
+}
+
+// PairWithAuth tries to pair with deCONZ and returns an API key when successful
+// If a username is given, the request is authenticated with HTTP basic auth. deCONZ accepts requests authenticated
+// with the Phoscon App credentials without being unlocked.
+// If the gateway is locked, the returned error wraps an *APIError of type ErrorTypeLinkButtonNotPressed.
+// The request is sent with client, e.g. the client of APIConfig.Client.
+func PairWithAuth(ctx context.Context, client *rest.Client, u url.URL, username, password string) (APIKey, error) {
 	// to pair we must send a POST request to "/api" containing a pairRequest
 	u.Path = "/api"
 
@@ -48,39 +58,56 @@ func Pair(u url.URL) (APIKey, error) {
 		return "", fmt.Errorf("unable to marshal pair request: %s", err)
 	}
 
-	// send POST request and read body
-	response, err := http.Post(u.String(), "application/json", &buff)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), &buff)
 	if err != nil {
-		return "", fmt.Errorf("unable to send post request: %s", err)
+		return "", fmt.Errorf("unable to create post request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if username != "" {
+		req.SetBasicAuth(username, password)
 	}
 
-	defer response.Body.Close()
-
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return "", fmt.Errorf("unable to read body: %s", err)
+	// e.g. if the gateway is locked
+	var pairResp pairResponse
+	if err := client.Do(req, &pairResp); err != nil {
+		return "", fmt.Errorf("unable to pair with deconz: %w", err)
 	}
 
-	// this error happens if the gateway is locked
-	if response.StatusCode == http.StatusForbidden {
-		var failure pairFailureResponse
-		err = json.Unmarshal(body, &failure)
-		if err != nil {
-			return "", fmt.Errorf("unable to parse failure message from deCONZ: %s", err)
+	// finally, if none of the above failed, extract APIKey from response
+	for _, r := range pairResp {
+		if r.Success != nil && r.Success.Username != "" {
+			return APIKey(r.Success.Username), nil
 		}
-		return "", fmt.Errorf("unable to pair with deconz: %s", failure[0].Error.Description)
 	}
 
-	if response.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("unexpected status code from deCONZ: %d\n%s", response.StatusCode, body)
-	}
+	return "", fmt.Errorf("no API key in pairing response")
+}
 
-	// finally, if none of the above failed, extract APIKey from response
-	var pairResp pairResponse
-	err = json.Unmarshal(body, &pairResp)
-	if err != nil {
-		return "", fmt.Errorf("unable to parse JSON from pairing response: %s", err)
-	}
+// PairWait tries to pair with deCONZ every interval until the gateway has been unlocked or the context is done
+// Errors other than a locked gateway abort immediately.
+func PairWait(ctx context.Context, client *rest.Client, u url.URL, username, password string, interval time.Duration) (APIKey, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		key, err := PairWithAuth(ctx, client, u, username, password)
+		if err == nil {
+			return key, nil
+		}
 
-	return APIKey(pairResp[0].Success.Username), nil
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("gateway has not been unlocked: %s", ctx.Err())
+		}
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.Type != ErrorTypeLinkButtonNotPressed {
+			return "", err
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("gateway has not been unlocked: %s", ctx.Err())
+		case <-ticker.C:
+		}
+	}
 }
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"github.com/rvk01/deflux/pkg/deconz/rest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePairServer is a deCONZ gateway that is unlocked after locked pair requests,
+// or accepts requests with the Phoscon credentials delight:secret
+func fakePairServer(t *testing.T, locked int32) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api" {
+			http.NotFound(w, r)
+			return
+		}
+
+		n := atomic.AddInt32(&requests, 1)
+		user, password, ok := r.BasicAuth()
+		switch {
+		case ok && (user != "delight" || password != "secret"):
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`[{"error": {"type": 1, "address": "/", "description": "unauthorized user"}}]`))
+		case !ok && n <= locked:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`[{"error": {"type": 101, "address": "/", "description": "link button not pressed"}}]`))
+		default:
+			_, _ = w.Write([]byte(`[{"success": {"username": "83A0C7D1E2"}}]`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+func TestPairWait(t *testing.T) {
+	srv, requests := fakePairServer(t, 2)
+	u, _ := url.Parse(srv.URL)
+
+	_, err := Pair(*u)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Type != ErrorTypeLinkButtonNotPressed || apiErr.Description != "link button not pressed" {
+		t.Fatalf("expected link button error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	key, err := PairWait(ctx, rest.New(http.DefaultClient, rest.Options{}), *u, "", "", 10*time.Millisecond)
+	if err != nil || key != "83A0C7D1E2" {
+		t.Fatalf("expected key, got %q, %v", key, err)
+	}
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+}
+
+func TestPairWaitTimeout(t *testing.T) {
+	srv, _ := fakePairServer(t, 1000)
+	u, _ := url.Parse(srv.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := PairWait(ctx, rest.New(http.DefaultClient, rest.Options{}), *u, "", "", 10*time.Millisecond); err == nil || !strings.Contains(err.Error(), "not been unlocked") {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestPairWithAuth(t *testing.T) {
+	srv, requests := fakePairServer(t, 1000)
+	u, _ := url.Parse(srv.URL)
+
+	key, err := PairWithAuth(context.Background(), rest.New(http.DefaultClient, rest.Options{}), *u, "delight", "secret")
+	if err != nil || key != "83A0C7D1E2" {
+		t.Fatalf("expected key, got %q, %v", key, err)
+	}
+
+	// other errors are not retried
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = PairWait(ctx, rest.New(http.DefaultClient, rest.Options{}), *u, "delight", "wrong", 10*time.Millisecond)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Type != 1 {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}
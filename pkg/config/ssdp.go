@@ -0,0 +1,65 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ssdpSearchTarget is the search target of M-SEARCH requests. deCONZ responds to it like a Hue bridge does.
+const ssdpSearchTarget = "upnp:rootdevice"
+
+// searchSSDP sends an SSDP M-SEARCH request and returns the description URLs of all devices that responded
+func (l LocalDiscoverer) searchSSDP() ([]string, error) {
+	addr := l.SSDPAddr
+	if addr == "" {
+		addr = DefaultSSDPAddr
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve ssdp address: %s", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for ssdp responses: %s", err)
+	}
+	defer conn.Close()
+
+	req := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\n"+
+		"HOST: %s\r\n"+
+		"MAN: \"ssdp:discover\"\r\n"+
+		"MX: 1\r\n"+
+		"ST: %s\r\n\r\n", DefaultSSDPAddr, ssdpSearchTarget)
+
+	if _, err := conn.WriteTo([]byte(req), raddr); err != nil {
+		return nil, fmt.Errorf("unable to send ssdp request: %s", err)
+	}
+
+	var locations []string
+	seen := make(map[string]bool)
+
+	err = readResponses(conn, l.timeout(), func(b []byte, _ net.Addr) {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+		if err != nil {
+			return
+		}
+		resp.Body.Close()
+
+		location := resp.Header.Get("Location")
+		if location == "" || seen[location] {
+			return
+		}
+
+		seen[location] = true
+		locations = append(locations, location)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ssdp responses: %s", err)
+	}
+
+	return locations, nil
+}
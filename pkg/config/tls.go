@@ -0,0 +1,91 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSConfig holds the TLS settings of a connection to deCONZ or InfluxDB
+// The zero value uses the system's CA certificates and no client certificate.
+type TLSConfig struct {
+	// CA is a PEM file of CA certificates that are trusted in addition to the system's CA certificates
+	CA string `yaml:",omitempty"`
+
+	// Cert and Key are PEM files of a client certificate and its private key
+	Cert string `yaml:",omitempty"`
+	Key  string `yaml:",omitempty"`
+
+	// InsecureSkipVerify set true accepts any server certificate. Only use it for testing.
+	InsecureSkipVerify bool `yaml:",omitempty"`
+}
+
+// IsZero returns true if no TLS settings are configured
+func (t TLSConfig) IsZero() bool {
+	return t == TLSConfig{}
+}
+
+// Config returns the crypto/tls configuration, or nil if no TLS settings are configured
+func (t TLSConfig) Config() (*tls.Config, error) {
+	if t.IsZero() {
+		return nil, nil
+	}
+
+	c := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %s", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", t.CA)
+		}
+		c.RootCAs = pool
+	}
+
+	if t.Cert != "" || t.Key != "" {
+		if t.Cert == "" || t.Key == "" {
+			return nil, fmt.Errorf("client certificate requires both cert and key")
+		}
+
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// HasFiles returns true if the TLS settings refer to CA or certificate files
+func (t TLSConfig) HasFiles() bool {
+	return t.CA != "" || t.Cert != "" || t.Key != ""
+}
+
+// HTTPClient returns an HTTP client using the TLS settings
+// The CA and certificate files are read on each call, so callers should hold the client to reuse its connections.
+// Without TLS settings, it returns http.DefaultClient.
+func (t TLSConfig) HTTPClient() (*http.Client, error) {
+	if t.IsZero() {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig, err := t.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"websocketport": 8443}`)
+	}))
+	defer ts.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(ca, caPEM, 0600); err != nil {
+		t.Fatalf("failed to write CA file: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		tls     TLSConfig
+		wantErr bool
+	}{
+		{name: "untrusted", tls: TLSConfig{}, wantErr: true},
+		{name: "custom CA", tls: TLSConfig{CA: ca}},
+		{name: "insecure", tls: TLSConfig{InsecureSkipVerify: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := APIConfig{Addr: ts.URL + "/api", APIKey: "KEY", TLS: tt.tls}
+			err := gw.DiscoverWebsocket(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected certificate error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("failed to discover websocket: %s", err)
+			}
+			if !strings.HasPrefix(gw.WsAddr, "wss://") || !strings.HasSuffix(gw.WsAddr, ":8443/") {
+				t.Errorf("expected wss address on port 8443, got %s", gw.WsAddr)
+			}
+		})
+	}
+}
+
+func TestTLSConfigInvalid(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	for _, tls := range []TLSConfig{{CA: empty}, {Key: "key.pem"}, {Cert: empty, Key: empty}} {
+		if _, err := tls.Config(); err == nil {
+			t.Errorf("expected error for %+v", tls)
+		}
+	}
+
+	if c, err := (TLSConfig{}).Config(); c != nil || err != nil {
+		t.Errorf("expected no TLS config without settings, got %v, %v", c, err)
+	}
+}
+
+func TestTLSConfigRotated(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(ca, caPEM, 0600); err != nil {
+		t.Fatalf("failed to write CA file: %s", err)
+	}
+
+	tls := TLSConfig{CA: ca}
+	if _, err := tls.HTTPClient(); err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+
+	// the files are read again for each client
+	if err := os.WriteFile(ca, nil, 0600); err != nil {
+		t.Fatalf("failed to write CA file: %s", err)
+	}
+	if _, err := tls.HTTPClient(); err == nil {
+		t.Errorf("expected error for the rotated CA file")
+	}
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Validate checks the configuration for values deflux cannot work with
+// All problems are returned, joined by newlines, with the config key they refer to.
+func (c *Configuration) Validate() error {
+	var errs []error
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	gateways, err := c.GatewayConfigs()
+	if err != nil {
+		add("gateways: %s", err)
+	}
+	for i, gw := range gateways {
+		key := "deconz"
+		if len(c.Gateways) > 0 {
+			key = fmt.Sprintf("gateways[%d]", i)
+		}
+		errs = append(errs, validateGateway(key, gw)...)
+	}
+
+	if !c.Timestamp.Valid() {
+		add("timestamp: unknown policy %q, use %s, %s or %s", c.Timestamp, TimestampReceive, TimestampLastUpdated,
+			TimestampBoth)
+	}
+
+	if c.FillValues.Enabled {
+		if c.FillValues.FillInterval <= 0 {
+			add("fillvalues.fillinterval: must be positive, e.g. 30m")
+		}
+		if c.FillValues.LastSeenTimeout <= 0 {
+			add("fillvalues.lastseentimeout: must be positive, e.g. 2h")
+		}
+		if c.FillValues.FillInterval > 0 && c.FillValues.LastSeenTimeout > 0 &&
+			c.FillValues.FillInterval >= c.FillValues.LastSeenTimeout {
+			add("fillvalues.fillinterval: %s must be less than lastseentimeout %s", c.FillValues.FillInterval,
+				c.FillValues.LastSeenTimeout)
+		}
+	}
+
+	if c.Health.Enabled && !c.FillValues.Enabled && c.FillValues.LastSeenTimeout <= 0 {
+		add("fillvalues.lastseentimeout: must be positive for health.enabled, e.g. 2h")
+	}
+	if c.Health.Interval < 0 {
+		add("health.interval: must not be negative")
+	}
+
+	if c.Internal.Enabled {
+		if c.Internal.Interval <= 0 {
+			add("internal.interval: must be positive, e.g. 1m")
+		}
+		if !slices.Contains(c.SinkNames(), SinkInfluxDB) {
+			add("internal.enabled: requires the %s sink", SinkInfluxDB)
+		}
+	}
+
+	if c.Status.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Status.Listen); err != nil {
+			add("status.listen: %s", err)
+		}
+	}
+	if c.Status.ReadyTimeout < 0 {
+		add("status.readytimeout: must not be negative")
+	}
+
+	ws := c.Websocket
+	for _, d := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"backoffmin", ws.BackoffMin},
+		{"backoffmax", ws.BackoffMax},
+		{"pinginterval", ws.PingInterval},
+		{"pongtimeout", ws.PongTimeout},
+		{"watchdogtimeout", ws.WatchdogTimeout},
+	} {
+		if d.value < 0 {
+			add("websocket.%s: must not be negative", d.key)
+		}
+	}
+	if ws.BackoffMin > 0 && ws.BackoffMax > 0 && ws.BackoffMin > ws.BackoffMax {
+		add("websocket.backoffmin: %s must not be greater than backoffmax %s", ws.BackoffMin, ws.BackoffMax)
+	}
+	if ws.WatchdogTimeout > 0 && ws.WatchdogTimeout <= ws.WithDefaults().PingInterval {
+		add("websocket.watchdogtimeout: %s must be greater than pinginterval %s", ws.WatchdogTimeout,
+			ws.WithDefaults().PingInterval)
+	}
+
+	if c.Cache.RefreshInterval < 0 {
+		add("cache.refreshinterval: must not be negative")
+	}
+
+	errs = append(errs, validateSensors(c.Sensors)...)
+
+	for _, name := range c.SinkNames() {
+		switch name {
+		case SinkInfluxDB:
+			errs = append(errs, validateInfluxDB(c.InfluxDB)...)
+		case SinkPrometheus:
+			if _, _, err := net.SplitHostPort(c.Prometheus.ListenAddr()); err != nil {
+				add("prometheus.listen: %s", err)
+			}
+			// series of sensors that have not been seen for the timeout are removed
+			if !c.FillValues.Enabled && c.FillValues.LastSeenTimeout <= 0 {
+				add("fillvalues.lastseentimeout: must be positive for the %s sink, e.g. 2h", SinkPrometheus)
+			}
+		case SinkMQTT:
+			if err := validateURL(c.MQTT.Broker, "tcp", "ssl", "tls", "mqtt", "mqtts", "ws", "wss"); err != nil {
+				add("mqtt.broker: %s", err)
+			}
+			if c.MQTT.QoS > 2 {
+				add("mqtt.qos: must be 0, 1 or 2")
+			}
+		default:
+			add("sinks: unknown sink %q, use %s, %s or %s", name, SinkInfluxDB, SinkPrometheus, SinkMQTT)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateGateway checks the configuration of a deCONZ gateway
+func validateGateway(key string, gw APIConfig) []error {
+	var errs []error
+	if err := validateURL(gw.Addr, "http", "https"); err != nil {
+		errs = append(errs, fmt.Errorf("%s.addr: %s", key, err))
+	}
+	if gw.APIKey == "" {
+		errs = append(errs, fmt.Errorf("%s.apikey: missing, run `deflux pair` to get one", key))
+	}
+	if gw.WsAddr != "" {
+		if err := validateURL(gw.WsAddr, "ws", "wss"); err != nil {
+			errs = append(errs, fmt.Errorf("%s.wsaddr: %s", key, err))
+		}
+	}
+	if _, err := gw.TLS.Config(); err != nil {
+		errs = append(errs, fmt.Errorf("%s.tls: %s", key, err))
+	}
+	if gw.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("%s.timeout: must not be negative", key))
+	}
+
+	return errs
+}
+
+// validateInfluxDB checks the configuration of the InfluxDB sink
+func validateInfluxDB(cfg InfluxDB) []error {
+	var errs []error
+	if err := validateURL(cfg.URL, "http", "https"); err != nil {
+		errs = append(errs, fmt.Errorf("influxdb.url: %s", err))
+	}
+	if cfg.Bucket == "" {
+		errs = append(errs, fmt.Errorf("influxdb.bucket: missing"))
+	}
+
+	// InfluxDB v1 is used with an empty org and takes username:password as token
+	if cfg.Org == "" && !strings.Contains(cfg.Token, ":") {
+		errs = append(errs, fmt.Errorf("influxdb.token: must be USERNAME:PASSWORD for InfluxDB v1, or set influxdb.org "+
+			"for InfluxDB v2"))
+	}
+	if cfg.Org != "" && cfg.Token == "" {
+		errs = append(errs, fmt.Errorf("influxdb.token: missing"))
+	}
+	if _, err := cfg.TLS.Config(); err != nil {
+		errs = append(errs, fmt.Errorf("influxdb.tls: %s", err))
+	}
+
+	return errs
+}
+
+// validateSensors checks the sensor filters and overrides
+func validateSensors(cfg SensorsConfig) []error {
+	var errs []error
+	keys := []string{"sensors.include", "sensors.exclude"}
+	matches := []SensorMatch{cfg.Include, cfg.Exclude}
+	for i, o := range cfg.Overrides {
+		keys = append(keys, fmt.Sprintf("sensors.overrides[%d].match", i))
+		matches = append(matches, o.Match)
+		if o.FillInterval < 0 {
+			errs = append(errs, fmt.Errorf("sensors.overrides[%d].fillinterval: must not be negative", i))
+		}
+	}
+
+	for i, m := range matches {
+		for _, pattern := range m.Names {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s.names: invalid pattern %q: %s", keys[i], pattern, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// validateURL checks that s is an absolute URL with a host and one of the given schemes
+func validateURL(s string, schemes ...string) error {
+	if s == "" {
+		return fmt.Errorf("missing")
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host, use e.g. %s://127.0.0.1", s, schemes[0])
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%q has unsupported scheme %q, use %s", s, u.Scheme, strings.Join(schemes, ", "))
+}
@@ -0,0 +1,223 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfiguration returns a configuration that passes Validate
+func validConfiguration() Configuration {
+	return Configuration{
+		Deconz:   APIConfig{Addr: "http://127.0.0.1/api", APIKey: "123A4B5C67"},
+		InfluxDB: InfluxDB{URL: "http://localhost:8086", Token: "SECRET", Org: "organization", Bucket: "default"},
+		FillValues: FillConfig{
+			Enabled:         true,
+			FillInterval:    30 * time.Minute,
+			LastSeenTimeout: 2 * time.Hour,
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Configuration)
+		want   []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Configuration) {},
+		},
+		{
+			name: "valid influxdb v1",
+			modify: func(c *Configuration) {
+				c.InfluxDB.Org = ""
+				c.InfluxDB.Token = "user:password"
+			},
+		},
+		{
+			name: "deconz",
+			modify: func(c *Configuration) {
+				c.Deconz.Addr = "127.0.0.1/api"
+				c.Deconz.APIKey = ""
+				c.Deconz.WsAddr = "http://127.0.0.1:443"
+			},
+			want: []string{"deconz.addr: ", "deconz.apikey: missing", "deconz.wsaddr: "},
+		},
+		{
+			name: "gateways",
+			modify: func(c *Configuration) {
+				c.Gateways = []APIConfig{
+					{Name: "a", Addr: "http://10.0.0.1/api", APIKey: "A"},
+					{Name: "b", Addr: "ftp://10.0.0.2/api", APIKey: "B"},
+				}
+			},
+			want: []string{"gateways[1].addr: "},
+		},
+		{
+			name: "tls",
+			modify: func(c *Configuration) {
+				c.Deconz.TLS = TLSConfig{CA: "/nonexistent/ca.pem"}
+				c.InfluxDB.TLS = TLSConfig{Cert: "client.pem"}
+			},
+			want: []string{"deconz.tls: unable to read CA file", "influxdb.tls: client certificate requires both cert and key"},
+		},
+		{
+			name: "negative gateway timeout",
+			modify: func(c *Configuration) {
+				c.Deconz.Timeout = -time.Second
+			},
+			want: []string{"deconz.timeout: must not be negative"},
+		},
+		{
+			name: "fill interval not less than timeout",
+			modify: func(c *Configuration) {
+				c.FillValues.FillInterval = 2 * time.Hour
+			},
+			want: []string{"fillvalues.fillinterval: 2h0m0s must be less than lastseentimeout 2h0m0s"},
+		},
+		{
+			name: "fill interval missing",
+			modify: func(c *Configuration) {
+				c.FillValues.FillInterval = 0
+				c.FillValues.LastSeenTimeout = 0
+			},
+			want: []string{"fillvalues.fillinterval: must be positive", "fillvalues.lastseentimeout: must be positive"},
+		},
+		{
+			name: "fill values disabled",
+			modify: func(c *Configuration) {
+				c.FillValues = FillConfig{}
+			},
+		},
+		{
+			name: "health without fill values",
+			modify: func(c *Configuration) {
+				c.FillValues = FillConfig{LastSeenTimeout: 2 * time.Hour}
+				c.Health = HealthConfig{Enabled: true}
+			},
+		},
+		{
+			name: "health without lastseen timeout",
+			modify: func(c *Configuration) {
+				c.FillValues = FillConfig{}
+				c.Health = HealthConfig{Enabled: true}
+			},
+			want: []string{"fillvalues.lastseentimeout: must be positive for health.enabled"},
+		},
+		{
+			name: "prometheus without lastseen timeout",
+			modify: func(c *Configuration) {
+				c.FillValues = FillConfig{}
+				c.Sinks = []string{SinkPrometheus}
+			},
+			want: []string{"fillvalues.lastseentimeout: must be positive for the prometheus sink"},
+		},
+		{
+			name: "internal interval missing",
+			modify: func(c *Configuration) {
+				c.Internal = InternalConfig{Enabled: true}
+				c.Sinks = []string{SinkPrometheus}
+			},
+			want: []string{"internal.interval: must be positive", "internal.enabled: requires the influxdb sink"},
+		},
+		{
+			name: "websocket",
+			modify: func(c *Configuration) {
+				c.Websocket = WebsocketConfig{
+					BackoffMin:      time.Minute,
+					BackoffMax:      time.Second,
+					PongTimeout:     -time.Second,
+					WatchdogTimeout: 10 * time.Second,
+				}
+			},
+			want: []string{"websocket.pongtimeout: must not be negative",
+				"websocket.backoffmin: 1m0s must not be greater than backoffmax 1s",
+				"websocket.watchdogtimeout: 10s must be greater than pinginterval 30s"},
+		},
+		{
+			name: "negative cache refresh interval",
+			modify: func(c *Configuration) {
+				c.Cache.RefreshInterval = -time.Minute
+			},
+			want: []string{"cache.refreshinterval: must not be negative"},
+		},
+		{
+			name: "influxdb v1 without credentials",
+			modify: func(c *Configuration) {
+				c.InfluxDB.Org = ""
+				c.InfluxDB.URL = ""
+			},
+			want: []string{"influxdb.url: missing", "influxdb.token: must be USERNAME:PASSWORD"},
+		},
+		{
+			name: "sinks",
+			modify: func(c *Configuration) {
+				c.Sinks = []string{"mqtt", "influx"}
+				c.MQTT.Broker = "tcp://localhost:1883"
+				c.MQTT.QoS = 3
+			},
+			want: []string{"mqtt.qos: ", "sinks: unknown sink \"influx\""},
+		},
+		{
+			name: "sensors and timestamp",
+			modify: func(c *Configuration) {
+				c.Timestamp = "now"
+				c.Sensors.Exclude.Names = []string{"th-["}
+				c.Sensors.Overrides = []SensorOverride{{FillInterval: -time.Minute}}
+			},
+			want: []string{"timestamp: unknown policy \"now\"", "sensors.overrides[0].fillinterval: ",
+				"sensors.exclude.names: invalid pattern \"th-[\""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfiguration()
+			tt.modify(&c)
+
+			err := c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("expected no error, got %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %v", tt.want)
+			}
+
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tt.want) {
+				t.Errorf("expected %d errors, got %d:\n%s", len(tt.want), len(lines), err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error containing %q, got:\n%s", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigurationStrict(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deflux.yml")
+	content := `deconz:
+  addr: http://127.0.0.1/api
+  apikey: "123A4B5C67"
+fillvalues:
+  enabled: true
+  fillintervall: 10m
+`
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %s", err)
+	}
+
+	_, err := LoadConfiguration(file)
+	if err == nil || !strings.Contains(err.Error(), "fillintervall") {
+		t.Errorf("expected error about unknown key fillintervall, got %v", err)
+	}
+}
@@ -1,39 +1,67 @@
 package deconz
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz/group"
+	"github.com/rvk01/deflux/pkg/deconz/light"
+	"github.com/rvk01/deflux/pkg/deconz/rest"
 	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/metrics"
 	"log/slog"
-	"net/http"
+	"time"
 )
 
 // API represents the deCONZ REST API
+// Use NewAPI to reuse the connections of a single client for all requests. An API without client creates one per
+// request.
 type API struct {
 	Config config.APIConfig
 
-	// sensorCache is used to look up types of sensors when a new event is received via websocket
-	sensorCache *CachingSensorProvider
+	client *rest.Client
+}
+
+// NewAPI returns an API with a client using the TLS, timeout and retry settings of cfg
+// The CA and certificate files are read once; create a new API to apply changed files.
+func NewAPI(cfg config.APIConfig) (API, error) {
+	client, err := cfg.Client()
+	if err != nil {
+		return API{}, err
+	}
+
+	return API{Config: cfg, client: client}, nil
 }
 
 // Sensors returns a map of sensors as received from the deCONZ /sensors endpoint
 // The map key is the sensor id.
-func (a *API) Sensors() (*sensor.Sensors, error) {
+func (a *API) Sensors(ctx context.Context) (*sensor.Sensors, error) {
+	b, err := a.SensorsJSON(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSensors(b)
+}
+
+// SensorsJSON returns the response of the deCONZ /sensors endpoint as is, e.g. to record it
+func (a *API) SensorsJSON(ctx context.Context) (json.RawMessage, error) {
 
 	uri := fmt.Sprintf("%s/%s/sensors", a.Config.Addr, a.Config.APIKey)
-	resp, err := http.Get(uri)
-	if err != nil {
-		return nil, fmt.Errorf("unable to get %s: %s", uri, err)
+
+	var b json.RawMessage
+	if err := a.get(ctx, "sensors", uri, &b); err != nil {
+		return nil, err
 	}
 
-	defer resp.Body.Close()
+	return b, nil
+}
 
+// ParseSensors parses a response of the deCONZ /sensors endpoint into a map of sensors indexed by their id
+func ParseSensors(b []byte) (*sensor.Sensors, error) {
 	var sensors sensor.Sensors
-
-	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(&sensors)
-	if err != nil {
+	if err := json.Unmarshal(b, &sensors); err != nil {
 		return nil, fmt.Errorf("unable to decode deCONZ /sensors response: %s", err)
 	}
 
@@ -48,3 +76,94 @@ func (a *API) Sensors() (*sensor.Sensors, error) {
 
 	return &sensors, nil
 }
+
+// Lights returns a map of lights as received from the deCONZ /lights endpoint
+// The map key is the light id.
+func (a *API) Lights(ctx context.Context) (*light.Lights, error) {
+
+	uri := fmt.Sprintf("%s/%s/lights", a.Config.Addr, a.Config.APIKey)
+
+	var lights light.Lights
+	if err := a.get(ctx, "lights", uri, &lights); err != nil {
+		return nil, err
+	}
+
+	for id := range lights {
+		l := lights[id]
+
+		l.ID = id
+
+		lights[id] = l
+		slog.Debug(fmt.Sprintf("got light: %v, state: %v", l, l.StateDef))
+	}
+
+	return &lights, nil
+}
+
+// Groups returns a map of groups as received from the deCONZ /groups endpoint
+// The map key is the group id.
+func (a *API) Groups(ctx context.Context) (*group.Groups, error) {
+
+	uri := fmt.Sprintf("%s/%s/groups", a.Config.Addr, a.Config.APIKey)
+
+	var groups group.Groups
+	if err := a.get(ctx, "groups", uri, &groups); err != nil {
+		return nil, err
+	}
+
+	for id := range groups {
+		g := groups[id]
+
+		g.ID = id
+
+		groups[id] = g
+		slog.Debug(fmt.Sprintf("got group: %v, state: %v", g, g.StateDef))
+	}
+
+	return &groups, nil
+}
+
+// Scenes returns a map of the scenes of a group as received from the deCONZ /groups/<id>/scenes endpoint
+// The map key is the scene id.
+func (a *API) Scenes(ctx context.Context, groupID int) (*group.Scenes, error) {
+
+	uri := fmt.Sprintf("%s/%s/groups/%d/scenes", a.Config.Addr, a.Config.APIKey, groupID)
+
+	var scenes group.Scenes
+	if err := a.get(ctx, "scenes", uri, &scenes); err != nil {
+		return nil, err
+	}
+
+	for id := range scenes {
+		s := scenes[id]
+
+		s.ID = id
+
+		scenes[id] = s
+	}
+
+	return &scenes, nil
+}
+
+// get sends a GET request to the REST API with the configured client settings, decodes the response into v and
+// observes the duration of the request for the endpoint
+// Errors name the endpoint instead of uri, which holds the API key.
+func (a *API) get(ctx context.Context, endpoint, uri string, v interface{}) error {
+	client := a.client
+	if client == nil {
+		var err error
+		if client, err = a.Config.Client(); err != nil {
+			return fmt.Errorf("unable to get %s: %w", endpoint, err)
+		}
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.RESTDuration.WithLabelValues(a.Config.NameOrDefault(), endpoint).Observe(time.Since(start).Seconds())
+	}()
+
+	if err := client.Get(ctx, uri, v); err != nil {
+		return fmt.Errorf("unable to get %s: %w", endpoint, err)
+	}
+	return nil
+}
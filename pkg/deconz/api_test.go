@@ -1,11 +1,14 @@
 package deconz
 
 import (
+	"context"
 	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz/group"
 	"github.com/rvk01/deflux/pkg/deconz/sensor"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -73,10 +76,9 @@ func TestApiSensors(t *testing.T) {
 			APIKey: "",
 			WsAddr: "",
 		},
-		sensorCache: nil,
 	}
 
-	sensors, err := api.Sensors()
+	sensors, err := api.Sensors(context.Background())
 	if err != nil {
 		t.Fatalf("failed to get sensors: %s", err)
 	}
@@ -86,27 +88,35 @@ func TestApiSensors(t *testing.T) {
 
 	want := &sensor.Sensors{
 		4: sensor.Sensor{
-			Type:     "ZHAPressure",
-			Name:     "th-sz",
-			LastSeen: lastSeen4,
+			Type:         "ZHAPressure",
+			Name:         "th-sz",
+			LastSeen:     lastSeen4,
+			Manufacturer: "LUMI",
+			ModelID:      "lumi.weather",
+			SWVersion:    "20191205",
+			UniqueID:     "00:15:8d:12:34:bd:ff:71-01-0403",
 			StateDef: &sensor.ZHAPressure{
 				State:    sensor.State{Lastupdated: "2022-01-09T17:58:29.629"},
 				Pressure: 996,
 			},
-			Config: sensor.Config{Battery: 91},
+			Config: sensor.Config{Battery: 91, Reachable: true},
 			ID:     4,
 		},
 		5: sensor.Sensor{
-			Type:     "ZHAOpenClose",
-			Name:     "wi-wc",
-			LastSeen: lastSeen5,
+			Type:          "ZHAOpenClose",
+			Name:          "wi-wc",
+			LastSeen:      lastSeen5,
+			LastAnnounced: time.Date(2022, 1, 4, 15, 0, 40, 0, time.UTC),
+			Manufacturer:  "LIDL Silvercrest",
+			ModelID:       "TY0203",
+			UniqueID:      "68:b0:e2:ff:fe:12:34:ff-01-0500",
 			StateDef: &sensor.ZHAOpenClose{
 				State:      sensor.State{Lastupdated: "2022-01-09T18:12:29.179"},
 				Tampered:   false,
 				Lowbattery: false,
 				Open:       false,
 			},
-			Config: sensor.Config{Battery: 0},
+			Config: sensor.Config{Battery: 0, Reachable: true},
 			ID:     5,
 		},
 	}
@@ -154,11 +164,10 @@ func TestBatteryTimeSeries(t *testing.T) {
 			APIKey: "",
 			WsAddr: "",
 		},
-		sensorCache: nil,
 	}
 
 	now := time.Now()
-	sensors, err := api.Sensors()
+	sensors, err := api.Sensors(context.Background())
 	if err != nil {
 		t.Fatalf("failed to get sensors: %s", err)
 	}
@@ -167,14 +176,20 @@ func TestBatteryTimeSeries(t *testing.T) {
 
 	want := &sensor.Sensors{
 		1: sensor.Sensor{
-			Type:     "ZHABattery",
-			Name:     "batterytest",
-			LastSeen: lastSeen,
+			Type:          "ZHABattery",
+			Name:          "batterytest",
+			LastSeen:      lastSeen,
+			LastAnnounced: time.Date(2021, 12, 24, 11, 37, 43, 0, time.UTC),
+			Manufacturer:  "IKEA of Sweden",
+			ModelID:       "FYRTUR block-out roller blind",
+			SWVersion:     "2.2.009",
+			UniqueID:      "84:71:27:ff:fe:25:f7:b3-01-0001",
 			StateDef: &sensor.ZHABattery{
 				State:   sensor.State{Lastupdated: "2021-12-20T06:03:35.000"},
 				Battery: 75,
 			},
-			ID: 1,
+			Config: sensor.Config{Reachable: true},
+			ID:     1,
 		},
 	}
 
@@ -211,3 +226,154 @@ func TestBatteryTimeSeries(t *testing.T) {
 
 	}
 }
+
+func TestApiLights(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/key/lights" {
+			t.Errorf("unexpected request path %s", r.URL.Path)
+		}
+
+		resp := `{
+			"3": {
+				"etag": "026bcfe544ad76c7534e5ca8ed39047c",
+				"hascolor": true,
+				"manufacturername": "IKEA of Sweden",
+				"modelid": "TRADFRI bulb E27 WS opal 980lm",
+				"name": "desk",
+				"state": {
+					"alert": "none",
+					"bri": 254,
+					"colormode": "ct",
+					"ct": 370,
+					"on": true,
+					"reachable": true
+				},
+				"swversion": "1.2.217",
+				"type": "Color temperature light",
+				"uniqueid": "00:0b:57:ff:fe:12:34:56-01"
+			}
+		}`
+
+		if _, err := w.Write([]byte(resp)); err != nil {
+			t.Fatalf("failed to send response: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := API{
+		Config: config.APIConfig{
+			Addr:   ts.URL,
+			APIKey: "key",
+		},
+	}
+
+	lights, err := api.Lights(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get lights: %s", err)
+	}
+
+	l, ok := (*lights)[3]
+	if !ok || l.ID != 3 || l.Name != "desk" || l.UniqueID != "00:0b:57:ff:fe:12:34:56-01" {
+		t.Fatalf("unexpected lights: %v", lights)
+	}
+
+	tags, fields, err := l.Timeseries()
+	if err != nil {
+		t.Fatalf("timeseries has error: %s", err)
+	}
+
+	wantTags := map[string]string{"name": "desk", "type": "Color temperature light", "id": "3", "source": "rest"}
+	if !reflect.DeepEqual(wantTags, tags) {
+		t.Fatalf("expected: %v, got: %v", wantTags, tags)
+	}
+
+	wantFields := map[string]interface{}{"on": true, "bri": 254, "ct": 370, "colormode": "ct", "reachable": true}
+	if !reflect.DeepEqual(wantFields, fields) {
+		t.Fatalf("expected: %v, got: %v", wantFields, fields)
+	}
+}
+
+func TestApiGroupsAndScenes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp string
+
+		switch r.URL.Path {
+		case "/key/groups":
+			resp = `{
+				"1": {
+					"action": {"on": true},
+					"devicemembership": [],
+					"etag": "ab5272cfe11339202929259af22b6bdd",
+					"id": "1",
+					"lights": ["3", "4"],
+					"name": "living room",
+					"scenes": [
+						{"id": "1", "lightcount": 2, "name": "Relax", "transitiontime": 10},
+						{"id": "2", "lightcount": 2, "name": "Movie", "transitiontime": 10}
+					],
+					"state": {"all_on": false, "any_on": true},
+					"type": "LightGroup"
+				}
+			}`
+		case "/key/groups/1/scenes":
+			resp = `{
+				"1": {"lightcount": 2, "name": "Relax", "transitiontime": 10},
+				"2": {"lightcount": 2, "name": "Movie", "transitiontime": 10}
+			}`
+		default:
+			t.Errorf("unexpected request path %s", r.URL.Path)
+		}
+
+		if _, err := w.Write([]byte(resp)); err != nil {
+			t.Fatalf("failed to send response: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	api := API{
+		Config: config.APIConfig{
+			Addr:   ts.URL,
+			APIKey: "key",
+		},
+	}
+
+	groups, err := api.Groups(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get groups: %s", err)
+	}
+
+	allOn, anyOn := false, true
+	want := &group.Groups{
+		1: group.Group{
+			Type:     "LightGroup",
+			Name:     "living room",
+			StateDef: group.State{AllOn: &allOn, AnyOn: &anyOn},
+			Scenes:   []group.Scene{{ID: 1, Name: "Relax"}, {ID: 2, Name: "Movie"}},
+			ID:       1,
+		},
+	}
+	if !reflect.DeepEqual(want, groups) {
+		t.Fatalf("expected: %v, got: %v", want, groups)
+	}
+
+	scenes, err := api.Scenes(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("failed to get scenes: %s", err)
+	}
+
+	wantScenes := &group.Scenes{1: {ID: 1, Name: "Relax"}, 2: {ID: 2, Name: "Movie"}}
+	if !reflect.DeepEqual(wantScenes, scenes) {
+		t.Fatalf("expected: %v, got: %v", wantScenes, scenes)
+	}
+}
+
+func TestApiErrorWithoutAPIKey(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+
+	api := API{Config: config.APIConfig{Addr: ts.URL + "/api", APIKey: "123A4B5C67", Retries: -1}}
+	_, err := api.Sensors(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "unable to get sensors") || strings.Contains(err.Error(), "123A4B5C67") {
+		t.Errorf("expected an error naming the endpoint without the API key, got %v", err)
+	}
+}
@@ -3,8 +3,11 @@ package deconz
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/rvk01/deflux/pkg/deconz/group"
+	"github.com/rvk01/deflux/pkg/deconz/light"
 	"github.com/rvk01/deflux/pkg/deconz/sensor"
 	"strconv"
+	"time"
 )
 
 // Event is a common interface for different types of websocket events
@@ -52,8 +55,116 @@ func (s *SensorEvent) Timeseries() (map[string]string, map[string]interface{}, e
 		nil
 }
 
+// SensorUpdateEvent is an Event triggered by a change of the attributes or config of a Sensor, e.g. its lastseen
+// or reachable state. Sensor holds the updated sensor.
+type SensorUpdateEvent struct {
+	*sensor.Sensor
+	Event
+}
+
+// LightEvent is an Event triggered by a Light
+type LightEvent struct {
+	*light.Light
+	Event
+}
+
+// Timeseries returns tags and fields for use in InfluxDB
+func (l *LightEvent) Timeseries() (map[string]string, map[string]interface{}, error) {
+	if l.Event == nil || l.Event.State() == nil {
+		return nil, nil, fmt.Errorf("event is empty: %v", l)
+	}
+
+	state, ok := l.Event.State().(*light.State)
+	if !ok {
+		return nil, nil, fmt.Errorf("this event (%T:%s) has no time series data", l.Event.State(), l.Name)
+	}
+
+	fields := state.Fields()
+	if len(fields) == 0 {
+		return nil, nil, fmt.Errorf("this event (%s) has no time series data", l.Name)
+	}
+
+	return l.Light.Tags("websocket"), fields, nil
+}
+
+// GroupEvent is an Event triggered by a change of the state of a Group
+type GroupEvent struct {
+	*group.Group
+	Event
+}
+
+// Timeseries returns tags and fields for use in InfluxDB
+func (g *GroupEvent) Timeseries() (map[string]string, map[string]interface{}, error) {
+	if g.Event == nil || g.Event.State() == nil {
+		return nil, nil, fmt.Errorf("event is empty: %v", g)
+	}
+
+	state, ok := g.Event.State().(*group.State)
+	if !ok {
+		return nil, nil, fmt.Errorf("this event (%T:%s) has no time series data", g.Event.State(), g.Name)
+	}
+
+	fields := state.Fields()
+	if len(fields) == 0 {
+		return nil, nil, fmt.Errorf("this event (%s) has no time series data", g.Name)
+	}
+
+	return g.Group.Tags("websocket"), fields, nil
+}
+
+// SceneEvent is an Event triggered by recalling a scene of a Group
+type SceneEvent struct {
+	*group.Group
+	Event
+
+	// Scene is the recalled scene. Its name is empty if the scene is not known yet.
+	Scene group.Scene
+}
+
+// Timeseries returns tags and fields for use in InfluxDB
+// The tags describe the group, the fields the recalled scene.
+func (s *SceneEvent) Timeseries() (map[string]string, map[string]interface{}, error) {
+	fields := map[string]interface{}{
+		"scene_id": s.Scene.ID,
+	}
+	if s.Scene.Name != "" {
+		fields["scene_name"] = s.Scene.Name
+	}
+
+	return s.Group.Tags("websocket"), fields, nil
+}
+
+// ReconnectEvent is emitted by the WebsocketEventReader after the websocket has been connected again
+// Events that deCONZ sent between Disconnected and the reconnect have been missed.
+type ReconnectEvent struct {
+	// Disconnected is the time the last message of the previous connection has been received, or the previous
+	// connection has been established
+	Disconnected time.Time
+}
+
+// EventName returns "reconnected"
+func (e *ReconnectEvent) EventName() string {
+	return "reconnected"
+}
+
+// Resource returns "websocket"
+func (e *ReconnectEvent) Resource() string {
+	return "websocket"
+}
+
+// ResourceID returns 0, the event does not belong to a resource
+func (e *ReconnectEvent) ResourceID() int {
+	return 0
+}
+
+// State returns nil, the event has no state
+func (e *ReconnectEvent) State() interface{} {
+	return nil
+}
+
 // WsEvent is a message received over the deCONZ websocket
-// We are only interested in e = 'change' events of resource type r = 'sensor'.
+// We are only interested in e = 'change' events of resource types r = 'sensors', r = 'lights' and r = 'groups',
+// and in e = 'scene-called' events.
 // Thus we don't implement all fields.
 // See https://dresden-elektronik.github.io/deconz-rest-doc/endpoints/websocket/#message-fields
 type WsEvent struct {
@@ -70,6 +181,19 @@ type WsEvent struct {
 
 	// only for e = 'changed'
 	StateDef interface{}
+
+	// only for e = 'changed', if attributes of the resource have changed
+	RawAttr json.RawMessage `json:"attr"`
+
+	// only for e = 'changed', if the config of the resource has changed
+	RawConfig json.RawMessage `json:"config"`
+
+	// only for e = 'added' of resource type r = 'sensors'
+	RawSensor json.RawMessage `json:"sensor"`
+
+	// only for e = 'scene-called'
+	GroupID int `json:"gid,string"`
+	SceneID int `json:"scid,string"`
 }
 
 // EventName return the name of an event, e.g. "change"
@@ -92,24 +216,61 @@ func (e WsEvent) State() interface{} {
 	return e.StateDef
 }
 
+// Decoder decodes messages from the deCONZ websocket
+// The providers are used to look up the resources affected by an event. If the Lights or Groups provider is nil,
+// light or group and scene events are not decoded.
+type Decoder struct {
+	Sensors sensor.Provider
+	Lights  light.Provider
+	Groups  group.Provider
+}
+
 // DecodeEvent parses events from bytes
 func DecodeEvent(sp sensor.Provider, b []byte) (Event, error) {
+	return Decoder{Sensors: sp}.Decode(b)
+}
+
+// Decode parses events from bytes
+func (d Decoder) Decode(b []byte) (Event, error) {
 	var e WsEvent
 	err := json.Unmarshal(b, &e)
 	if err != nil {
 		return nil, fmt.Errorf("unable to unmarshal json: %s", err)
 	}
 
-	// We don't decode anything other than sensor events
+	if e.EventName() == "scene-called" && d.Groups != nil {
+		return d.decodeSceneEvent(e)
+	}
+
 	// If there is no state, dont try to parse it
-	if e.Resource() != "sensors" || len(e.RawState) == 0 {
+	if len(e.RawState) == 0 {
 		e.StateDef = &sensor.EmptyState{}
 		return e, nil
 	}
 
-	s, err := sp.Sensor(e.ID)
+	switch e.Resource() {
+	case "sensors":
+		return d.decodeSensorEvent(e)
+	case "lights":
+		if d.Lights != nil {
+			return d.decodeLightEvent(e)
+		}
+	case "groups":
+		if d.Groups != nil {
+			return d.decodeGroupEvent(e)
+		}
+	}
+
+	// We don't decode anything else
+	e.StateDef = &sensor.EmptyState{}
+	return e, nil
+}
+
+// decodeSensorEvent decodes the state of a sensor event
+func (d Decoder) decodeSensorEvent(e WsEvent) (Event, error) {
+	s, err := d.Sensors.Sensor(e.ID)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get sensor with id %d: %s", e.ID, err)
+		return nil, fmt.Errorf("unable to get sensor with id %d: %w", e.ID, err)
 	}
 
 	state, err := sensor.DecodeSensorState(e.RawState, s.Type)
@@ -120,3 +281,53 @@ func DecodeEvent(sp sensor.Provider, b []byte) (Event, error) {
 
 	return SensorEvent{Sensor: s, Event: e}, nil
 }
+
+// decodeLightEvent decodes the state of a light event
+func (d Decoder) decodeLightEvent(e WsEvent) (Event, error) {
+	l, err := d.Lights.Light(e.ID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get light with id %d: %s", e.ID, err)
+	}
+
+	var state light.State
+	err = json.Unmarshal(e.RawState, &state)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode light state: %s", err)
+	}
+	e.StateDef = &state
+
+	return LightEvent{Light: l, Event: e}, nil
+}
+
+// decodeGroupEvent decodes the state of a group event
+func (d Decoder) decodeGroupEvent(e WsEvent) (Event, error) {
+	g, err := d.Groups.Group(e.ID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get group with id %d: %s", e.ID, err)
+	}
+
+	var state group.State
+	err = json.Unmarshal(e.RawState, &state)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode group state: %s", err)
+	}
+	e.StateDef = &state
+
+	return GroupEvent{Group: g, Event: e}, nil
+}
+
+// decodeSceneEvent looks up the group and scene of a scene-called event
+func (d Decoder) decodeSceneEvent(e WsEvent) (Event, error) {
+	g, err := d.Groups.Group(e.GroupID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get group with id %d: %s", e.GroupID, err)
+	}
+
+	scene := group.Scene{ID: e.SceneID}
+	if s, ok := g.Scene(e.SceneID); ok {
+		scene = *s
+	}
+	e.StateDef = &sensor.EmptyState{}
+
+	return SceneEvent{Group: g, Event: e, Scene: scene}, nil
+}
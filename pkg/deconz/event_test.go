@@ -2,6 +2,8 @@ package deconz
 
 import (
 	"errors"
+	"github.com/rvk01/deflux/pkg/deconz/group"
+	"github.com/rvk01/deflux/pkg/deconz/light"
 	"github.com/rvk01/deflux/pkg/deconz/sensor"
 	"os"
 	"reflect"
@@ -24,7 +26,39 @@ func (l TestSensorProvider) Sensors() (*sensor.Sensors, error) {
 	return l.Store, nil
 }
 
+type TestLightProvider struct {
+	Store *light.Lights
+}
+
+func (l TestLightProvider) Light(i int) (*light.Light, error) {
+	if s, ok := (*l.Store)[i]; ok {
+		return &s, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (l TestLightProvider) Lights() (*light.Lights, error) {
+	return l.Store, nil
+}
+
+type TestGroupProvider struct {
+	Store *group.Groups
+}
+
+func (l TestGroupProvider) Group(i int) (*group.Group, error) {
+	if s, ok := (*l.Store)[i]; ok {
+		return &s, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (l TestGroupProvider) Groups() (*group.Groups, error) {
+	return l.Store, nil
+}
+
 var sensorInfo sensor.Provider
+var lightInfo light.Provider
+var groupInfo group.Provider
 
 func TestMain(m *testing.M) {
 
@@ -45,6 +79,18 @@ func TestMain(m *testing.M) {
 		15: sensor.Sensor{Type: "ZHAAirQuality", Name: "ZHAAirQuality"},
 	}}
 
+	lightInfo = TestLightProvider{Store: &light.Lights{
+		1: light.Light{Type: "Extended color light", Name: "living room", ID: 1},
+		2: light.Light{Type: "Dimmable light", Name: "hallway", ID: 2},
+	}}
+
+	groupInfo = TestGroupProvider{Store: &group.Groups{
+		1: group.Group{Type: "LightGroup", Name: "living room", ID: 1, Scenes: []group.Scene{
+			{ID: 1, Name: "Relax"},
+			{ID: 2, Name: "Movie"},
+		}},
+	}}
+
 	os.Exit(m.Run())
 }
 
@@ -389,3 +435,145 @@ func TestBatteryTimeseries(t *testing.T) {
 		t.Fatalf("expected: %v, got: %v", wantFields, fields)
 	}
 }
+
+func TestLightEvents(t *testing.T) {
+	on := true
+	bri := 127
+	xy := [2]float64{0.3144, 0.3301}
+	colormode := "xy"
+	reachable := false
+
+	tests := map[string]struct {
+		jsonInput  string
+		wantTags   map[string]string
+		wantFields map[string]interface{}
+	}{
+		"full state": {
+			jsonInput: `{
+				"e": "changed",
+				"id": "1",
+				"r": "lights",
+				"t": "event",
+				"state": {
+					"on": true,
+					"bri": 127,
+					"colormode": "xy",
+					"xy": [0.3144, 0.3301],
+					"reachable": true
+				}
+			}`,
+			wantTags: map[string]string{"name": "living room", "type": "Extended color light", "id": "1", "source": "websocket"},
+			wantFields: map[string]interface{}{
+				"on":        on,
+				"bri":       bri,
+				"colormode": colormode,
+				"x":         xy[0],
+				"y":         xy[1],
+				"reachable": true,
+			},
+		},
+		"partial state": {
+			jsonInput: `{
+				"e": "changed",
+				"id": "2",
+				"r": "lights",
+				"t": "event",
+				"state": {
+					"reachable": false
+				}
+			}`,
+			wantTags:   map[string]string{"name": "hallway", "type": "Dimmable light", "id": "2", "source": "websocket"},
+			wantFields: map[string]interface{}{"reachable": reachable},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, err := Decoder{Sensors: sensorInfo, Lights: lightInfo}.Decode([]byte(tc.jsonInput))
+			if err != nil {
+				t.Fatalf("unable to decode: %s", err)
+			}
+
+			le, ok := e.(LightEvent)
+			if !ok {
+				t.Fatalf("expected LightEvent, got %T", e)
+			}
+
+			tags, fields, err := le.Timeseries()
+			if err != nil {
+				t.Fatalf("timeseries has error: %s", err)
+			}
+			if !reflect.DeepEqual(tc.wantTags, tags) {
+				t.Fatalf("expected: %v, got: %v", tc.wantTags, tags)
+			}
+			if !reflect.DeepEqual(tc.wantFields, fields) {
+				t.Fatalf("expected: %v, got: %v", tc.wantFields, fields)
+			}
+		})
+	}
+
+	// without a light provider, light events are not decoded
+	e, err := DecodeEvent(sensorInfo, []byte(tests["full state"].jsonInput))
+	if err != nil {
+		t.Fatalf("unable to decode: %s", err)
+	}
+	if _, ok := e.(LightEvent); ok {
+		t.Fatalf("expected no LightEvent without light provider")
+	}
+}
+
+func TestGroupEvents(t *testing.T) {
+	d := Decoder{Sensors: sensorInfo, Lights: lightInfo, Groups: groupInfo}
+
+	tests := map[string]struct {
+		jsonInput  string
+		wantTags   map[string]string
+		wantFields map[string]interface{}
+	}{
+		"group state": {
+			jsonInput:  `{"e": "changed", "id": "1", "r": "groups", "state": {"all_on": false, "any_on": true}, "t": "event"}`,
+			wantTags:   map[string]string{"name": "living room", "type": "LightGroup", "id": "1", "source": "websocket"},
+			wantFields: map[string]interface{}{"all_on": false, "any_on": true},
+		},
+		"scene called": {
+			jsonInput:  `{"e": "scene-called", "gid": "1", "r": "scenes", "scid": "2", "t": "event"}`,
+			wantTags:   map[string]string{"name": "living room", "type": "LightGroup", "id": "1", "source": "websocket"},
+			wantFields: map[string]interface{}{"scene_id": 2, "scene_name": "Movie"},
+		},
+		"unknown scene called": {
+			jsonInput:  `{"e": "scene-called", "gid": "1", "r": "scenes", "scid": "7", "t": "event"}`,
+			wantTags:   map[string]string{"name": "living room", "type": "LightGroup", "id": "1", "source": "websocket"},
+			wantFields: map[string]interface{}{"scene_id": 7},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, err := d.Decode([]byte(tc.jsonInput))
+			if err != nil {
+				t.Fatalf("unable to decode: %s", err)
+			}
+
+			var ts Timeserieser
+			switch ev := e.(type) {
+			case GroupEvent:
+				ts = &ev
+			case SceneEvent:
+				ts = &ev
+			default:
+				t.Fatalf("unexpected event type %T", e)
+			}
+
+			tags, fields, err := ts.Timeseries()
+			if err != nil {
+				t.Fatalf("timeseries has error: %s", err)
+			}
+			if !reflect.DeepEqual(tc.wantTags, tags) {
+				t.Fatalf("expected: %v, got: %v", tc.wantTags, tags)
+			}
+			if !reflect.DeepEqual(tc.wantFields, fields) {
+				t.Fatalf("expected: %v, got: %v", tc.wantFields, fields)
+			}
+		})
+	}
+}
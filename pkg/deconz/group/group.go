@@ -0,0 +1,89 @@
+package group
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Groups is a map of groups indexed by their id
+type Groups map[int]Group
+
+// Scenes is a map of scenes indexed by their id
+type Scenes map[int]Scene
+
+// Provider provides information about groups
+type Provider interface {
+	// Groups provides info about all known groups
+	Groups() (*Groups, error)
+
+	// Group gets a group by id
+	Group(int) (*Group, error)
+}
+
+// Group is a deCONZ group of lights
+// We only implement required fields for event decoding
+type Group struct {
+	Type     string  `json:"type"`
+	Name     string  `json:"name"`
+	StateDef State   `json:"state"`
+	Scenes   []Scene `json:"scenes"`
+	ID       int     `json:"-"`
+}
+
+// State is the state of a group
+// Missing attributes are nil.
+type State struct {
+	AllOn *bool `json:"all_on"`
+	AnyOn *bool `json:"any_on"`
+}
+
+// Scene is a scene of a group
+type Scene struct {
+	ID   int    `json:"id,string"`
+	Name string `json:"name"`
+}
+
+// Fields implements the fielder interface and returns time series data for InfluxDB
+// Only attributes that are present are returned.
+func (s *State) Fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+
+	if s.AllOn != nil {
+		fields["all_on"] = *s.AllOn
+	}
+	if s.AnyOn != nil {
+		fields["any_on"] = *s.AnyOn
+	}
+
+	return fields
+}
+
+// Scene returns the scene with the given id
+func (g *Group) Scene(id int) (*Scene, bool) {
+	for _, s := range g.Scenes {
+		if s.ID == id {
+			return &s, true
+		}
+	}
+	return nil, false
+}
+
+// Tags returns the tags of the group for InfluxDB
+func (g *Group) Tags(source string) map[string]string {
+	return map[string]string{
+		"name":   g.Name,
+		"type":   g.Type,
+		"id":     strconv.Itoa(g.ID),
+		"source": source,
+	}
+}
+
+// Timeseries returns tags and fields for use in InfluxDB
+func (g *Group) Timeseries() (map[string]string, map[string]interface{}, error) {
+	fields := g.StateDef.Fields()
+	if len(fields) == 0 {
+		return nil, nil, fmt.Errorf("this group (%s) has no time series data", g.Name)
+	}
+
+	return g.Tags("rest"), fields, nil
+}
@@ -0,0 +1,76 @@
+package deconz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/deconz/group"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"log/slog"
+	"time"
+)
+
+// CachingGroupProvider is a group.Provider that retrieves group info from the deCONZ REST API and caches results
+type CachingGroupProvider struct {
+	// ctx is the context of the requests to the REST API
+	ctx            context.Context
+	api            API
+	cache          *group.Groups
+	nextFetch      time.Time
+	updateInterval time.Duration
+}
+
+// NewCachingGroupProvider returns a CachingGroupProvider
+// Requests to the REST API are canceled when ctx is done.
+func NewCachingGroupProvider(ctx context.Context, api API, updateInterval time.Duration) (*CachingGroupProvider, error) {
+	p := &CachingGroupProvider{ctx: ctx, api: api, updateInterval: updateInterval}
+
+	err := p.populateCache()
+	if err != nil {
+		return nil, fmt.Errorf("unable to populate group cache: %s", err)
+	}
+
+	return p, nil
+}
+
+// Group returns a group for a group id
+func (c *CachingGroupProvider) Group(i int) (*group.Group, error) {
+	if err := c.populateCache(); err != nil {
+		slog.Error(fmt.Sprintf("failed to update group cache: %s", err))
+	}
+
+	if g, found := (*c.cache)[i]; found {
+		return &g, nil
+	}
+
+	return nil, errors.New("no such group")
+}
+
+// Groups returns all groups in the cache
+func (c *CachingGroupProvider) Groups() (*group.Groups, error) {
+	if err := c.populateCache(); err != nil {
+		slog.Error(fmt.Sprintf("failed to update group cache: %s", err))
+	}
+
+	return c.cache, nil
+}
+
+func (c *CachingGroupProvider) populateCache() error {
+	now := time.Now()
+
+	if now.Before(c.nextFetch) {
+		return nil
+	}
+
+	groups, err := c.api.Groups(c.ctx)
+	metrics.CacheRefreshes.WithLabelValues(c.api.Config.NameOrDefault(), "groups", metrics.Result(err)).Inc()
+	if err != nil {
+		return err
+	}
+
+	c.cache = groups
+	c.nextFetch = now.Add(c.updateInterval)
+	slog.Info(fmt.Sprintf("Group cache updated, found %d groups", len(*c.cache)))
+
+	return nil
+}
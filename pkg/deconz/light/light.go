@@ -0,0 +1,98 @@
+package light
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Lights is a map of lights indexed by their id
+type Lights map[int]Light
+
+// Provider provides information about lights
+type Provider interface {
+	// Lights provides info about all known lights
+	Lights() (*Lights, error)
+
+	// Light gets a light by id
+	Light(int) (*Light, error)
+}
+
+// Light is a deCONZ light
+// We only implement required fields for event decoding
+type Light struct {
+	Type         string `json:"type"`
+	Name         string `json:"name"`
+	ModelID      string `json:"modelid"`
+	Manufacturer string `json:"manufacturername"`
+	UniqueID     string `json:"uniqueid"`
+	StateDef     State  `json:"state"`
+	ID           int    `json:"-"`
+}
+
+// State is the state of a light
+// Websocket events only contain the attributes that have changed, and not all lights support all attributes.
+// Missing attributes are nil.
+type State struct {
+	On        *bool       `json:"on"`
+	Bri       *int        `json:"bri"`
+	CT        *int        `json:"ct"`
+	XY        *[2]float64 `json:"xy"`
+	Hue       *int        `json:"hue"`
+	Sat       *int        `json:"sat"`
+	ColorMode *string     `json:"colormode"`
+	Reachable *bool       `json:"reachable"`
+}
+
+// Fields implements the fielder interface and returns time series data for InfluxDB
+// Only attributes that are present are returned.
+func (s *State) Fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+
+	if s.On != nil {
+		fields["on"] = *s.On
+	}
+	if s.Bri != nil {
+		fields["bri"] = *s.Bri
+	}
+	if s.CT != nil {
+		fields["ct"] = *s.CT
+	}
+	if s.XY != nil {
+		fields["x"] = s.XY[0]
+		fields["y"] = s.XY[1]
+	}
+	if s.Hue != nil {
+		fields["hue"] = *s.Hue
+	}
+	if s.Sat != nil {
+		fields["sat"] = *s.Sat
+	}
+	if s.ColorMode != nil {
+		fields["colormode"] = *s.ColorMode
+	}
+	if s.Reachable != nil {
+		fields["reachable"] = *s.Reachable
+	}
+
+	return fields
+}
+
+// Tags returns the tags of the light for InfluxDB
+func (l *Light) Tags(source string) map[string]string {
+	return map[string]string{
+		"name":   l.Name,
+		"type":   l.Type,
+		"id":     strconv.Itoa(l.ID),
+		"source": source,
+	}
+}
+
+// Timeseries returns tags and fields for use in InfluxDB
+func (l *Light) Timeseries() (map[string]string, map[string]interface{}, error) {
+	fields := l.StateDef.Fields()
+	if len(fields) == 0 {
+		return nil, nil, fmt.Errorf("this light (%s) has no time series data", l.Name)
+	}
+
+	return l.Tags("rest"), fields, nil
+}
@@ -0,0 +1,76 @@
+package deconz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/deconz/light"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"log/slog"
+	"time"
+)
+
+// CachingLightProvider is a light.Provider that retrieves light info from the deCONZ REST API and caches results
+type CachingLightProvider struct {
+	// ctx is the context of the requests to the REST API
+	ctx            context.Context
+	api            API
+	cache          *light.Lights
+	nextFetch      time.Time
+	updateInterval time.Duration
+}
+
+// NewCachingLightProvider returns a CachingLightProvider
+// Requests to the REST API are canceled when ctx is done.
+func NewCachingLightProvider(ctx context.Context, api API, updateInterval time.Duration) (*CachingLightProvider, error) {
+	p := &CachingLightProvider{ctx: ctx, api: api, updateInterval: updateInterval}
+
+	err := p.populateCache()
+	if err != nil {
+		return nil, fmt.Errorf("unable to populate light cache: %s", err)
+	}
+
+	return p, nil
+}
+
+// Light returns a light for a light id
+func (c *CachingLightProvider) Light(i int) (*light.Light, error) {
+	if err := c.populateCache(); err != nil {
+		slog.Error(fmt.Sprintf("failed to update light cache: %s", err))
+	}
+
+	if l, found := (*c.cache)[i]; found {
+		return &l, nil
+	}
+
+	return nil, errors.New("no such light")
+}
+
+// Lights returns all lights in the cache
+func (c *CachingLightProvider) Lights() (*light.Lights, error) {
+	if err := c.populateCache(); err != nil {
+		slog.Error(fmt.Sprintf("failed to update light cache: %s", err))
+	}
+
+	return c.cache, nil
+}
+
+func (c *CachingLightProvider) populateCache() error {
+	now := time.Now()
+
+	if now.Before(c.nextFetch) {
+		return nil
+	}
+
+	lights, err := c.api.Lights(c.ctx)
+	metrics.CacheRefreshes.WithLabelValues(c.api.Config.NameOrDefault(), "lights", metrics.Result(err)).Inc()
+	if err != nil {
+		return err
+	}
+
+	c.cache = lights
+	c.nextFetch = now.Add(c.updateInterval)
+	slog.Info(fmt.Sprintf("Light cache updated, found %d lights", len(*c.cache)))
+
+	return nil
+}
@@ -0,0 +1,180 @@
+// Package rest is the HTTP client of the deCONZ REST API
+// It applies a timeout to every request, retries idempotent requests and distinguishes failures by their error type.
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Defaults of the client options
+const (
+	// DefaultTimeout is the default timeout of a single request
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetries is the default number of retries of a failed GET request
+	DefaultRetries = 2
+	// DefaultRetryBackoff is the default delay before the first retry. It doubles with every retry.
+	DefaultRetryBackoff = 500 * time.Millisecond
+)
+
+// Options configures a Client. Fields that are not set use the defaults.
+type Options struct {
+	// Timeout is the timeout of a single request, including reading the response
+	Timeout time.Duration
+
+	// Retries is the number of retries of GET requests after connection failures and server errors.
+	// A negative number disables retries.
+	Retries int
+
+	// RetryBackoff is the delay before the first retry
+	RetryBackoff time.Duration
+}
+
+// Client sends requests to the deCONZ REST API
+type Client struct {
+	http *http.Client
+	opts Options
+}
+
+// New returns a Client that sends requests with c, e.g. a client with custom TLS settings
+func New(c *http.Client, opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+
+	return &Client{http: c, opts: opts}
+}
+
+// Get sends a GET request to url and decodes the JSON response into v
+func (c *Client) Get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %s", withoutURL(err))
+	}
+
+	return c.Do(req, v)
+}
+
+// Do sends the request and decodes the JSON response into v, unless v is nil
+// GET requests are retried after connection failures and server errors until the retries are exhausted or the
+// context of the request is done. Failed requests return a *ConnectionError, *AuthError, *APIError or *StatusError.
+func (c *Client) Do(req *http.Request, v interface{}) error {
+	ctx := req.Context()
+	backoff := c.opts.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := c.do(req, v)
+		if err == nil || req.Method != http.MethodGet || attempt >= c.opts.Retries || !retryable(err) ||
+			ctx.Err() != nil {
+			return err
+		}
+
+		slog.Debug(fmt.Sprintf("Retrying deCONZ request in %s: %s", backoff, err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// do sends a single attempt of the request
+func (c *Client) do(req *http.Request, v interface{}) error {
+	ctx, cancel := context.WithTimeout(req.Context(), c.opts.Timeout)
+	defer cancel()
+
+	resp, err := c.http.Do(req.Clone(ctx))
+	if err != nil {
+		return &ConnectionError{Err: withoutURL(err)}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &ConnectionError{Err: fmt.Errorf("unable to read response: %w", err)}
+	}
+
+	apiErr := parseAPIError(body)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		if apiErr != nil {
+			return &AuthError{StatusCode: resp.StatusCode, Err: apiErr}
+		}
+		return &AuthError{StatusCode: resp.StatusCode, Err: &StatusError{StatusCode: resp.StatusCode, Body: string(body)}}
+	case apiErr != nil:
+		return apiErr
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	if v == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unable to decode response: %s", err)
+	}
+
+	return nil
+}
+
+// parseAPIError returns the first error of a deCONZ error response, or nil if body is no error response
+// Errors are returned as list of error objects.
+func parseAPIError(body []byte) *APIError {
+	var errs []struct {
+		Error *APIError `json:"error"`
+	}
+	if json.Unmarshal(body, &errs) != nil {
+		return nil
+	}
+
+	for _, e := range errs {
+		if e.Error != nil {
+			return e.Error
+		}
+	}
+	return nil
+}
+
+// retryable returns true if a request that failed with err may succeed when it is sent again
+func retryable(err error) bool {
+	var connErr *ConnectionError
+	if errors.As(err, &connErr) {
+		return true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+// withoutURL returns the cause of a *url.Error, as its URL holds the API key of the request
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s request: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServer answers requests with handler and counts them
+func fakeServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, n int32)) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, atomic.AddInt32(&requests, 1))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+func TestClientRetry(t *testing.T) {
+	srv, requests := fakeServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		if n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"websocketport": 443}`))
+	})
+
+	c := New(http.DefaultClient, Options{RetryBackoff: time.Millisecond})
+
+	var v struct {
+		Websocketport int
+	}
+	if err := c.Get(context.Background(), srv.URL, &v); err != nil {
+		t.Fatalf("expected success after retries, got %s", err)
+	}
+	if v.Websocketport != 443 {
+		t.Fatalf("expected decoded response, got %+v", v)
+	}
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+}
+
+func TestClientRetriesExhausted(t *testing.T) {
+	srv, requests := fakeServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("internal error"))
+	})
+
+	c := New(http.DefaultClient, Options{Retries: 1, RetryBackoff: time.Millisecond})
+
+	err := c.Get(context.Background(), srv.URL, nil)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError || statusErr.Body != "internal error" {
+		t.Fatalf("expected status error, got %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+
+	// retries disabled
+	atomic.StoreInt32(requests, 0)
+	c = New(http.DefaultClient, Options{Retries: -1})
+	if err := c.Get(context.Background(), srv.URL, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+}
+
+func TestClientAuthError(t *testing.T) {
+	srv, requests := fakeServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`[{"error": {"type": 1, "address": "/sensors", "description": "unauthorized user"}}]`))
+	})
+
+	c := New(http.DefaultClient, Options{RetryBackoff: time.Millisecond})
+
+	err := c.Get(context.Background(), srv.URL, nil)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || authErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Type != 1 || apiErr.Description != "unauthorized user" {
+		t.Fatalf("expected wrapped API error, got %v", err)
+	}
+	var connErr *ConnectionError
+	if errors.As(err, &connErr) {
+		t.Fatalf("auth error must not be a connection error")
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("expected auth errors not to be retried, got %d requests", n)
+	}
+}
+
+func TestClientAPIError(t *testing.T) {
+	srv, _ := fakeServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`[{"error": {"type": 3, "address": "/sensors/9", "description": "resource, /sensors/9, not available"}}]`))
+	})
+
+	err := New(http.DefaultClient, Options{}).Get(context.Background(), srv.URL, nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Type != 3 {
+		t.Fatalf("expected API error, got %v", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	srv, requests := fakeServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	c := New(http.DefaultClient, Options{Timeout: 20 * time.Millisecond, Retries: 1, RetryBackoff: time.Millisecond})
+
+	err := c.Get(context.Background(), srv.URL, nil)
+	var connErr *ConnectionError
+	if !errors.As(err, &connErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected connection error after timeout, got %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestClientCanceled(t *testing.T) {
+	srv, requests := fakeServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	c := New(http.DefaultClient, Options{RetryBackoff: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := c.Get(ctx, srv.URL, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expected retries to stop when the context is done, took %s", d)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+}
+
+func TestClientNoRetryForPost(t *testing.T) {
+	srv, requests := fakeServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(`{"devicetype": "Deflux"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New(http.DefaultClient, Options{RetryBackoff: time.Millisecond}).Do(req, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+}
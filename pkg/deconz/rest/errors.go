@@ -0,0 +1,62 @@
+package rest
+
+import (
+	"fmt"
+)
+
+// APIError is an error returned by the deCONZ REST API
+// See https://dresden-elektronik.github.io/deconz-rest-doc/errors/
+type APIError struct {
+	Type        int    `json:"type"`
+	Address     string `json:"address"`
+	Description string `json:"description"`
+}
+
+// Error returns the description of the error
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (type %d)", e.Description, e.Type)
+}
+
+// ConnectionError is returned if deCONZ cannot be reached, the request timed out or the response cannot be read
+type ConnectionError struct {
+	Err error
+}
+
+// Error returns the cause of the connection failure
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("unable to reach deCONZ: %s", e.Err)
+}
+
+// Unwrap returns the cause of the connection failure
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// AuthError is returned if deCONZ rejects the API key or the credentials of a request
+// Err is the *APIError returned by deCONZ, e.g. "unauthorized user" or "link button not pressed", or a *StatusError
+// if the response has no error object.
+type AuthError struct {
+	StatusCode int
+	Err        error
+}
+
+// Error returns the status code and the error returned by deCONZ
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("deCONZ denied access (status %d): %s", e.StatusCode, e.Err)
+}
+
+// Unwrap returns the error returned by deCONZ
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned for responses with an unexpected status code that have no error object
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+// Error returns the status code and the body of the response
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code from deCONZ: %d\n%s", e.StatusCode, e.Body)
+}
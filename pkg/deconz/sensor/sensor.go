@@ -1,7 +1,9 @@
 package sensor
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
@@ -11,6 +13,12 @@ import (
 // Sensors is a map of sensors indexed by their id
 type Sensors map[int]Sensor
 
+// ErrNotFound is returned by a Provider if there is no sensor with the requested id
+var ErrNotFound = errors.New("no such sensor")
+
+// lastSeenLayout is the layout of the "lastseen" timestamp
+const lastSeenLayout = "2006-01-02T15:04Z"
+
 // Provider provides information about sensors
 type Provider interface {
 	// Sensors provides info about all known sensors
@@ -20,6 +28,51 @@ type Provider interface {
 	Sensor(int) (*Sensor, error)
 }
 
+// Cache is a Provider that holds sensors in memory
+// Its entries can be modified when the websocket reports changes.
+type Cache interface {
+	Provider
+
+	// Add adds or replaces a sensor
+	Add(Sensor)
+
+	// Remove removes the sensor with the given id
+	Remove(int)
+
+	// Refresh reloads all sensors from their source
+	Refresh() error
+}
+
+// ChangeType is the kind of a Change
+type ChangeType string
+
+const (
+	// ChangeAdded is a sensor that has been added to the cache
+	ChangeAdded ChangeType = "added"
+	// ChangeRemoved is a sensor that has been removed from the cache
+	ChangeRemoved ChangeType = "removed"
+	// ChangeRenamed is a sensor whose name has changed
+	ChangeRenamed ChangeType = "renamed"
+)
+
+// Change is an added, removed or renamed sensor in a Cache
+type Change struct {
+	Type ChangeType
+	// Sensor is the sensor after the change, or the removed sensor
+	Sensor Sensor
+	// OldName is the name of a renamed sensor before the change
+	OldName string
+}
+
+// Notifier is a Cache that notifies subscribers of changes of its sensors
+type Notifier interface {
+	Cache
+
+	// Subscribe returns a channel that receives the changes of the sensors until ctx is done
+	// Changes are dropped if the subscriber does not keep up.
+	Subscribe(ctx context.Context) <-chan Change
+}
+
 // Fielder is an interface that provides fields for InfluxDB
 type Fielder interface {
 	Fields() map[string]interface{}
@@ -36,16 +89,43 @@ type Sensor struct {
 	Type     string    `json:"type"`
 	Name     string    `json:"name"`
 	LastSeen time.Time `json:"lastseen"`
-	StateDef interface{}
-	Config   Config
-	ID       int
+	// LastAnnounced is the time the device last (re)joined the network
+	LastAnnounced time.Time `json:"lastannounced"`
+	Manufacturer  string    `json:"manufacturername"`
+	ModelID       string    `json:"modelid"`
+	SWVersion     string    `json:"swversion"`
+	UniqueID      string    `json:"uniqueid"`
+	StateDef      interface{}
+	Config        Config
+	ID            int
+}
+
+// Attributes are sensor properties sent by the websocket in e = 'changed' events, when they change
+// Attributes that have not changed are nil.
+type Attributes struct {
+	Name          *string `json:"name"`
+	LastSeen      *string `json:"lastseen"`
+	LastAnnounced *string `json:"lastannounced"`
+	Manufacturer  *string `json:"manufacturername"`
+	ModelID       *string `json:"modelid"`
+	SWVersion     *string `json:"swversion"`
 }
 
 // Config represents the sensor configuration as retrieved from the API
-// Currently, it holds only the battery state.
+// Currently, it holds only the battery and reachable state.
 type Config struct {
 	// Battery state in percent; not present for all sensors
 	Battery uint32 `json:"battery"`
+
+	// Reachable is false if the gateway is unable to communicate with the sensor
+	Reachable bool `json:"reachable"`
+}
+
+// ConfigAttributes are parts of the sensor configuration sent by the websocket in e = 'changed' events,
+// when they change. Attributes that have not changed are nil.
+type ConfigAttributes struct {
+	Battery   *uint32 `json:"battery"`
+	Reachable *bool   `json:"reachable"`
 }
 
 // State contains properties that are provided by all sensors
@@ -54,6 +134,11 @@ type State struct {
 	Lastupdated string
 }
 
+// LastUpdater is implemented by sensor states that know the time of their last update
+type LastUpdater interface {
+	LastUpdated() (time.Time, bool)
+}
+
 // EmptyState is an empty struct used to indicate no state was parsed
 type EmptyState struct{}
 
@@ -61,11 +146,17 @@ type EmptyState struct{}
 // The auxiliary approach is inspired by https://github.com/golang/go/issues/21990
 func (s *Sensor) UnmarshalJSON(b []byte) error {
 	var aux struct {
-		Type     string          `json:"type"`
-		Name     string          `json:"name"`
-		LastSeen string          `json:"lastseen"`
-		State    json.RawMessage `json:"state"`
-		Config   Config
+		Type     string `json:"type"`
+		Name     string `json:"name"`
+		LastSeen string `json:"lastseen"`
+		// null for some sensors
+		LastAnnounced *string         `json:"lastannounced"`
+		Manufacturer  string          `json:"manufacturername"`
+		ModelID       string          `json:"modelid"`
+		SWVersion     string          `json:"swversion"`
+		UniqueID      string          `json:"uniqueid"`
+		State         json.RawMessage `json:"state"`
+		Config        Config
 	}
 
 	err := json.Unmarshal(b, &aux)
@@ -74,7 +165,7 @@ func (s *Sensor) UnmarshalJSON(b []byte) error {
 	}
 
 	if aux.LastSeen != "" {
-		t, err := time.Parse("2006-01-02T15:04Z", aux.LastSeen)
+		t, err := time.Parse(lastSeenLayout, aux.LastSeen)
 		if err != nil {
 			return err
 		}
@@ -82,21 +173,76 @@ func (s *Sensor) UnmarshalJSON(b []byte) error {
 		s.LastSeen = t
 	}
 
+	if aux.LastAnnounced != nil && *aux.LastAnnounced != "" {
+		t, err := time.Parse(time.RFC3339, *aux.LastAnnounced)
+		if err != nil {
+			return err
+		}
+
+		s.LastAnnounced = t
+	}
+
 	s.Type = aux.Type
 	s.Name = aux.Name
+	s.Manufacturer = aux.Manufacturer
+	s.ModelID = aux.ModelID
+	s.SWVersion = aux.SWVersion
+	s.UniqueID = aux.UniqueID
 	s.Config = aux.Config
 
 	state, err := DecodeSensorState(aux.State, aux.Type)
 	if err == nil {
 		s.StateDef = state
 	} else {
-		slog.Warn("unable to decode state: %s", err)
+		slog.Warn(fmt.Sprintf("unable to decode state: %s", err))
 		s.StateDef = EmptyState{}
 	}
 
 	return nil
 }
 
+// ApplyAttributes updates the sensor with changed attributes
+func (s *Sensor) ApplyAttributes(a Attributes) error {
+	if a.LastSeen != nil && *a.LastSeen != "" {
+		t, err := time.Parse(lastSeenLayout, *a.LastSeen)
+		if err != nil {
+			return err
+		}
+		s.LastSeen = t
+	}
+	if a.LastAnnounced != nil && *a.LastAnnounced != "" {
+		t, err := time.Parse(time.RFC3339, *a.LastAnnounced)
+		if err != nil {
+			return err
+		}
+		s.LastAnnounced = t
+	}
+	if a.Name != nil {
+		s.Name = *a.Name
+	}
+	if a.Manufacturer != nil {
+		s.Manufacturer = *a.Manufacturer
+	}
+	if a.ModelID != nil {
+		s.ModelID = *a.ModelID
+	}
+	if a.SWVersion != nil {
+		s.SWVersion = *a.SWVersion
+	}
+
+	return nil
+}
+
+// ApplyConfig updates the sensor with changed config attributes
+func (s *Sensor) ApplyConfig(c ConfigAttributes) {
+	if c.Battery != nil {
+		s.Config.Battery = *c.Battery
+	}
+	if c.Reachable != nil {
+		s.Config.Reachable = *c.Reachable
+	}
+}
+
 // Timeseries returns tags and fields for use in InfluxDB
 func (s *Sensor) Timeseries() (map[string]string, map[string]interface{}, error) {
 	f, ok := s.StateDef.(Fielder)
@@ -215,17 +361,28 @@ func DecodeSensorState(rawState json.RawMessage, sensorType string) (interface{}
 	return nil, fmt.Errorf("%s is not a known sensor type", sensorType)
 }
 
+// LastUpdated returns the time of the last update of the state
+// It returns false if the time is not known, e.g. if deCONZ reports "none".
+func (s *State) LastUpdated() (time.Time, bool) {
+	if s.Lastupdated == "" || s.Lastupdated == "none" {
+		return time.Time{}, false
+	}
+
+	// deCONZ reports lastupdated in UTC without zone
+	t, err := time.ParseInLocation("2006-01-02T15:04:05.999", s.Lastupdated, time.UTC)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Failed to unmarshal `lastupdated`: %s", err))
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
 // Fields returns the data age of the state (time.Now() - state.Lastupdated) in seconds
 func (s *State) Fields() map[string]interface{} {
-	if s.Lastupdated != "" {
-		t, err := time.Parse("2006-01-02T15:04:05.999", s.Lastupdated)
-
-		if err != nil {
-			slog.Warn("Failed to unmarshal `lastupdated`: %s", err)
-		} else {
-			return map[string]interface{}{
-				"age_secs": int64(time.Now().Sub(t).Seconds()),
-			}
+	if t, ok := s.LastUpdated(); ok {
+		return map[string]interface{}{
+			"age_secs": int64(time.Now().Sub(t).Seconds()),
 		}
 	}
 
@@ -1,39 +1,59 @@
 package deconz
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/metrics"
 	"log/slog"
+	"sync"
 	"time"
 )
 
+// subscriberBuffer is the number of changes buffered for a subscriber before changes are dropped
+const subscriberBuffer = 64
+
 // CachingSensorProvider is a sensor.Provider that retrieves sensor info from the dCONZ REST API and caches results
-// It is the default sensor.Provider
+// It is the default sensor.Provider. It implements sensor.Notifier, so it can be updated by websocket events and
+// reports added, removed and renamed sensors to its subscribers.
+// The cache is refreshed in the background. Sensor and Sensors never query the REST API, they serve the cached
+// sensors while a refresh is in progress. All methods are safe for concurrent use.
 type CachingSensorProvider struct {
-	api            API
-	cache          *sensor.Sensors
-	nextFetch      time.Time
-	updateInterval time.Duration
+	// ctx is the context of the requests to the REST API and of the background refresh
+	ctx             context.Context
+	api             API
+	refreshInterval time.Duration
+
+	// mu guards cache, updated, touched and subscribers
+	mu    sync.Mutex
+	cache sensor.Sensors
+	// updated is the time the cache has been fetched from the REST API
+	updated time.Time
+	// touched holds the ids of the sensors added, replaced or removed while a refresh is in progress, nil otherwise.
+	// The refresh keeps their cached state, as the REST API may have answered before the change.
+	touched     map[int]struct{}
+	subscribers []chan sensor.Change
+
+	// refreshMu serializes refreshes, so the REST API is not queried by several refreshes at once
+	refreshMu sync.Mutex
 }
 
-var sensorProvider *CachingSensorProvider
-
-// NewCachingSensorProvider returns a CachingSensorProvider
-// The CachingSensorProvider is a singleton.
-func NewCachingSensorProvider(api API, updateInterval time.Duration) (*CachingSensorProvider, error) {
-	if sensorProvider != nil {
-		return sensorProvider, nil
-	}
-
-	sensorProvider = &CachingSensorProvider{api: api, updateInterval: updateInterval}
+// NewCachingSensorProvider returns a CachingSensorProvider for the sensors of the gateway of the given API
+// The cache is filled before it is returned and refreshed every refreshInterval until ctx is done. Zero disables the
+// background refresh. Requests to the REST API, including later refreshes of the cache, are canceled when ctx is
+// done.
+func NewCachingSensorProvider(ctx context.Context, api API, refreshInterval time.Duration) (*CachingSensorProvider, error) {
+	sensorProvider := &CachingSensorProvider{ctx: ctx, api: api, refreshInterval: refreshInterval}
 
-	err := sensorProvider.populateCache()
+	err := sensorProvider.Refresh()
 	if err != nil {
-		sensorProvider = nil
 		return nil, fmt.Errorf("unable to populate sensor cache: %s", err)
 	}
 
+	if refreshInterval > 0 {
+		go sensorProvider.refreshLoop()
+	}
+
 	return sensorProvider, nil
 }
 
@@ -41,41 +61,193 @@ func NewCachingSensorProvider(api API, updateInterval time.Duration) (*CachingSe
 
 // Sensor returns a sensor for a sensor id
 func (c *CachingSensorProvider) Sensor(i int) (*sensor.Sensor, error) {
-	if err := c.populateCache(); err != nil {
-		slog.Error("failed to update sensor cache: %s", err)
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if s, found := (*c.cache)[i]; found {
+	if s, found := c.cache[i]; found {
 		return &s, nil
 	}
 
-	return nil, errors.New("no such sensor")
+	return nil, sensor.ErrNotFound
 }
 
 // Sensors returns all sensors in the cache
 func (c *CachingSensorProvider) Sensors() (*sensor.Sensors, error) {
-	if err := c.populateCache(); err != nil {
-		slog.Error("failed to update sensor cache: %s", err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sensors := make(sensor.Sensors, len(c.cache))
+	for id, s := range c.cache {
+		sensors[id] = s
 	}
 
-	return c.cache, nil
+	return &sensors, nil
+}
+
+// Add adds or replaces a sensor in the cache
+func (c *CachingSensorProvider) Add(s sensor.Sensor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old, found := c.cache[s.ID]
+	c.cache[s.ID] = s
+	c.touch(s.ID)
+	c.notify(change(old, found, s, true))
+}
+
+// Remove removes a sensor from the cache
+func (c *CachingSensorProvider) Remove(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old, found := c.cache[i]
+	delete(c.cache, i)
+	c.touch(i)
+	c.notify(change(old, found, sensor.Sensor{}, false))
+}
+
+// Subscribe returns a channel that receives the added, removed and renamed sensors until ctx is done
+// The channel is closed when ctx is done. Changes are dropped if the subscriber does not keep up.
+func (c *CachingSensorProvider) Subscribe(ctx context.Context) <-chan sensor.Change {
+	ch := make(chan sensor.Change, subscriberBuffer)
+
+	c.mu.Lock()
+	c.subscribers = append(c.subscribers, ch)
+	c.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		for i, sub := range c.subscribers {
+			if sub == ch {
+				c.subscribers = append(c.subscribers[:i], c.subscribers[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+// CacheStatus returns the number of cached sensors and the time they have been fetched from the REST API
+func (c *CachingSensorProvider) CacheStatus() (int, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.cache), c.updated
 }
 
-func (c *CachingSensorProvider) populateCache() error {
+// Refresh reloads all sensors from the REST API
+// The previous sensors are served until the REST API has answered. Sensors changed by Add and Remove in the
+// meantime keep their cached state. Subscribers are notified of the differences.
+func (c *CachingSensorProvider) Refresh() error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
 	now := time.Now()
 
-	if now.Before(c.nextFetch) {
-		return nil
-	}
+	c.mu.Lock()
+	c.touched = map[int]struct{}{}
+	c.mu.Unlock()
 
-	var err error
-	c.cache, err = c.api.Sensors()
+	sensors, err := c.api.Sensors(c.ctx)
+	metrics.CacheRefreshes.WithLabelValues(c.api.Config.NameOrDefault(), "sensors", metrics.Result(err)).Inc()
+
+	c.mu.Lock()
+	touched := c.touched
+	c.touched = nil
 	if err != nil {
+		c.mu.Unlock()
 		return err
 	}
 
-	c.nextFetch = now.Add(c.updateInterval)
-	slog.Info(fmt.Sprintf("Sensor cache updated, found %d sensors", len((*c.cache))))
+	cache := make(sensor.Sensors, len(*sensors))
+	for id, s := range *sensors {
+		if _, ok := touched[id]; ok {
+			continue
+		}
+		old, found := c.cache[id]
+		// the initial fill is no change
+		if c.cache != nil {
+			c.notify(change(old, found, s, true))
+		}
+		cache[id] = s
+	}
+	for id, old := range c.cache {
+		if _, ok := touched[id]; ok {
+			cache[id] = old
+			continue
+		}
+		if _, found := (*sensors)[id]; !found {
+			c.notify(change(old, true, sensor.Sensor{}, false))
+		}
+	}
+	c.cache = cache
+	c.updated = now
+	n := len(c.cache)
+	c.mu.Unlock()
+
+	slog.Debug(fmt.Sprintf("Sensor cache updated, found %d sensors", n))
+
+	return nil
+}
+
+// refreshLoop refreshes the cache every refresh interval until the context is done
+func (c *CachingSensorProvider) refreshLoop() {
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Refresh(); err != nil && c.ctx.Err() == nil {
+				slog.Error(fmt.Sprintf("failed to refresh sensor cache, serving the cached sensors: %s", err))
+			}
+		}
+	}
+}
+
+// touch records that a sensor has been added, replaced or removed while a refresh is in progress
+// It must be called with mu held.
+func (c *CachingSensorProvider) touch(id int) {
+	if c.touched != nil {
+		c.touched[id] = struct{}{}
+	}
+}
+
+// notify sends a change to all subscribers without blocking, if there is a change
+// It must be called with mu held.
+func (c *CachingSensorProvider) notify(ch *sensor.Change) {
+	if ch == nil {
+		return
+	}
+
+	for _, sub := range c.subscribers {
+		select {
+		case sub <- *ch:
+		default:
+			slog.Warn(fmt.Sprintf("Dropped change of sensor %d, subscriber does not keep up", ch.Sensor.ID))
+		}
+	}
+}
+
+// change returns the change from the sensor old, if it was found, to the sensor s, if it exists
+// It returns nil if the sensor has neither been added, removed nor renamed.
+func change(old sensor.Sensor, found bool, s sensor.Sensor, exists bool) *sensor.Change {
+	switch {
+	case !found && exists:
+		return &sensor.Change{Type: sensor.ChangeAdded, Sensor: s}
+	case found && !exists:
+		return &sensor.Change{Type: sensor.ChangeRemoved, Sensor: old}
+	case found && exists && old.Name != s.Name:
+		return &sensor.Change{Type: sensor.ChangeRenamed, Sensor: s, OldName: old.Name}
+	}
 
 	return nil
 }
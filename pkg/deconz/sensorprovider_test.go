@@ -0,0 +1,225 @@
+package deconz
+
+import (
+	"context"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSensorsServer serves the sensors endpoint with the sensors returned by sensors
+// Requests block while block is locked.
+func fakeSensorsServer(t *testing.T, sensors func() map[int]string, block *sync.Mutex) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		block.Lock()
+		defer block.Unlock()
+
+		resp := "{"
+		for id, name := range sensors() {
+			if len(resp) > 1 {
+				resp += ","
+			}
+			resp += fmt.Sprintf(`"%d": {"name": %q, "type": "ZHATemperature", "state": {"temperature": 2000}}`, id, name)
+		}
+		resp += "}"
+
+		_, _ = w.Write([]byte(resp))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// receiveChange returns the next change or fails after a timeout
+func receiveChange(t *testing.T, changes <-chan sensor.Change) sensor.Change {
+	t.Helper()
+
+	select {
+	case c := <-changes:
+		return c
+	case <-time.After(time.Second):
+		t.Fatalf("expected change")
+	}
+	return sensor.Change{}
+}
+
+func TestCachingSensorProviderChanges(t *testing.T) {
+	var mu, block sync.Mutex
+	names := map[int]string{1: "kitchen", 2: "bath"}
+	srv := fakeSensorsServer(t, func() map[int]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return names
+	}, &block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := NewCachingSensorProvider(ctx, API{Config: config.APIConfig{Addr: srv.URL}}, 0)
+	if err != nil {
+		t.Fatalf("failed to create provider: %s", err)
+	}
+	changes := p.Subscribe(ctx)
+
+	mu.Lock()
+	names = map[int]string{1: "kitchen", 2: "bathroom", 3: "garden"}
+	mu.Unlock()
+
+	// the cached sensors are served while the REST API is queried
+	block.Lock()
+	refreshed := make(chan error)
+	go func() {
+		refreshed <- p.Refresh()
+	}()
+	if s, err := p.Sensor(2); err != nil || s.Name != "bath" {
+		t.Fatalf("expected cached sensor during refresh, got %v, %v", s, err)
+	}
+	block.Unlock()
+	if err := <-refreshed; err != nil {
+		t.Fatalf("failed to refresh: %s", err)
+	}
+
+	got := map[sensor.ChangeType]sensor.Change{}
+	for i := 0; i < 2; i++ {
+		c := receiveChange(t, changes)
+		got[c.Type] = c
+	}
+	if c := got[sensor.ChangeAdded]; c.Sensor.ID != 3 || c.Sensor.Name != "garden" {
+		t.Errorf("expected sensor 3 added, got %+v", c)
+	}
+	if c := got[sensor.ChangeRenamed]; c.Sensor.ID != 2 || c.Sensor.Name != "bathroom" || c.OldName != "bath" {
+		t.Errorf("expected sensor 2 renamed, got %+v", c)
+	}
+
+	p.Remove(1)
+	if c := receiveChange(t, changes); c.Type != sensor.ChangeRemoved || c.Sensor.ID != 1 || c.Sensor.Name != "kitchen" {
+		t.Errorf("expected sensor 1 removed, got %+v", c)
+	}
+
+	// unchanged names are no change
+	s, _ := p.Sensor(3)
+	p.Add(*s)
+	p.Add(sensor.Sensor{ID: 4, Name: "attic"})
+	if c := receiveChange(t, changes); c.Type != sensor.ChangeAdded || c.Sensor.ID != 4 {
+		t.Errorf("expected sensor 4 added, got %+v", c)
+	}
+
+	cancel()
+	for range changes {
+	}
+}
+
+func TestCachingSensorProviderChangedDuringRefresh(t *testing.T) {
+	var block sync.Mutex
+	srv := fakeSensorsServer(t, func() map[int]string {
+		return map[int]string{1: "kitchen", 2: "bath"}
+	}, &block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := NewCachingSensorProvider(ctx, API{Config: config.APIConfig{Addr: srv.URL}}, 0)
+	if err != nil {
+		t.Fatalf("failed to create provider: %s", err)
+	}
+	changes := p.Subscribe(ctx)
+
+	block.Lock()
+	refreshed := make(chan error)
+	go func() {
+		refreshed <- p.Refresh()
+	}()
+	for refreshing := false; !refreshing; {
+		p.mu.Lock()
+		refreshing = p.touched != nil
+		p.mu.Unlock()
+	}
+
+	// the REST API answers with the sensors before these websocket events
+	p.Add(sensor.Sensor{ID: 3, Name: "garden"})
+	p.Add(sensor.Sensor{ID: 1, Name: "kitchen", Type: "ZHATemperature", Manufacturer: "websocket"})
+	p.Remove(2)
+	for _, want := range []sensor.ChangeType{sensor.ChangeAdded, sensor.ChangeRemoved} {
+		if c := receiveChange(t, changes); c.Type != want {
+			t.Fatalf("expected change %v, got %+v", want, c)
+		}
+	}
+
+	block.Unlock()
+	if err := <-refreshed; err != nil {
+		t.Fatalf("failed to refresh: %s", err)
+	}
+
+	select {
+	case c := <-changes:
+		t.Errorf("expected no change by the refresh, got %+v", c)
+	default:
+	}
+
+	if s, err := p.Sensor(3); err != nil || s.Name != "garden" {
+		t.Errorf("expected sensor 3 added during the refresh, got %v, %v", s, err)
+	}
+	if s, err := p.Sensor(1); err != nil || s.Manufacturer != "websocket" {
+		t.Errorf("expected sensor 1 updated during the refresh, got %v, %v", s, err)
+	}
+	if _, err := p.Sensor(2); err == nil {
+		t.Errorf("expected sensor 2 removed during the refresh")
+	}
+}
+
+func TestCachingSensorProviderBackgroundRefresh(t *testing.T) {
+	var mu, block sync.Mutex
+	names := map[int]string{1: "kitchen"}
+	srv := fakeSensorsServer(t, func() map[int]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return names
+	}, &block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := NewCachingSensorProvider(ctx, API{Config: config.APIConfig{Addr: srv.URL}}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to create provider: %s", err)
+	}
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	changes := p.Subscribe(subCtx)
+
+	mu.Lock()
+	names = map[int]string{1: "kitchen", 2: "bath"}
+	mu.Unlock()
+
+	if c := receiveChange(t, changes); c.Type != sensor.ChangeAdded || c.Sensor.ID != 2 {
+		t.Fatalf("expected sensor 2 added, got %+v", c)
+	}
+
+	unsubscribe()
+	for range changes {
+	}
+
+	// concurrent readers and websocket updates while the cache is refreshed
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, _ = p.Sensor(1)
+				_, _ = p.Sensors()
+				p.Add(sensor.Sensor{ID: 10 + i, Name: "new"})
+				p.Remove(10 + i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n, updated := p.CacheStatus(); n != 2 || updated.IsZero() {
+		t.Errorf("expected 2 cached sensors, got %d updated at %s", n, updated)
+	}
+}
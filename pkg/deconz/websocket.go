@@ -1,49 +1,128 @@
 package deconz
 
 import (
-	ctx "context"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/rvk01/deflux/pkg/deconz/sensor"
 	"github.com/gorilla/websocket"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz/group"
+	"github.com/rvk01/deflux/pkg/deconz/light"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/metrics"
 	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
 	"time"
 )
 
-// WebsocketEventReader uses an EventReader (for example WsReader) to provide a channel of SensorEvent
+// WebsocketEventReader uses an EventReader (for example WsReader) to provide a channel of SensorEvent, LightEvent,
+// GroupEvent and SceneEvent
 // The WebsocketEventReader handles connection losses and reconnection attempts of the underlying EventReader
 type WebsocketEventReader struct {
 	WebsocketAddr  string
 	SensorProvider sensor.Provider
 
+	// LightProvider is optional. If it is set, light events are decoded as well.
+	LightProvider light.Provider
+
+	// GroupProvider is optional. If it is set, group and scene events are decoded as well.
+	GroupProvider group.Provider
+
+	// Config holds the reconnect and liveness settings. Durations that are not set use the defaults.
+	Config config.WebsocketConfig
+
+	// OnMessage is optional. It is called with every message received from the websocket before it is decoded,
+	// e.g. to record the messages.
+	OnMessage func(message []byte)
+
 	conn    *websocket.Conn
-	connCtx ctx.Context
+	connCtx context.Context
 	running bool
+
+	// lastMessage is the time the last message has been received or the connection has been established.
+	// connDone is closed when the connection is dropped, which stops sending pings.
+	lastMessage time.Time
+	connDone    chan struct{}
+
+	// gateway is the name of the gateway used in the metrics, connects counts the successful connections
+	gateway  string
+	connects int
+
+	// reconnected is set by a reconnect until it has been forwarded by the event loop
+	reconnected *ReconnectEvent
+
+	// dialer connects to the websocket with the TLS settings of the gateway
+	dialer *websocket.Dialer
+
+	// statusMu guards status, which is read by other go routines
+	statusMu sync.Mutex
+	status   WebsocketStatus
+}
+
+// WebsocketStatus is the connection state of a WebsocketEventReader
+type WebsocketStatus struct {
+	Connected bool
+	// Since is the time the websocket has been connected or disconnected, or the reader has been created
+	Since time.Time
+	// LastEvent is the time the last message has been received, zero if there was none
+	LastEvent time.Time
 }
 
 // NewWebsocketEventReader creates a new WebsocketEventReader that continuously reads events from the deCONZ websocket
 // It uses the API to discover the websocket address
 // The structure of the JSON messages from the websocket depend on the resource/sensor type. Thus,
 // the WsReader requires a sensor.Provider to properly unmarshal those messages.
-func NewWebsocketEventReader(api API, si sensor.Provider) (*WebsocketEventReader, error) {
+func NewWebsocketEventReader(ctx context.Context, api API, si sensor.Provider) (*WebsocketEventReader, error) {
 	if api.Config.WsAddr == "" {
-		err := api.Config.DiscoverWebsocket()
+		err := api.Config.DiscoverWebsocket(ctx)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	dialer, err := newDialer(api.Config.TLS)
+	if err != nil {
+		return nil, err
+	}
+
 	return &WebsocketEventReader{
 		WebsocketAddr:  api.Config.WsAddr,
 		SensorProvider: si,
+		gateway:        api.Config.NameOrDefault(),
+		dialer:         dialer,
+		status:         WebsocketStatus{Since: time.Now()},
 	}, nil
 }
 
+// Status returns the connection state of the reader
+func (r *WebsocketEventReader) Status() WebsocketStatus {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	return r.status
+}
+
+// setConnected records a change of the connection state
+func (r *WebsocketEventReader) setConnected(connected bool) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	if r.status.Connected != connected || r.status.Since.IsZero() {
+		r.status.Connected = connected
+		r.status.Since = time.Now()
+	}
+}
+
 // Start starts a go routine that reads events from the associated EventReader
-// It returns the channel to retrieve events from
-func (r *WebsocketEventReader) Start(ctx ctx.Context) (<-chan *SensorEvent, error) {
+// It returns the channel to retrieve events from. The channel provides events of type *SensorEvent, *LightEvent,
+// *GroupEvent and *SceneEvent. If the SensorProvider is a sensor.Cache, it provides *SensorUpdateEvent as well.
+// After each reconnect, a *ReconnectEvent is provided before the first event of the new connection.
+func (r *WebsocketEventReader) Start(ctx context.Context) (<-chan Event, error) {
 
-	out := make(chan *SensorEvent)
+	out := make(chan Event)
 
 	if r.running {
 		return nil, errors.New("WebsocketEventReader is already running")
@@ -61,11 +140,25 @@ func (r *WebsocketEventReader) Start(ctx ctx.Context) (<-chan *SensorEvent, erro
 				return
 
 			default:
+				// connect before reading, so a reconnect is reported before the next message arrives
+				if r.conn == nil {
+					r.connect()
+					if r.reconnected != nil {
+						select {
+						case out <- r.reconnected:
+						case <-r.connCtx.Done():
+						}
+						r.reconnected = nil
+					}
+					continue
+				}
+
 				// read events until connection fails
 				e, err := r.readEvent()
 				if err != nil {
 					if err, ok := err.(EventError); ok && err.Recoverable() {
-						slog.Error("Dropping event due to error: %s", err.error)
+						metrics.EventsDropped.WithLabelValues(r.gateway, metrics.ReasonDecodeError, "").Inc()
+						slog.Error(fmt.Sprintf("Dropping event due to error: %s", err.error))
 						continue
 					}
 				}
@@ -75,15 +168,32 @@ func (r *WebsocketEventReader) Start(ctx ctx.Context) (<-chan *SensorEvent, erro
 					continue
 				}
 
-				// we only care about sensor events
-				se, ok := e.(SensorEvent)
-				if !ok {
-					slog.Debug(fmt.Sprintf("Dropping non-sensor event type %s", e.Resource()))
+				// we only care about sensor, light, group and scene events
+				var fwd Event
+				eventType := e.Resource()
+				switch ev := e.(type) {
+				case SensorEvent:
+					fwd, eventType = &ev, ev.Sensor.Type
+				case SensorUpdateEvent:
+					fwd, eventType = &ev, ev.Sensor.Type
+				case LightEvent:
+					fwd = &ev
+				case GroupEvent:
+					fwd = &ev
+				case SceneEvent:
+					fwd = &ev
+				default:
+					metrics.EventsDropped.WithLabelValues(r.gateway, metrics.ReasonUnsupported, eventType).Inc()
+					slog.Debug(fmt.Sprintf("Dropping event type %s of resource %s", e.EventName(), e.Resource()))
 					continue
 				}
+				metrics.EventsDecoded.WithLabelValues(r.gateway, e.Resource(), eventType).Inc()
 
-				// send event on channel
-				out <- &se
+				// the consumer may have stopped, e.g. when the gateway is restarted on reload
+				select {
+				case out <- fwd:
+				case <-r.connCtx.Done():
+				}
 			}
 		}
 
@@ -93,66 +203,267 @@ func (r *WebsocketEventReader) Start(ctx ctx.Context) (<-chan *SensorEvent, erro
 }
 
 // connect connects the EventReader
-// If the connection fails, it retries every 10s as long as the given Context is not Done()
+// If the connection fails, it retries with exponential backoff as long as the given Context is not Done()
 func (r *WebsocketEventReader) connect() {
+	if r.SensorProvider == nil {
+		panic("cannot dial without a sensor.Provider")
+	}
 
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-	for ; ; <-ticker.C {
+	cfg := r.Config.WithDefaults()
+	for attempt := 0; r.conn == nil; attempt++ {
+		if r.connCtx.Err() != nil {
+			slog.Debug("Aborting websocket connection")
+			return
+		}
+
+		conn, _, err := r.dialer.DialContext(r.connCtx, r.WebsocketAddr, nil)
+		if err == nil {
+			r.connected(conn, cfg)
+			return
+		}
+		if r.connCtx.Err() != nil {
+			slog.Debug("Aborting websocket connection")
+			return
+		}
+
+		metrics.WebsocketConnectErrors.WithLabelValues(r.gateway).Inc()
+		delay := backoff(attempt, cfg.BackoffMin, cfg.BackoffMax)
+		slog.Error(fmt.Sprintf("Error connecting deCONZ websocket: %s\nAttempting reconnect in %s...", err,
+			delay.Truncate(time.Millisecond)))
+
+		timer := time.NewTimer(delay)
 		select {
+		case <-timer.C:
 		case <-r.connCtx.Done():
-			slog.Debug("Aborting websocket connection")
-		default:
+			timer.Stop()
+		}
+	}
+}
 
-			if r.SensorProvider == nil {
-				panic("cannot dial without a sensor.Provider")
-			}
+// connected sets up a new connection: it logs the downtime of a reconnect, starts sending pings and sets the read
+// deadline
+func (r *WebsocketEventReader) connected(conn *websocket.Conn, cfg config.WebsocketConfig) {
+	now := time.Now()
+
+	r.connects++
+	if r.connects > 1 {
+		// the connection may have been lost up to a ping or watchdog timeout before the read failed
+		disconnected := r.lastMessage
+		r.reconnected = &ReconnectEvent{Disconnected: disconnected}
+
+		metrics.WebsocketReconnects.WithLabelValues(r.gateway).Inc()
+		slog.Info(fmt.Sprintf("deCONZ websocket of gateway %s reconnected after %s", r.gateway,
+			now.Sub(disconnected).Truncate(time.Millisecond)))
+	} else {
+		slog.Info("deCONZ websocket connected")
+	}
+	r.setConnected(true)
 
-			if r.conn != nil {
-				return
-			}
+	r.conn = conn
+	r.lastMessage = now
+	r.connDone = make(chan struct{})
 
-			// connect
-			var err error
-			r.conn, _, err = websocket.DefaultDialer.DialContext(r.connCtx, r.WebsocketAddr, nil)
+	conn.SetPongHandler(func(string) error {
+		r.extendDeadline(conn, cfg, time.Now())
+		return nil
+	})
+	r.extendDeadline(conn, cfg, now)
 
-			if err != nil {
-				slog.Error("Error connecting deCONZ websocket: %s\nAttempting reconnect in 10s...", err)
-			} else {
-				slog.Info("deCONZ websocket connected")
+	go r.ping(conn, cfg, r.connDone)
+}
+
+// disconnect closes the connection after a read error
+func (r *WebsocketEventReader) disconnect() {
+	close(r.connDone)
+	_ = r.conn.Close()
+	r.conn = nil
+	r.setConnected(false)
+}
+
+// extendDeadline sets the read deadline of the connection after a message or pong has been received at t
+// The deadline is a ping interval plus pong timeout later, or earlier if the watchdog expires before.
+func (r *WebsocketEventReader) extendDeadline(conn *websocket.Conn, cfg config.WebsocketConfig, t time.Time) {
+	deadline := t.Add(cfg.PingInterval + cfg.PongTimeout)
+	if cfg.WatchdogTimeout > 0 {
+		if watchdog := r.lastMessage.Add(cfg.WatchdogTimeout); watchdog.Before(deadline) {
+			deadline = watchdog
+		}
+	}
+
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		slog.Debug(fmt.Sprintf("Failed to set websocket read deadline: %s", err))
+	}
+}
+
+// ping sends ping frames every ping interval until done is closed or the context is done
+func (r *WebsocketEventReader) ping(conn *websocket.Conn, cfg config.WebsocketConfig, done <-chan struct{}) {
+	ticker := time.NewTicker(cfg.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(cfg.PongTimeout)); err != nil {
+				slog.Debug(fmt.Sprintf("Failed to send websocket ping: %s", err))
 				return
 			}
+		case <-done:
+			return
+		case <-r.connCtx.Done():
+			return
 		}
 	}
 }
 
+// backoff returns the delay before the next connection attempt after attempt failed attempts
+// The delay doubles with every attempt, starting at min and limited to max. A random jitter of up to half the delay
+// is subtracted, so gateways that went down together don't reconnect at the same time.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	half := int64(d / 2)
+	return d - time.Duration(rand.Int63n(half+1))
+}
+
 // readEvent reads, parses and returns the next event from the websocket
 func (r *WebsocketEventReader) readEvent() (Event, error) {
 
 	if r.conn == nil {
 		r.connect()
+		if r.conn == nil {
+			return nil, fmt.Errorf("event read error: %s", r.connCtx.Err())
+		}
 	}
 
 	_, message, err := r.conn.ReadMessage()
 	if err != nil {
-		r.conn = nil
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if silence := time.Since(r.lastMessage); r.Config.WatchdogTimeout > 0 && silence >= r.Config.WatchdogTimeout {
+				slog.Warn(fmt.Sprintf("No message from deCONZ websocket of gateway %s for %s, reconnecting", r.gateway,
+					silence.Truncate(time.Millisecond)))
+			} else {
+				slog.Warn(fmt.Sprintf("deCONZ websocket of gateway %s did not answer ping, reconnecting", r.gateway))
+			}
+		}
+		r.disconnect()
 
 		return nil, fmt.Errorf("event read error: %s", err)
 	}
 
+	r.lastMessage = time.Now()
+	r.extendDeadline(r.conn, r.Config.WithDefaults(), r.lastMessage)
+
+	r.statusMu.Lock()
+	r.status.LastEvent = time.Now()
+	r.statusMu.Unlock()
+	metrics.EventsReceived.WithLabelValues(r.gateway).Inc()
+
 	slog.Debug(fmt.Sprintf("recv: %s", message))
+	if r.OnMessage != nil {
+		r.OnMessage(message)
+	}
+
+	var updated *sensor.Sensor
+	if cache, ok := r.SensorProvider.(sensor.Cache); ok {
+		updated = r.updateSensorCache(cache, message)
+	}
+
+	d := Decoder{Sensors: r.SensorProvider, Lights: r.LightProvider, Groups: r.GroupProvider}
+	e, err := d.Decode(message)
+
+	// a sensor we don't know yet, e.g. because it has just been paired
+	if cache, ok := r.SensorProvider.(sensor.Cache); ok && errors.Is(err, sensor.ErrNotFound) {
+		slog.Info("Received event of unknown sensor, refreshing sensor cache")
+		if err := cache.Refresh(); err != nil {
+			slog.Error(fmt.Sprintf("failed to refresh sensor cache: %s", err))
+		}
+		e, err = d.Decode(message)
+	}
 
-	e, err := DecodeEvent(r.SensorProvider, message)
 	if err != nil {
 		return nil, NewEventError(fmt.Errorf("unable to parse message: %s", err), true)
 	}
 
+	if updated != nil {
+		return SensorUpdateEvent{Sensor: updated, Event: e}, nil
+	}
+
 	return e, nil
 }
 
+// updateSensorCache keeps the sensor cache up to date when sensors are added, deleted or their attributes or config
+// change. It returns the updated sensor if attributes or config of a known sensor have changed, nil otherwise.
+func (r *WebsocketEventReader) updateSensorCache(cache sensor.Cache, message []byte) *sensor.Sensor {
+	var e WsEvent
+	if err := json.Unmarshal(message, &e); err != nil || e.Resource() != "sensors" {
+		return nil
+	}
+
+	switch e.EventName() {
+	case "added":
+		var s sensor.Sensor
+		if err := json.Unmarshal(e.RawSensor, &s); err != nil {
+			slog.Error(fmt.Sprintf("unable to decode added sensor %d: %s", e.ID, err))
+			return nil
+		}
+		s.ID = e.ID
+		cache.Add(s)
+
+	case "deleted":
+		cache.Remove(e.ID)
+
+	case "changed":
+		if len(e.RawAttr) == 0 && len(e.RawConfig) == 0 {
+			return nil
+		}
+
+		var attr sensor.Attributes
+		if len(e.RawAttr) > 0 {
+			if err := json.Unmarshal(e.RawAttr, &attr); err != nil {
+				slog.Error(fmt.Sprintf("unable to decode attributes of sensor %d: %s", e.ID, err))
+				return nil
+			}
+		}
+
+		var conf sensor.ConfigAttributes
+		if len(e.RawConfig) > 0 {
+			if err := json.Unmarshal(e.RawConfig, &conf); err != nil {
+				slog.Error(fmt.Sprintf("unable to decode config of sensor %d: %s", e.ID, err))
+				return nil
+			}
+		}
+
+		s, err := cache.Sensor(e.ID)
+		if err != nil {
+			slog.Info(fmt.Sprintf("Attributes of unknown sensor %d changed, refreshing sensor cache", e.ID))
+			if err := cache.Refresh(); err != nil {
+				slog.Error(fmt.Sprintf("failed to refresh sensor cache: %s", err))
+			}
+			return nil
+		}
+		if err := s.ApplyAttributes(attr); err != nil {
+			slog.Error(fmt.Sprintf("unable to apply attributes of sensor %d: %s", e.ID, err))
+			return nil
+		}
+		s.ApplyConfig(conf)
+		cache.Add(*s)
+
+		return s
+	}
+
+	return nil
+}
+
 // Shutdown closes the reader, closing the connection to deCONZ
 // The method blocks until all background tasks are terminated or the given Context is aborted
-func (r *WebsocketEventReader) Shutdown(ctx ctx.Context) {
+func (r *WebsocketEventReader) Shutdown(ctx context.Context) {
 	r.running = false
 	done := make(chan interface{}, 1)
 
@@ -161,7 +472,7 @@ func (r *WebsocketEventReader) Shutdown(ctx ctx.Context) {
 		if r.conn != nil {
 			err := r.conn.Close()
 			if err != nil {
-				slog.Error("Failed to close websocket", err)
+				slog.Error(fmt.Sprintf("Failed to close websocket: %s", err))
 				return
 			}
 			slog.Info("deCONZ websocket closed")
@@ -178,3 +489,33 @@ func (r *WebsocketEventReader) Shutdown(ctx ctx.Context) {
 		return
 	}
 }
+
+// CheckWebsocket connects to the deCONZ websocket of the gateway and closes the connection again
+func CheckWebsocket(ctx context.Context, gw config.APIConfig) error {
+	dialer, err := newDialer(gw.TLS)
+	if err != nil {
+		return err
+	}
+
+	conn, _, err := dialer.DialContext(ctx, gw.WsAddr, nil)
+	if err != nil {
+		return fmt.Errorf("unable to connect websocket: %s", err)
+	}
+
+	return conn.Close()
+}
+
+// newDialer returns a websocket dialer with the TLS settings
+func newDialer(t config.TLSConfig) (*websocket.Dialer, error) {
+	tlsConfig, err := t.Config()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %s", err)
+	}
+	if tlsConfig == nil {
+		return websocket.DefaultDialer, nil
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	return &dialer, nil
+}
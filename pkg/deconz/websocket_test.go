@@ -0,0 +1,272 @@
+package deconz
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSensorCache struct {
+	TestSensorProvider
+	refreshed int
+}
+
+func (c *testSensorCache) Add(s sensor.Sensor) {
+	(*c.Store)[s.ID] = s
+}
+
+func (c *testSensorCache) Remove(i int) {
+	delete(*c.Store, i)
+}
+
+func (c *testSensorCache) Refresh() error {
+	c.refreshed++
+	return nil
+}
+
+func TestUpdateSensorCache(t *testing.T) {
+	cache := &testSensorCache{TestSensorProvider: TestSensorProvider{Store: &sensor.Sensors{
+		1: sensor.Sensor{Type: "ZHATemperature", Name: "old name", ID: 1},
+		2: sensor.Sensor{Type: "ZHAHumidity", Name: "to be deleted", ID: 2},
+	}}}
+	r := &WebsocketEventReader{SensorProvider: cache}
+
+	messages := []string{
+		`{
+			"attr": {
+				"id": "1",
+				"lastannounced": null,
+				"lastseen": "2022-01-09T17:58Z",
+				"manufacturername": "LUMI",
+				"modelid": "lumi.weather",
+				"name": "th-sz",
+				"swversion": "20191205",
+				"type": "ZHATemperature",
+				"uniqueid": "00:15:8d:12:34:bd:ff:71-01-0402"
+			},
+			"e": "changed",
+			"id": "1",
+			"r": "sensors",
+			"t": "event",
+			"uniqueid": "00:15:8d:12:34:bd:ff:71-01-0402"
+		}`,
+		`{"e": "deleted", "id": "2", "r": "sensors", "t": "event"}`,
+		`{
+			"e": "added",
+			"id": "3",
+			"r": "sensors",
+			"sensor": {
+				"config": {"battery": 100, "on": true, "reachable": true},
+				"lastseen": "2022-01-10T08:00Z",
+				"manufacturername": "LUMI",
+				"modelid": "lumi.sensor_wleak.aq1",
+				"name": "flood",
+				"state": {"lastupdated": "none", "water": false},
+				"type": "ZHAWater",
+				"uniqueid": "00:15:8d:00:01:02:03:04-01-0500"
+			},
+			"t": "event"
+		}`,
+		`{"attr": {"name": "unknown"}, "e": "changed", "id": "9", "r": "sensors", "t": "event"}`,
+		`{"config": {"battery": 42, "reachable": false}, "e": "changed", "id": "3", "r": "sensors", "t": "event"}`,
+	}
+
+	for _, m := range messages {
+		r.updateSensorCache(cache, []byte(m))
+	}
+
+	s1 := (*cache.Store)[1]
+	lastSeen := time.Date(2022, 1, 9, 17, 58, 0, 0, time.UTC)
+	if s1.Name != "th-sz" || !s1.LastSeen.Equal(lastSeen) || s1.Manufacturer != "LUMI" ||
+		s1.ModelID != "lumi.weather" || s1.SWVersion != "20191205" || s1.Type != "ZHATemperature" {
+		t.Fatalf("attributes not applied: %+v", s1)
+	}
+
+	if _, ok := (*cache.Store)[2]; ok {
+		t.Fatalf("sensor 2 not deleted")
+	}
+
+	s3, ok := (*cache.Store)[3]
+	if !ok || s3.ID != 3 || s3.Name != "flood" || s3.Type != "ZHAWater" || s3.Config.Battery != 42 {
+		t.Fatalf("sensor 3 not added: %+v", s3)
+	}
+
+	if updated := r.updateSensorCache(cache, []byte(messages[4])); updated == nil || updated.ID != 3 {
+		t.Fatalf("expected updated sensor 3, got %+v", updated)
+	}
+
+	s3 = (*cache.Store)[3]
+	if s3.Config.Battery != 42 || s3.Config.Reachable {
+		t.Fatalf("config not applied: %+v", s3.Config)
+	}
+
+	if cache.refreshed != 1 {
+		t.Fatalf("expected 1 refresh for the unknown sensor, got %d", cache.refreshed)
+	}
+}
+
+func TestWebsocketStatus(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"e": "changed", "id": "1", "r": "lights", "t": "event"}`))
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	api := API{Config: config.APIConfig{WsAddr: "ws" + strings.TrimPrefix(ts.URL, "http")}}
+	r, err := NewWebsocketEventReader(context.Background(), api, TestSensorProvider{Store: &sensor.Sensors{}})
+	if err != nil {
+		t.Fatalf("failed to create reader: %s", err)
+	}
+	r.connCtx = context.Background()
+
+	created := r.Status()
+	if created.Connected || created.Since.IsZero() || !created.LastEvent.IsZero() {
+		t.Fatalf("unexpected initial status %+v", created)
+	}
+
+	// the light event is dropped without a light provider, but the connection is established
+	_, _ = r.readEvent()
+	connected := r.Status()
+	if !connected.Connected || connected.LastEvent.IsZero() || connected.Since.Before(created.Since) {
+		t.Fatalf("expected connected status, got %+v", connected)
+	}
+
+	// the server has closed the connection
+	if _, err := r.readEvent(); err == nil {
+		t.Fatalf("expected read error")
+	}
+	if disconnected := r.Status(); disconnected.Connected || disconnected.LastEvent != connected.LastEvent {
+		t.Fatalf("expected disconnected status, got %+v", disconnected)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		for i := 0; i < 20; i++ {
+			d := backoff(attempt, time.Second, 10*time.Second)
+			if d > want || d < want/2 {
+				t.Fatalf("attempt %d: expected delay between %s and %s, got %s", attempt, want/2, want, d)
+			}
+		}
+	}
+
+	// a large number of attempts does not overflow
+	if d := backoff(100, time.Second, time.Minute); d < 30*time.Second || d > time.Minute {
+		t.Errorf("expected delay up to 1m, got %s", d)
+	}
+}
+
+func TestWebsocketLiveness(t *testing.T) {
+	tests := []struct {
+		name string
+		// answer makes the server read from the connection, which answers pings
+		answer bool
+		cfg    config.WebsocketConfig
+	}{
+		{
+			name: "missing pong",
+			cfg:  config.WebsocketConfig{PingInterval: 50 * time.Millisecond, PongTimeout: 50 * time.Millisecond},
+		},
+		{
+			name:   "watchdog",
+			answer: true,
+			cfg: config.WebsocketConfig{PingInterval: 50 * time.Millisecond, PongTimeout: 50 * time.Millisecond,
+				WatchdogTimeout: 300 * time.Millisecond},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			upgrader := websocket.Upgrader{}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"e": "changed", "id": "1", "r": "lights", "t": "event"}`))
+				if tt.answer {
+					for {
+						if _, _, err := conn.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}
+				<-r.Context().Done()
+			}))
+			defer ts.Close()
+
+			api := API{Config: config.APIConfig{WsAddr: "ws" + strings.TrimPrefix(ts.URL, "http")}}
+			r, err := NewWebsocketEventReader(context.Background(), api, TestSensorProvider{Store: &sensor.Sensors{}})
+			if err != nil {
+				t.Fatalf("failed to create reader: %s", err)
+			}
+			r.Config = tt.cfg
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r.connCtx = ctx
+
+			_, _ = r.readEvent()
+			start := time.Now()
+			if _, err := r.readEvent(); err == nil {
+				t.Fatalf("expected read error")
+			}
+
+			// pongs keep the connection alive until the watchdog expires
+			if elapsed := time.Since(start); tt.answer && elapsed < 200*time.Millisecond {
+				t.Errorf("expected the connection to be kept until the watchdog expires, closed after %s", elapsed)
+			}
+			if r.Status().Connected {
+				t.Errorf("expected disconnected status")
+			}
+		})
+	}
+}
+
+func TestWebsocketReconnectEvent(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	api := API{Config: config.APIConfig{WsAddr: "ws" + strings.TrimPrefix(ts.URL, "http")}}
+	r, err := NewWebsocketEventReader(context.Background(), api, TestSensorProvider{Store: &sensor.Sensors{}})
+	if err != nil {
+		t.Fatalf("failed to create reader: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := r.Start(ctx)
+	if err != nil {
+		t.Fatalf("failed to start reader: %s", err)
+	}
+
+	select {
+	case e := <-events:
+		reconnect, ok := e.(*ReconnectEvent)
+		if !ok || reconnect.Disconnected.IsZero() {
+			t.Errorf("expected reconnect event, got %#v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected reconnect event")
+	}
+}
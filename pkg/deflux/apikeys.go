@@ -0,0 +1,225 @@
+package deflux
+
+import (
+	"context"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// APIKeysList lists the API keys of the gateways
+	APIKeysList = "list"
+	// APIKeysVerify verifies the configured API keys
+	APIKeysVerify = "verify"
+	// APIKeysRevoke revokes API keys
+	APIKeysRevoke = "revoke"
+	// APIKeysPrune revokes unused API keys created by deflux
+	APIKeysPrune = "prune"
+)
+
+// APIKeysOptions holds the options of RunAPIKeys
+type APIKeysOptions struct {
+	// Command is one of APIKeysList, APIKeysVerify, APIKeysRevoke or APIKeysPrune
+	Command string
+
+	// Gateway restricts the command to the gateway with that name. Revoke and prune require it if several
+	// gateways are configured.
+	Gateway string
+
+	// Keys are the keys to revoke
+	Keys []string
+
+	// Unused is the duration after which an unused key created by deflux is pruned
+	Unused time.Duration
+
+	// DryRun set true only prints the keys that would be pruned
+	DryRun bool
+}
+
+// RunAPIKeys manages the API keys of the configured gateways and returns the program's exit code
+func RunAPIKeys(cfg *config.Configuration, opts APIKeysOptions) int {
+	gateways, err := cfg.GatewayConfigs()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid gateway configuration: %s", err))
+		return ExitFailConfig
+	}
+
+	var selected []config.APIConfig
+	for _, gw := range gateways {
+		if opts.Gateway == "" || gw.NameOrDefault() == opts.Gateway {
+			selected = append(selected, gw)
+		}
+	}
+	if len(selected) == 0 {
+		slog.Error(fmt.Sprintf("Gateway %s not found", opts.Gateway))
+		return ExitFailConfig
+	}
+
+	// pending requests are canceled on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	switch opts.Command {
+	case APIKeysList:
+		return listAPIKeys(ctx, selected)
+	case APIKeysVerify:
+		return verifyAPIKeys(ctx, selected)
+	}
+
+	if len(selected) > 1 {
+		slog.Error("Several gateways are configured, select one with -gateway")
+		return ExitFailConfig
+	}
+	gw := selected[0]
+
+	switch opts.Command {
+	case APIKeysRevoke:
+		return revokeAPIKeys(ctx, gw, opts.Keys)
+	case APIKeysPrune:
+		return pruneAPIKeys(ctx, gw, opts.Unused, opts.DryRun, time.Now())
+	}
+
+	slog.Error(fmt.Sprintf("Unknown command %q", opts.Command))
+	return ExitFailConfig
+}
+
+// listAPIKeys prints the whitelists of the gateways
+func listAPIKeys(ctx context.Context, gateways []config.APIConfig) int {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GATEWAY\tKEY\tNAME\tCREATED\tLAST USED\tDEFLUX\tCONFIGURED")
+
+	code := ExitOK
+	for _, gw := range gateways {
+		entries, err := gw.Whitelist(ctx)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Gateway %s: %s", gw.NameOrDefault(), err))
+			code = ExitFailConnect
+			continue
+		}
+
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", gw.NameOrDefault(), e.Key, e.Name, formatDate(e.CreateDate),
+				formatDate(e.LastUseDate), yesNo(e.IsDeflux()), yesNo(string(e.Key) == gw.APIKey))
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to print API keys: %s", err))
+		return ExitFailConfig
+	}
+
+	return code
+}
+
+// verifyAPIKeys checks that the configured API keys are accepted by the gateways
+func verifyAPIKeys(ctx context.Context, gateways []config.APIConfig) int {
+	code := ExitOK
+	for _, gw := range gateways {
+		if err := gw.VerifyAPIKey(ctx); err != nil {
+			fmt.Printf("%s: API key invalid: %s\n", gw.NameOrDefault(), err)
+			code = ExitFailConnect
+			continue
+		}
+		fmt.Printf("%s: API key valid\n", gw.NameOrDefault())
+	}
+
+	return code
+}
+
+// revokeAPIKeys deletes keys from the whitelist of the gateway
+// The configured key is never revoked, it would lock deflux out.
+func revokeAPIKeys(ctx context.Context, gw config.APIConfig, keys []string) int {
+	if len(keys) == 0 {
+		slog.Error("No API keys to revoke given")
+		return ExitFailConfig
+	}
+
+	code := ExitOK
+	for _, key := range keys {
+		if key == gw.APIKey {
+			slog.Error(fmt.Sprintf("Refusing to revoke the configured API key %s", config.APIKey(key).Redacted()))
+			code = ExitFailConfig
+			continue
+		}
+
+		if err := gw.RevokeAPIKey(ctx, config.APIKey(key)); err != nil {
+			slog.Error(err.Error())
+			code = ExitFailConnect
+			continue
+		}
+		fmt.Printf("%s: revoked %s\n", gw.NameOrDefault(), key)
+	}
+
+	return code
+}
+
+// pruneAPIKeys revokes keys created by deflux that have not been used for the given duration, except the configured one
+func pruneAPIKeys(ctx context.Context, gw config.APIConfig, unused time.Duration, dryRun bool, now time.Time) int {
+	entries, err := gw.Whitelist(ctx)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Gateway %s: %s", gw.NameOrDefault(), err))
+		return ExitFailConnect
+	}
+
+	code := ExitOK
+	for _, e := range prunableAPIKeys(entries, gw.APIKey, unused, now) {
+		if dryRun {
+			fmt.Printf("%s: would revoke %s, last used %s\n", gw.NameOrDefault(), e.Key, formatDate(e.LastUseDate))
+			continue
+		}
+
+		if err := gw.RevokeAPIKey(ctx, e.Key); err != nil {
+			slog.Error(err.Error())
+			code = ExitFailConnect
+			continue
+		}
+		fmt.Printf("%s: revoked %s, last used %s\n", gw.NameOrDefault(), e.Key, formatDate(e.LastUseDate))
+	}
+
+	return code
+}
+
+// prunableAPIKeys returns the keys created by deflux that have not been used for the given duration, except the
+// configured key. Keys that have never been used count from their creation.
+func prunableAPIKeys(entries []config.WhitelistEntry, configured string, unused time.Duration, now time.Time) []config.WhitelistEntry {
+	var prunable []config.WhitelistEntry
+	for _, e := range entries {
+		if !e.IsDeflux() || string(e.Key) == configured {
+			continue
+		}
+
+		last := e.LastUseDate
+		if last.IsZero() {
+			last = e.CreateDate
+		}
+		if last.Add(unused).After(now) {
+			continue
+		}
+
+		prunable = append(prunable, e)
+	}
+
+	return prunable
+}
+
+// formatDate formats a date of the whitelist, or "-" if it is unknown
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.DateTime)
+}
+
+// yesNo returns "yes" or "no"
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,28 @@
+package deflux
+
+import (
+	"github.com/rvk01/deflux/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestPrunableAPIKeys(t *testing.T) {
+	now := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	entries := []config.WhitelistEntry{
+		// configured
+		{Key: "83A0C7D1E2", Name: "Deflux", CreateDate: now.Add(-100 * 24 * time.Hour), LastUseDate: now.Add(-100 * 24 * time.Hour)},
+		// unused deflux key
+		{Key: "1234567890", Name: "Deflux", CreateDate: now.Add(-90 * 24 * time.Hour), LastUseDate: now.Add(-60 * 24 * time.Hour)},
+		// never used deflux key
+		{Key: "ABCDEF0123", Name: "Deflux", CreateDate: now.Add(-40 * 24 * time.Hour)},
+		// recently used deflux key
+		{Key: "0987654321", Name: "Deflux", CreateDate: now.Add(-90 * 24 * time.Hour), LastUseDate: now.Add(-time.Hour)},
+		// other application
+		{Key: "FEDCBA9876", Name: "Phoscon#B1920x1080", CreateDate: now.Add(-90 * 24 * time.Hour)},
+	}
+
+	prunable := prunableAPIKeys(entries, "83A0C7D1E2", 30*24*time.Hour, now)
+	if len(prunable) != 2 || prunable[0].Key != "1234567890" || prunable[1].Key != "ABCDEF0123" {
+		t.Fatalf("unexpected prunable keys: %+v", prunable)
+	}
+}
@@ -0,0 +1,92 @@
+package deflux
+
+import (
+	"context"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz"
+	"github.com/rvk01/deflux/pkg/sink"
+	"slices"
+	"strings"
+	"time"
+)
+
+// checkTimeout is the timeout of each connectivity check
+const checkTimeout = 10 * time.Second
+
+// RunCheckConfig loads and validates the configuration, tests the connections to the deCONZ REST API and websocket
+// of all gateways and to InfluxDB, reports each step on stdout and returns the program's exit code
+func RunCheckConfig(file string) int {
+	cfg, err := config.LoadConfiguration(file)
+	if !reportCheck("Load configuration", err) {
+		return ExitFailConfig
+	}
+
+	if !reportCheck("Validate configuration", cfg.Validate()) {
+		return ExitFailConfig
+	}
+
+	// GatewayConfigs does not fail after validation
+	gateways, _ := cfg.GatewayConfigs()
+
+	code := ExitOK
+	for _, gw := range gateways {
+		dAPI := deconz.API{Config: gw}
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		sensors, err := dAPI.Sensors(ctx)
+		cancel()
+		step := fmt.Sprintf("Gateway %s: REST API at %s", gw.NameOrDefault(), gw.Addr)
+		if err == nil {
+			step = fmt.Sprintf("%s, %d sensors", step, len(*sensors))
+		}
+		if !reportCheck(step, err) {
+			code = ExitFailConnect
+			continue
+		}
+
+		if gw.WsAddr == "" {
+			ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+			err := gw.DiscoverWebsocket(ctx)
+			cancel()
+			if !reportCheck(fmt.Sprintf("Gateway %s: discover websocket", gw.NameOrDefault()), err) {
+				code = ExitFailConnect
+				continue
+			}
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), checkTimeout)
+		err = deconz.CheckWebsocket(ctx, gw)
+		cancel()
+		if !reportCheck(fmt.Sprintf("Gateway %s: websocket at %s", gw.NameOrDefault(), gw.WsAddr), err) {
+			code = ExitFailConnect
+		}
+	}
+
+	if slices.Contains(cfg.SinkNames(), config.SinkInfluxDB) {
+		step := fmt.Sprintf("InfluxDB at %s, bucket %s", cfg.InfluxDB.URL, cfg.InfluxDB.Bucket)
+		if cfg.InfluxDB.Org == "" {
+			step = fmt.Sprintf("InfluxDB v1 at %s, database not checked", cfg.InfluxDB.URL)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		err := sink.CheckInfluxDB(ctx, cfg.InfluxDB)
+		cancel()
+		if !reportCheck(step, err) {
+			code = ExitFailConnect
+		}
+	}
+
+	return code
+}
+
+// reportCheck prints the result of a check and returns true if it succeeded
+func reportCheck(step string, err error) bool {
+	if err == nil {
+		fmt.Printf("[ OK ] %s\n", step)
+		return true
+	}
+
+	// validation errors are joined by newlines, print one per line
+	fmt.Printf("[FAIL] %s\n       %s\n", step, strings.ReplaceAll(err.Error(), "\n", "\n       "))
+	return false
+}
@@ -0,0 +1,88 @@
+package deflux
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunCheckConfig(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	var wsPort string
+	deconzServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err == nil {
+				conn.Close()
+			}
+		case "/api/123A4B5C67/sensors":
+			fmt.Fprint(w, `{"1": {"name": "th-sz", "type": "ZHATemperature", "state": {"temperature": 1850}}}`)
+		case "/api/123A4B5C67/config":
+			fmt.Fprintf(w, `{"websocketport": %s}`, wsPort)
+		default:
+			http.Error(w, `[{"error": {"type": 1, "description": "unauthorized user"}}]`, http.StatusForbidden)
+		}
+	}))
+	defer deconzServer.Close()
+	u, _ := url.Parse(deconzServer.URL)
+	wsPort = u.Port()
+
+	influxServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/api/v2/buckets":
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Query().Get("name") == "default" {
+				fmt.Fprint(w, `{"buckets": [{"id": "1", "name": "default", "orgID": "2", "retentionRules": []}]}`)
+				return
+			}
+			fmt.Fprint(w, `{"buckets": []}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer influxServer.Close()
+
+	tests := []struct {
+		name   string
+		apikey string
+		bucket string
+		extra  string
+		want   int
+	}{
+		{name: "ok", apikey: "123A4B5C67", bucket: "default", want: ExitOK},
+		{name: "unauthorized", apikey: "unknown", bucket: "default", want: ExitFailConnect},
+		{name: "missing bucket", apikey: "123A4B5C67", bucket: "missing", want: ExitFailConnect},
+		{name: "unknown key", apikey: "123A4B5C67", bucket: "default", extra: "fillintervall: 10m\n", want: ExitFailConfig},
+		{name: "invalid", apikey: "", bucket: "default", want: ExitFailConfig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "deflux.yml")
+			content := fmt.Sprintf(`deconz:
+  addr: %s/api
+  apikey: "%s"
+influxdb:
+  url: %s
+  token: SECRET
+  org: organization
+  bucket: %s
+%s`, deconzServer.URL, tt.apikey, influxServer.URL, tt.bucket, tt.extra)
+			if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+				t.Fatalf("failed to write config: %s", err)
+			}
+
+			if code := RunCheckConfig(file); code != tt.want {
+				t.Errorf("expected exit code %d, got %d", tt.want, code)
+			}
+		})
+	}
+}
@@ -8,12 +8,22 @@ import (
 	"github.com/rvk01/deflux/pkg/deconz/sensor"
 	"github.com/rvk01/deflux/pkg/sink"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 )
 
+const (
+	// lightMeasurement is the measurement of light states
+	lightMeasurement = "deflux_light_state"
+	// groupMeasurement is the measurement of group states
+	groupMeasurement = "deflux_group_state"
+	// sceneMeasurement is the measurement of recalled scenes
+	sceneMeasurement = "deflux_scene_called"
+)
+
 const (
 	// ExitOK is a return code that indicates successful termination
 	ExitOK int = 0
@@ -23,176 +33,369 @@ const (
 	ExitFailConfig = 2
 )
 
-// RunOnce pulls sensor state from API, writes to InfluxDB and returns the program's exit code.
+// RunOnce pulls sensor, light and group state from the API of all gateways, writes to the configured sinks and
+// returns the program's exit code.
 func RunOnce(cfg *config.Configuration) int {
-	// set up output to InfluxDB
-	influx := sink.NewInfluxSink(cfg)
-	defer influx.Close()
+	gateways, err := cfg.GatewayConfigs()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid gateway configuration: %s", err))
+		return ExitFailConfig
+	}
 
-	dAPI := deconz.API{Config: cfg.Deconz}
+	if err := cfg.Validate(); err != nil {
+		slog.Error(fmt.Sprintf("Invalid configuration, run `deflux check-config` for details:\n%s", err))
+		return ExitFailConfig
+	}
 
-	sensors, err := dAPI.Sensors()
+	// set up output to the sinks
+	out, err := sink.New(cfg)
 	if err != nil {
-		slog.Error("Failed to fetch sensors: %s", err)
-		return 1
+		slog.Error(fmt.Sprintf("Could not create sink: %s", err))
+		return ExitFailConfig
 	}
-	for _, s := range *sensors {
-		writeSensorState(&s, &s, influx, time.Now(), nil)
+	defer closeSink(out)
+
+	// pending requests are canceled on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	code := ExitOK
+	for _, gw := range gateways {
+		if !pullOnce(ctx, cfg, gw, gatewaySink(out, gw)) {
+			code = ExitFailConnect
+		}
 	}
 
-	return ExitOK
+	return code
 }
 
-// RunWebsocket continuously processes events from the deCONZ websocket
-func RunWebsocket(cfg *config.Configuration) int {
-	sigsCh := make(chan os.Signal, 1)
-	signal.Notify(sigsCh, syscall.SIGINT, syscall.SIGTERM)
+// pullOnce pulls sensor, light and group state from the API of a gateway and writes them to out
+// It returns false if the API could not be queried.
+func pullOnce(ctx context.Context, cfg *config.Configuration, gw config.APIConfig, out sink.Sink) bool {
+	rules, err := newSensorRules(cfg.Sensors, gw.NameOrDefault())
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid sensor configuration: %s", err))
+		return false
+	}
+
+	dAPI, err := deconz.NewAPI(gw)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid settings of gateway %s: %s", gw.NameOrDefault(), err))
+		return false
+	}
+
+	sensors, err := dAPI.Sensors(ctx)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to fetch sensors of gateway %s: %s", gw.NameOrDefault(), err))
+		return false
+	}
+	for _, s := range *sensors {
+		writeSensorState(&s, &s, out, rules, cfg.Timestamp, time.Now(), nil)
+	}
 
-	// set up input from deCONZ websocket
-	dAPI := deconz.API{Config: cfg.Deconz}
-	// TODO configurable update interval
-	sensorProvider, err := deconz.NewCachingSensorProvider(dAPI, 1*time.Minute)
+	if cfg.Health.Enabled {
+		newHealthWriter(out, cfg, rules).check(sensors, time.Now())
+	}
 
+	lights, err := dAPI.Lights(ctx)
 	if err != nil {
-		slog.Error("Could not create websocket reader: %s", err)
-		return ExitFailConnect
+		slog.Error(fmt.Sprintf("Failed to fetch lights of gateway %s: %s", gw.NameOrDefault(), err))
+		return false
+	}
+	for _, l := range *lights {
+		writeLightState(&l, out, time.Now())
 	}
 
-	// create a new WebsocketEventReader using the websocket connection
-	eventReader, err := deconz.NewWebsocketEventReader(dAPI, sensorProvider)
+	groups, err := dAPI.Groups(ctx)
 	if err != nil {
-		slog.Error("Could not create websocket reader: %s", err)
-		return ExitFailConnect
+		slog.Error(fmt.Sprintf("Failed to fetch groups of gateway %s: %s", gw.NameOrDefault(), err))
+		return false
+	}
+	for _, g := range *groups {
+		writePoint(groupMeasurement, &g, out, time.Now())
 	}
 
-	ctx1, cancel := context.WithCancel(context.Background())
-	done := make(chan bool, 1)
+	return true
+}
 
-	// set up output to InfluxDB
-	influx := sink.NewInfluxSink(cfg)
+// RunWebsocket continuously processes events from the deCONZ websockets of all gateways
+// On SIGHUP, the configuration is reloaded from its file, see websocketRunner.reload.
+func RunWebsocket(cfg *config.Configuration) int {
+	sigsCh := make(chan os.Signal, 1)
+	signal.Notify(sigsCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	// start websocket consumer background job
-	sensorsCh, err := eventReader.Start(ctx1)
+	gatewayConfigs, err := cfg.GatewayConfigs()
 	if err != nil {
-		cancel()
-		slog.Error("Could not start websocket reader: %s", err)
-		return ExitFailConnect
+		slog.Error(fmt.Sprintf("Invalid gateway configuration: %s", err))
+		return ExitFailConfig
 	}
 
-	slog.Info(fmt.Sprintf("Connected to deCONZ at %s", cfg.Deconz.Addr))
-
-	lastWrite := make(map[int]*time.Time)
-	ticker := time.NewTicker(1 * time.Minute)
-	if cfg.FillValues.Enabled {
-		slog.Info(fmt.Sprintf("Filling sensor values enabled. Fill interval is %v, timeout is %v", cfg.FillValues.FillInterval, cfg.FillValues.LastSeenTimeout))
-
-		// TODO if InitialFill is false, compare "lastupdated" timestamp to current time and write
-		if cfg.FillValues.InitialFill {
-			sensors, err := sensorProvider.Sensors()
-			if err != nil {
-				slog.Error("Failed to fetch sensors for initial fill: %s", err)
-			}
-			for _, s := range *sensors {
-				now := time.Now()
-
-				if s.LastSeen.IsZero() {
-					continue
-				}
-				if s.LastSeen.Add(cfg.FillValues.LastSeenTimeout).Before(now) {
-					slog.Warn(fmt.Sprintf("sensor %d last seen %s ago -> assuming it's offline", s.ID, now.Sub(s.LastSeen)))
-					continue
-				}
-
-				writeSensorState(&s, &s, influx, now, lastWrite)
-			}
+	if err := cfg.Validate(); err != nil {
+		slog.Error(fmt.Sprintf("Invalid configuration, run `deflux check-config` for details:\n%s", err))
+		return ExitFailConfig
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// set up input from deCONZ websockets
+	var gateways []*gateway
+	for _, gw := range gatewayConfigs {
+		g, err := newGateway(ctx, cfg, gw)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Could not create websocket reader for gateway %s: %s", gw.NameOrDefault(), err))
+			return ExitFailConnect
 		}
+		gateways = append(gateways, g)
+	}
+
+	// set up output to the sinks
+	out, err := sink.NewReloadable(cfg)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Could not create sink: %s", err))
+		return ExitFailConfig
 	}
 
 	// bring it all together
-	go func(ctx context.Context) {
-		for {
-			select {
-			case sensorEvent := <-sensorsCh:
-				if sensorEvent == nil {
-					continue
-				}
-
-				writeSensorState(sensorEvent, sensorEvent.Sensor, influx, time.Now(), lastWrite)
-
-			case <-ticker.C:
-				if !cfg.FillValues.Enabled {
-					continue
-				}
-
-				slog.Debug(fmt.Sprintf("Checking sensor values older than %s", cfg.FillValues.FillInterval))
-
-				for id, t := range lastWrite {
-					now := time.Now()
-
-					if t.Add(cfg.FillValues.FillInterval).After(now) {
-						continue
-					}
-
-					s, err := sensorProvider.Sensor(id)
-					if err != nil {
-						slog.Warn(fmt.Sprintf("Could not retrieve sensor with id %d: %s", id, err))
-						continue
-					}
-
-					if s.LastSeen.Add(cfg.FillValues.LastSeenTimeout).Before(now) {
-						slog.Warn(fmt.Sprintf("sensor %d last seen %s ago -> assuming it's offline", s.ID, now.Sub(s.LastSeen)))
-						continue
-					}
-
-					writeSensorState(s, s, influx, now, lastWrite)
-				}
-
-			case <-ctx.Done():
-				ticker.Stop()
-				influx.Close()
-			}
+	r := &websocketRunner{ctx: ctx, cfg: cfg, out: out}
+
+	var statusServer *http.Server
+	if cfg.Status.Listen != "" {
+		statusServer, err = startStatusServer(cfg.Status.Listen, r)
+		if err != nil {
+			r.shutdown()
+			slog.Error(err.Error())
+			return ExitFailConfig
 		}
+	}
+	defer stopStatusServer(statusServer)
+
+	if err := r.start(gateways); err != nil {
+		r.shutdown()
+		slog.Error(err.Error())
+		return ExitFailConnect
+	}
 
-	}(ctx1)
+	internalDone := make(chan struct{})
+	go func() {
+		defer close(internalDone)
+		runInternalMetrics(ctx, r)
+	}()
 
 	// signal handling
-	go func() {
-		select {
-		case sig := <-sigsCh:
-			slog.Debug("Received signal", "signal", sig)
-			cancel()
-
-			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-			eventReader.Shutdown(ctx)
-			cancel()
-			done <- true
-			return
+	for sig := range sigsCh {
+		slog.Debug("Received signal", "signal", sig)
+		if sig != syscall.SIGHUP {
+			break
 		}
-	}()
 
-	<-done
+		slog.Info("Reloading configuration")
+		if err := r.reload(); err != nil {
+			slog.Error(fmt.Sprintf("Failed to reload configuration, keeping the running configuration: %s", err))
+			continue
+		}
+		slog.Info("Configuration reloaded")
+	}
+
+	// stop writing internal metrics before the sinks are closed
+	cancel()
+	<-internalDone
+
+	r.shutdown()
 	slog.Info("Exiting")
 	return ExitOK
 }
 
-// writeSensorState writes a sensor measurement to InfluxDB
-func writeSensorState(ts deconz.Timeserieser, s *sensor.Sensor, influx *sink.InfluxSink, t time.Time, last map[int]*time.Time) {
-	tags, fields, err := ts.Timeseries()
+// gatewaySink returns a sink that adds the gateway tag to all points written to out
+func gatewaySink(out sink.Sink, gw config.APIConfig) sink.Sink {
+	return sink.NewTagSink(out, map[string]string{"gateway": gw.NameOrDefault()})
+}
+
+// sensorWrites records the last write of each sensor of a gateway
+type sensorWrites map[int]*sensorWrite
+
+// sensorWrite is the last write of a sensor
+type sensorWrite struct {
+	// at is the time of the write
+	at time.Time
+	// lastUpdated is the lastupdated time of the written state, zero if it is unknown
+	lastUpdated time.Time
+}
+
+// initialFill writes the most recent state of all sensors that are online
+func initialFill(sp sensor.Provider, out sink.Sink, rules *sensorRules, policy config.TimestampPolicy, cfg config.FillConfig, lastWrite sensorWrites, now time.Time) {
+	sensors, err := sp.Sensors()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to fetch sensors for initial fill: %s", err))
+		return
+	}
+
+	for _, s := range *sensors {
+		if s.LastSeen.IsZero() {
+			continue
+		}
+		if s.LastSeen.Add(cfg.LastSeenTimeout).Before(now) {
+			slog.Warn(fmt.Sprintf("sensor %d last seen %s ago -> assuming it's offline", s.ID, now.Sub(s.LastSeen)))
+			continue
+		}
+
+		writeSensorState(&s, &s, out, rules, policy, now, lastWrite)
+	}
+}
+
+// fillValues writes the most recent state of sensors that have not been written for cfg.FillInterval, or the fill
+// interval of the sensor overridden by the rules.
+// Sensors that have not been seen for cfg.LastSeenTimeout are considered offline and skipped.
+func fillValues(sp sensor.Provider, out sink.Sink, rules *sensorRules, policy config.TimestampPolicy, cfg config.FillConfig, lastWrite sensorWrites, now time.Time) {
+	slog.Debug(fmt.Sprintf("Checking sensor values older than %s", cfg.FillInterval))
+
+	for id, w := range lastWrite {
+		s, err := sp.Sensor(id)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Could not retrieve sensor with id %d: %s", id, err))
+			continue
+		}
+
+		if w.at.Add(rules.fillInterval(s, cfg.FillInterval)).After(now) {
+			continue
+		}
+
+		if s.LastSeen.Add(cfg.LastSeenTimeout).Before(now) {
+			slog.Warn(fmt.Sprintf("sensor %d last seen %s ago -> assuming it's offline", s.ID, now.Sub(s.LastSeen)))
+			continue
+		}
+
+		writeSensorState(s, s, out, rules, policy, now, lastWrite)
+	}
+}
+
+// writeSensorState writes a sensor measurement to the sink, if the sensor is included by the rules
+// The time of the measurement is now or the lastupdated time of the sensor state, depending on the policy. The time
+// of the write is recorded as now in last, along with the lastupdated time of the written state.
+func writeSensorState(ts deconz.Timeserieser, s *sensor.Sensor, out sink.Sink, rules *sensorRules, policy config.TimestampPolicy, now time.Time, last sensorWrites) {
+	if !rules.included(s) {
+		return
+	}
+
+	if tags := rules.tags(s); tags != nil {
+		out = sink.NewTagSink(out, tags)
+	}
+
+	t := now
+	updated, ok := lastUpdated(ts)
+	if ok && policy.UseLastUpdated(isWebsocketEvent(ts)) {
+		t = updated
+	}
+
+	if !s.LastSeen.IsZero() {
+		ts = seenSensor{Timeserieser: ts, lastSeen: s.LastSeen}
+	}
+
+	if !writePoint(rules.measurement(s), ts, out, t) {
+		return
+	}
+
+	if last != nil {
+		last[s.ID] = &sensorWrite{at: now, lastUpdated: updated}
+	}
+}
+
+// writeSensorSeen passes the lastseen time of a sensor to the sink without writing its state, if the sensor is
+// included by the rules
+// Sinks thus keep sensors that are seen by deCONZ but rarely report new values, see sink.FieldLastSeen.
+func writeSensorSeen(s *sensor.Sensor, out sink.Sink, rules *sensorRules, now time.Time) {
+	if s.LastSeen.IsZero() || !rules.included(s) {
+		return
+	}
+
+	if tags := rules.tags(s); tags != nil {
+		out = sink.NewTagSink(out, tags)
+	}
+
+	tags, _, err := s.Timeseries()
 	if err != nil {
-		slog.Warn("not adding sensor state to influx: %s", err)
 		return
 	}
 
-	slog.Debug("Writing point", "sensor", s.Type, "tags", tags, "fields", fields)
+	if err := out.Write(rules.measurement(s), tags, map[string]interface{}{sink.FieldLastSeen: s.LastSeen}, now); err != nil {
+		slog.Warn(fmt.Sprintf("failed to write lastseen time of sensor %d: %s", s.ID, err))
+	}
+}
+
+// seenSensor adds the lastseen time of a sensor to its time series data, so sinks can tell offline sensors
+type seenSensor struct {
+	deconz.Timeserieser
+	lastSeen time.Time
+}
+
+// Timeseries returns the tags and fields of the sensor with the field sink.FieldLastSeen
+func (s seenSensor) Timeseries() (map[string]string, map[string]interface{}, error) {
+	tags, fields, err := s.Timeserieser.Timeseries()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields[sink.FieldLastSeen] = s.lastSeen
+	return tags, fields, nil
+}
+
+// isWebsocketEvent returns true if the time series data has been received over the websocket
+func isWebsocketEvent(ts deconz.Timeserieser) bool {
+	_, ok := ts.(*deconz.SensorEvent)
+	return ok
+}
+
+// lastUpdated returns the lastupdated time of the sensor state of ts, if it is known
+func lastUpdated(ts deconz.Timeserieser) (time.Time, bool) {
+	var state interface{}
+	switch v := ts.(type) {
+	case *deconz.SensorEvent:
+		state = v.Event.State()
+	case *sensor.Sensor:
+		state = v.StateDef
+	case reconciledSensor:
+		state = v.StateDef
+	}
 
-	influx.Write(
-		fmt.Sprintf("deflux_%s", s.Type),
+	if u, ok := state.(sensor.LastUpdater); ok {
+		return u.LastUpdated()
+	}
+
+	return time.Time{}, false
+}
+
+// writeLightState writes a light measurement to the sink
+func writeLightState(ts deconz.Timeserieser, out sink.Sink, t time.Time) {
+	writePoint(lightMeasurement, ts, out, t)
+}
+
+// writePoint writes the time series data of ts to the sink and returns true on success
+func writePoint(measurement string, ts deconz.Timeserieser, out sink.Sink, t time.Time) bool {
+	tags, fields, err := ts.Timeseries()
+	if err != nil {
+		slog.Warn(fmt.Sprintf("not adding state to sink: %s", err))
+		return false
+	}
+
+	slog.Debug("Writing point", "measurement", measurement, "tags", tags, "fields", fields)
+
+	err = out.Write(
+		measurement,
 		tags,
 		fields,
 		t,
 	)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("failed to write %s: %s", measurement, err))
+		return false
+	}
 
-	if last != nil {
-		last[s.ID] = &t
+	return true
+}
+
+// closeSink closes the sink and logs errors
+func closeSink(out sink.Sink) {
+	if err := out.Close(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to close sink: %s", err))
 	}
 }
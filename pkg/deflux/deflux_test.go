@@ -0,0 +1,166 @@
+package deflux
+
+import (
+	"errors"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/sink"
+	"testing"
+	"time"
+)
+
+type testSensorProvider struct {
+	store *sensor.Sensors
+}
+
+func (p testSensorProvider) Sensor(i int) (*sensor.Sensor, error) {
+	if s, ok := (*p.store)[i]; ok {
+		return &s, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (p testSensorProvider) Sensors() (*sensor.Sensors, error) {
+	return p.store, nil
+}
+
+var fillConfig = config.FillConfig{
+	Enabled:         true,
+	InitialFill:     true,
+	FillInterval:    30 * time.Minute,
+	LastSeenTimeout: 2 * time.Hour,
+}
+
+func testSensors(now time.Time) testSensorProvider {
+	return testSensorProvider{store: &sensor.Sensors{
+		// online
+		1: sensor.Sensor{
+			Type:     "ZHATemperature",
+			Name:     "online",
+			LastSeen: now.Add(-10 * time.Minute),
+			StateDef: &sensor.ZHATemperature{Temperature: 2062},
+			ID:       1,
+		},
+		// offline
+		2: sensor.Sensor{
+			Type:     "ZHATemperature",
+			Name:     "offline",
+			LastSeen: now.Add(-3 * time.Hour),
+			StateDef: &sensor.ZHATemperature{Temperature: 1800},
+			ID:       2,
+		},
+		// never seen
+		3: sensor.Sensor{
+			Type:     "ZHAPressure",
+			Name:     "unseen",
+			StateDef: &sensor.ZHAPressure{Pressure: 993},
+			ID:       3,
+		},
+	}}
+}
+
+func TestInitialFill(t *testing.T) {
+	now := time.Now()
+	out := sink.NewMemorySink()
+	lastWrite := make(sensorWrites)
+
+	initialFill(testSensors(now), out, nil, config.TimestampReceive, fillConfig, lastWrite, now)
+
+	points := out.Points()
+	if len(points) != 1 {
+		t.Fatalf("expected 1 point, got %d: %v", len(points), points)
+	}
+
+	p := points[0]
+	if p.Measurement != "deflux_ZHATemperature" || p.Tags["name"] != "online" || p.Tags["source"] != "rest" {
+		t.Fatalf("unexpected point: %v", p)
+	}
+	if p.Fields["temperature"] != 20.62 {
+		t.Fatalf("expected temperature 20.62, got %v", p.Fields["temperature"])
+	}
+	if !p.Time.Equal(now) {
+		t.Fatalf("expected time %s, got %s", now, p.Time)
+	}
+
+	if _, ok := lastWrite[1]; !ok || len(lastWrite) != 1 {
+		t.Fatalf("expected last write of sensor 1 only, got %v", lastWrite)
+	}
+}
+
+func TestFillValues(t *testing.T) {
+	now := time.Now()
+	out := sink.NewMemorySink()
+
+	recent := now.Add(-5 * time.Minute)
+	old := now.Add(-time.Hour)
+	lastWrite := sensorWrites{
+		// sensor 1 has been written recently, then it is due
+		1: {at: recent},
+		// sensor 2 is due, but offline
+		2: {at: old},
+		// sensor 4 does not exist
+		4: {at: old},
+	}
+
+	fillValues(testSensors(now), out, nil, config.TimestampReceive, fillConfig, lastWrite, now)
+	if points := out.Points(); len(points) != 0 {
+		t.Fatalf("expected no points, got %v", points)
+	}
+
+	later := now.Add(fillConfig.FillInterval)
+	fillValues(testSensors(now), out, nil, config.TimestampReceive, fillConfig, lastWrite, later)
+
+	points := out.Points()
+	if len(points) != 1 {
+		t.Fatalf("expected 1 point, got %d: %v", len(points), points)
+	}
+	if points[0].Tags["id"] != "1" || !points[0].Time.Equal(later) {
+		t.Fatalf("unexpected point: %v", points[0])
+	}
+	if !lastWrite[1].at.Equal(later) {
+		t.Fatalf("expected last write of sensor 1 at %s, got %s", later, lastWrite[1].at)
+	}
+}
+
+func TestTimestampPolicy(t *testing.T) {
+	now := time.Date(2022, 1, 9, 20, 0, 0, 0, time.UTC)
+	updated := time.Date(2022, 1, 9, 17, 58, 29, 629000000, time.UTC)
+	state := &sensor.ZHATemperature{State: sensor.State{Lastupdated: "2022-01-09T17:58:29.629"}, Temperature: 2062}
+	s := &sensor.Sensor{Type: "ZHATemperature", Name: "th-sz", StateDef: state, ID: 1}
+	event := &deconz.SensorEvent{Sensor: s, Event: deconz.WsEvent{ID: 1, StateDef: state}}
+
+	tests := []struct {
+		policy    config.TimestampPolicy
+		websocket time.Time
+		rest      time.Time
+	}{
+		{config.TimestampReceive, now, now},
+		{config.TimestampLastUpdated, updated, updated},
+		{config.TimestampBoth, now, updated},
+	}
+
+	for _, test := range tests {
+		out := sink.NewMemorySink()
+		lastWrite := make(sensorWrites)
+
+		writeSensorState(event, s, out, nil, test.policy, now, lastWrite)
+		writeSensorState(s, s, out, nil, test.policy, now, lastWrite)
+
+		points := out.Points()
+		if len(points) != 2 || !points[0].Time.Equal(test.websocket) || !points[1].Time.Equal(test.rest) {
+			t.Errorf("policy %s: unexpected times of points %v", test.policy, points)
+		}
+		if w := lastWrite[1]; !w.at.Equal(now) || !w.lastUpdated.Equal(updated) {
+			t.Errorf("policy %s: expected last write at %s of state updated at %s, got %+v", test.policy, now, updated, w)
+		}
+	}
+
+	// unknown lastupdated falls back to the receive time
+	s.StateDef = &sensor.ZHATemperature{State: sensor.State{Lastupdated: "none"}}
+	out := sink.NewMemorySink()
+	writeSensorState(s, s, out, nil, config.TimestampLastUpdated, now, nil)
+	if points := out.Points(); len(points) != 1 || !points[0].Time.Equal(now) {
+		t.Errorf("expected receive time, got %v", points)
+	}
+}
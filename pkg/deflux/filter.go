@@ -0,0 +1,140 @@
+package deflux
+
+import (
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"path"
+	"slices"
+	"time"
+)
+
+// sensorRules applies the include/exclude filters and overrides of the configuration to the sensors of a gateway
+// A nil *sensorRules includes all sensors and overrides nothing.
+type sensorRules struct {
+	cfg     config.SensorsConfig
+	gateway string
+}
+
+// newSensorRules returns the sensorRules for the sensors of a gateway
+// It returns an error if a name pattern is malformed.
+func newSensorRules(cfg config.SensorsConfig, gateway string) (*sensorRules, error) {
+	matches := []config.SensorMatch{cfg.Include, cfg.Exclude}
+	for _, o := range cfg.Overrides {
+		matches = append(matches, o.Match)
+	}
+
+	for _, m := range matches {
+		for _, pattern := range m.Names {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid sensor name pattern %q: %s", pattern, err)
+			}
+		}
+	}
+
+	return &sensorRules{cfg: cfg, gateway: gateway}, nil
+}
+
+// included returns true if the sensor shall be written
+func (r *sensorRules) included(s *sensor.Sensor) bool {
+	if r == nil {
+		return true
+	}
+
+	if !isEmptyMatch(r.cfg.Include) && !r.matches(r.cfg.Include, s) {
+		return false
+	}
+
+	return !r.matches(r.cfg.Exclude, s)
+}
+
+// measurement returns the measurement name of the sensor
+func (r *sensorRules) measurement(s *sensor.Sensor) string {
+	m := fmt.Sprintf("deflux_%s", s.Type)
+	for _, o := range r.overrides(s) {
+		if o.Measurement != "" {
+			m = o.Measurement
+		}
+	}
+
+	return m
+}
+
+// tags returns the static tags of the sensor, or nil if there are none
+func (r *sensorRules) tags(s *sensor.Sensor) map[string]string {
+	var tags map[string]string
+	for _, o := range r.overrides(s) {
+		for k, v := range o.Tags {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[k] = v
+		}
+	}
+
+	return tags
+}
+
+// fillInterval returns the fill interval of the sensor, or def if it is not overridden
+func (r *sensorRules) fillInterval(s *sensor.Sensor, def time.Duration) time.Duration {
+	for _, o := range r.overrides(s) {
+		if o.FillInterval > 0 {
+			def = o.FillInterval
+		}
+	}
+
+	return def
+}
+
+// overrides returns the overrides matching the sensor in configuration order
+func (r *sensorRules) overrides(s *sensor.Sensor) []config.SensorOverride {
+	if r == nil {
+		return nil
+	}
+
+	var overrides []config.SensorOverride
+	for _, o := range r.cfg.Overrides {
+		if r.matches(o.Match, s) {
+			overrides = append(overrides, o)
+		}
+	}
+
+	return overrides
+}
+
+// matches returns true if the sensor matches m
+// An empty SensorMatch matches no sensor. If only gateways are given, all sensors of these gateways match.
+func (r *sensorRules) matches(m config.SensorMatch, s *sensor.Sensor) bool {
+	if isEmptyMatch(m) {
+		return false
+	}
+
+	if len(m.Gateways) > 0 && !slices.Contains(m.Gateways, r.gateway) {
+		return false
+	}
+
+	if len(m.IDs) == 0 && len(m.UniqueIDs) == 0 && len(m.Names) == 0 && len(m.Types) == 0 {
+		return true
+	}
+
+	if slices.Contains(m.IDs, s.ID) || slices.Contains(m.Types, s.Type) {
+		return true
+	}
+
+	if s.UniqueID != "" && slices.Contains(m.UniqueIDs, s.UniqueID) {
+		return true
+	}
+
+	for _, pattern := range m.Names {
+		if ok, _ := path.Match(pattern, s.Name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isEmptyMatch returns true if m has no criteria
+func isEmptyMatch(m config.SensorMatch) bool {
+	return len(m.IDs) == 0 && len(m.UniqueIDs) == 0 && len(m.Names) == 0 && len(m.Types) == 0 && len(m.Gateways) == 0
+}
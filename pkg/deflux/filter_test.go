@@ -0,0 +1,111 @@
+package deflux
+
+import (
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/sink"
+	"testing"
+	"time"
+)
+
+func TestSensorRules(t *testing.T) {
+	rules, err := newSensorRules(config.SensorsConfig{
+		Include: config.SensorMatch{Types: []string{"ZHATemperature", "CLIPPresence"}},
+		Exclude: config.SensorMatch{Names: []string{"test-*"}, UniqueIDs: []string{"00:00:00:00:00:00:00:01-01-0402"}},
+		Overrides: []config.SensorOverride{
+			{
+				Match:        config.SensorMatch{IDs: []int{1}},
+				Measurement:  "temperature",
+				Tags:         map[string]string{"room": "living", "floor": "0"},
+				FillInterval: 5 * time.Minute,
+			},
+			{
+				Match: config.SensorMatch{Gateways: []string{"building-a"}},
+				Tags:  map[string]string{"room": "kitchen"},
+			},
+			{
+				Match:       config.SensorMatch{Gateways: []string{"building-b"}},
+				Measurement: "never",
+			},
+		},
+	}, "building-a")
+	if err != nil {
+		t.Fatalf("failed to create rules: %s", err)
+	}
+
+	living := &sensor.Sensor{Type: "ZHATemperature", Name: "living", ID: 1}
+	tests := []struct {
+		s        *sensor.Sensor
+		included bool
+	}{
+		{living, true},
+		{&sensor.Sensor{Type: "ZHAHumidity", Name: "living", ID: 2}, false},
+		{&sensor.Sensor{Type: "ZHATemperature", Name: "test-device", ID: 3}, false},
+		{&sensor.Sensor{Type: "CLIPPresence", Name: "helper", ID: 4}, true},
+		{&sensor.Sensor{Type: "ZHATemperature", Name: "bath", UniqueID: "00:00:00:00:00:00:00:01-01-0402", ID: 5}, false},
+	}
+	for _, test := range tests {
+		if rules.included(test.s) != test.included {
+			t.Errorf("expected included=%v for sensor %d", test.included, test.s.ID)
+		}
+	}
+
+	if m := rules.measurement(living); m != "temperature" {
+		t.Errorf("expected overridden measurement, got %s", m)
+	}
+	if m := rules.measurement(tests[3].s); m != "deflux_CLIPPresence" {
+		t.Errorf("expected default measurement, got %s", m)
+	}
+	if tags := rules.tags(living); tags["room"] != "kitchen" || tags["floor"] != "0" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+	if i := rules.fillInterval(living, time.Hour); i != 5*time.Minute {
+		t.Errorf("expected overridden fill interval, got %v", i)
+	}
+	if i := rules.fillInterval(tests[3].s, time.Hour); i != time.Hour {
+		t.Errorf("expected default fill interval, got %v", i)
+	}
+
+	if _, err := newSensorRules(config.SensorsConfig{Exclude: config.SensorMatch{Names: []string{"["}}}, ""); err == nil {
+		t.Errorf("expected error for malformed name pattern")
+	}
+}
+
+func TestWriteSensorStateRules(t *testing.T) {
+	now := time.Now()
+	out := sink.NewMemorySink()
+	sensors := testSensors(now)
+
+	rules, err := newSensorRules(config.SensorsConfig{
+		Exclude: config.SensorMatch{IDs: []int{3}},
+		Overrides: []config.SensorOverride{{
+			Match:        config.SensorMatch{IDs: []int{1}},
+			Measurement:  "temperature",
+			Tags:         map[string]string{"room": "living"},
+			FillInterval: 5 * time.Minute,
+		}},
+	}, "default")
+	if err != nil {
+		t.Fatalf("failed to create rules: %s", err)
+	}
+
+	lastWrite := make(sensorWrites)
+	for _, id := range []int{1, 3} {
+		s, _ := sensors.Sensor(id)
+		writeSensorState(s, s, out, rules, config.TimestampReceive, now, lastWrite)
+	}
+
+	points := out.Points()
+	if len(points) != 1 {
+		t.Fatalf("expected 1 point, got %d: %v", len(points), points)
+	}
+	if p := points[0]; p.Measurement != "temperature" || p.Tags["room"] != "living" || p.Tags["name"] != "online" {
+		t.Fatalf("unexpected point: %v", p)
+	}
+
+	// sensor 1 is filled after its own fill interval
+	fillValues(sensors, out, rules, config.TimestampReceive, fillConfig, lastWrite, now.Add(6*time.Minute))
+	if n := len(out.Points()); n != 2 {
+		t.Fatalf("expected 2 points, got %d", n)
+	}
+}
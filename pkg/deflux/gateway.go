@@ -0,0 +1,280 @@
+package deflux
+
+import (
+	"context"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"github.com/rvk01/deflux/pkg/sink"
+	"log/slog"
+	"time"
+)
+
+// gateway holds the websocket reader, the caches and the state of a single deCONZ gateway
+type gateway struct {
+	name string
+	cfg  *config.Configuration
+	api  deconz.API
+
+	rules *sensorRules
+
+	sensorProvider sensor.Provider
+	reader         *deconz.WebsocketEventReader
+	// changes receives the added, removed and renamed sensors, nil if the sensor provider does not report them
+	changes <-chan sensor.Change
+	// events receives the events of the websocket reader, nil until the gateway is opened
+	events <-chan deconz.Event
+
+	// reloadCh passes a new configuration to the event loop
+	reloadCh chan *config.Configuration
+	// ctx is the context of the event loop and of the requests to the REST API
+	ctx context.Context
+	// stop cancels the event loop, the websocket reader and pending requests, done is closed when the event loop has
+	// returned
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// newGateway creates the providers and the websocket reader of a gateway
+// The requests to the REST API are canceled when ctx is done or the gateway is stopped.
+func newGateway(ctx context.Context, cfg *config.Configuration, gw config.APIConfig) (g *gateway, err error) {
+	rules, err := newSensorRules(cfg.Sensors, gw.NameOrDefault())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			stop()
+		}
+	}()
+
+	dAPI, err := deconz.NewAPI(gw)
+	if err != nil {
+		return nil, err
+	}
+	refreshInterval := cfg.Cache.RefreshIntervalOrDefault()
+	sensorProvider, err := deconz.NewCachingSensorProvider(ctx, dAPI, refreshInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	lightProvider, err := deconz.NewCachingLightProvider(ctx, dAPI, refreshInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	groupProvider, err := deconz.NewCachingGroupProvider(ctx, dAPI, refreshInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	// create a new WebsocketEventReader using the websocket connection
+	eventReader, err := deconz.NewWebsocketEventReader(ctx, dAPI, sensorProvider)
+	if err != nil {
+		return nil, err
+	}
+	eventReader.LightProvider = lightProvider
+	eventReader.GroupProvider = groupProvider
+	eventReader.Config = cfg.Websocket
+
+	return &gateway{
+		name:           gw.NameOrDefault(),
+		cfg:            cfg,
+		api:            dAPI,
+		rules:          rules,
+		sensorProvider: sensorProvider,
+		reader:         eventReader,
+		reloadCh:       make(chan *config.Configuration),
+		ctx:            ctx,
+		stop:           stop,
+	}, nil
+}
+
+// open starts the websocket reader without processing its events, so a gateway can be started or discarded later
+func (g *gateway) open() error {
+	if n, ok := g.sensorProvider.(sensor.Notifier); ok {
+		g.changes = n.Subscribe(g.ctx)
+	}
+
+	eventsCh, err := g.reader.Start(g.ctx)
+	if err != nil {
+		g.stop()
+		return err
+	}
+	g.events = eventsCh
+
+	return nil
+}
+
+// start opens the gateway, unless it has been opened, and starts the event loop, which writes the events of the
+// gateway to out
+func (g *gateway) start(out sink.Sink) error {
+	if g.events == nil {
+		if err := g.open(); err != nil {
+			return err
+		}
+	}
+
+	g.done = make(chan struct{})
+	go func() {
+		defer close(g.done)
+		g.run(g.ctx, g.events, gatewaySink(out, g.api.Config))
+	}()
+
+	return nil
+}
+
+// shutdown stops the event loop and closes the connection of the websocket reader
+// Gateways that have not been opened are only canceled.
+func (g *gateway) shutdown() {
+	g.stop()
+	if g.events == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	g.reader.Shutdown(ctx)
+	cancel()
+
+	if g.done != nil {
+		<-g.done
+	}
+}
+
+// reload passes a new configuration to the running event loop
+// The fill values, health, timestamp and sensor settings are applied without reconnecting the websocket.
+func (g *gateway) reload(cfg *config.Configuration) {
+	select {
+	case g.reloadCh <- cfg:
+	case <-g.done:
+	}
+}
+
+// run writes the events of the gateway to out until the context is done
+func (g *gateway) run(ctx context.Context, eventsCh <-chan deconz.Event, out sink.Sink) {
+	cfg := g.cfg
+
+	lastWrite := make(sensorWrites)
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	if cfg.FillValues.Enabled {
+		slog.Info(fmt.Sprintf("Filling sensor values of gateway %s enabled. Fill interval is %v, timeout is %v", g.name, cfg.FillValues.FillInterval, cfg.FillValues.LastSeenTimeout))
+
+		// TODO if InitialFill is false, compare "lastupdated" timestamp to current time and write
+		if cfg.FillValues.InitialFill {
+			initialFill(g.sensorProvider, out, g.rules, cfg.Timestamp, cfg.FillValues, lastWrite, time.Now())
+		}
+	}
+
+	var health *healthWriter
+	if cfg.Health.Enabled {
+		slog.Info(fmt.Sprintf("Device health of gateway %s enabled. Interval is %v", g.name, cfg.Health.Interval))
+
+		health = newHealthWriter(out, cfg, g.rules)
+		health.checkProvider(g.sensorProvider, time.Now())
+	}
+
+	// reconciled receives the sensors fetched after a websocket reconnect
+	reconciled := make(chan reconciliation)
+
+	for {
+		select {
+		case newCfg := <-g.reloadCh:
+			rules, err := newSensorRules(newCfg.Sensors, g.name)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Failed to reload configuration of gateway %s: %s", g.name, err))
+				continue
+			}
+			cfg, g.cfg, g.rules = newCfg, newCfg, rules
+
+			switch {
+			case !cfg.Health.Enabled:
+				health = nil
+			case health == nil:
+				health = newHealthWriter(out, cfg, g.rules)
+			default:
+				health.reconfigure(cfg, g.rules)
+			}
+
+			slog.Info(fmt.Sprintf("Reloaded configuration of gateway %s. Filling sensor values %s, device health %s",
+				g.name, enabledString(cfg.FillValues.Enabled), enabledString(cfg.Health.Enabled)))
+
+		case event := <-eventsCh:
+			switch e := event.(type) {
+			case *deconz.SensorEvent:
+				if !g.rules.included(e.Sensor) {
+					metrics.EventsDropped.WithLabelValues(g.name, metrics.ReasonFiltered, e.Sensor.Type).Inc()
+				}
+				writeSensorState(e, e.Sensor, out, g.rules, cfg.Timestamp, time.Now(), lastWrite)
+			case *deconz.ReconnectEvent:
+				// events are processed while the sensors are fetched from the REST API
+				go fetchReconciliation(ctx, g.sensorProvider, e.Disconnected, reconciled)
+			case *deconz.SensorUpdateEvent:
+				writeSensorSeen(e.Sensor, out, g.rules, time.Now())
+				if health != nil {
+					health.update(e.Sensor, time.Now(), "websocket")
+				}
+			case *deconz.LightEvent:
+				writeLightState(e, out, time.Now())
+			case *deconz.GroupEvent:
+				writePoint(groupMeasurement, e, out, time.Now())
+			case *deconz.SceneEvent:
+				writePoint(sceneMeasurement, e, out, time.Now())
+			}
+
+		case rc := <-reconciled:
+			n := reconcileSensors(rc.sensors, out, g.rules, rc.disconnected, lastWrite, time.Now())
+			slog.Info(fmt.Sprintf("Reconciled %d sensors of gateway %s updated since the websocket was disconnected",
+				n, g.name))
+
+		case c, ok := <-g.changes:
+			if !ok {
+				g.changes = nil
+				continue
+			}
+			g.sensorChanged(c, lastWrite)
+
+		case <-ticker.C:
+			if health != nil {
+				health.checkProvider(g.sensorProvider, time.Now())
+			}
+
+			if !cfg.FillValues.Enabled {
+				continue
+			}
+
+			fillValues(g.sensorProvider, out, g.rules, cfg.Timestamp, cfg.FillValues, lastWrite, time.Now())
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sensorChanged logs an added, removed or renamed sensor
+// Removed sensors are no longer filled.
+func (g *gateway) sensorChanged(c sensor.Change, lastWrite sensorWrites) {
+	switch c.Type {
+	case sensor.ChangeAdded:
+		slog.Info(fmt.Sprintf("Sensor %d (%s) added to gateway %s", c.Sensor.ID, c.Sensor.Name, g.name))
+	case sensor.ChangeRemoved:
+		delete(lastWrite, c.Sensor.ID)
+		slog.Info(fmt.Sprintf("Sensor %d (%s) removed from gateway %s", c.Sensor.ID, c.Sensor.Name, g.name))
+	case sensor.ChangeRenamed:
+		slog.Info(fmt.Sprintf("Sensor %d of gateway %s renamed from %s to %s", c.Sensor.ID, g.name, c.OldName,
+			c.Sensor.Name))
+	}
+}
+
+// enabledString returns "enabled" or "disabled"
+func enabledString(b bool) string {
+	if b {
+		return "enabled"
+	}
+	return "disabled"
+}
@@ -0,0 +1,158 @@
+package deflux
+
+import (
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/sink"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// healthMeasurement is the measurement of the reachable and lastseen state of sensors
+const healthMeasurement = "deflux_device_health"
+
+// deviceHealth is the health of a sensor at a given time
+type deviceHealth struct {
+	sensor *sensor.Sensor
+	now    time.Time
+	// timeout is the duration after which a sensor is considered offline, see config.FillConfig
+	timeout time.Duration
+	source  string
+}
+
+// online returns true if the sensor has been seen within the timeout
+func (h deviceHealth) online() bool {
+	return !h.sensor.LastSeen.IsZero() && !h.sensor.LastSeen.Add(h.timeout).Before(h.now)
+}
+
+// Timeseries returns tags and fields for use in InfluxDB
+func (h deviceHealth) Timeseries() (map[string]string, map[string]interface{}, error) {
+	s := h.sensor
+
+	tags := map[string]string{
+		"name":   s.Name,
+		"type":   s.Type,
+		"id":     strconv.Itoa(s.ID),
+		"source": h.source,
+	}
+
+	// the unique id is <mac>-<endpoint>-<cluster>; all sensors of a physical device share the mac
+	if s.UniqueID != "" {
+		tags["device"], _, _ = strings.Cut(s.UniqueID, "-")
+	}
+
+	fields := map[string]interface{}{
+		"reachable": s.Config.Reachable,
+		"online":    h.online(),
+		"battery":   int(s.Config.Battery),
+	}
+	if !s.LastSeen.IsZero() {
+		fields["lastseen_secs"] = int64(h.now.Sub(s.LastSeen).Seconds())
+	}
+	// deCONZ does not report the link quality of devices; a device that rejoins the network after losing its
+	// parent is announced again, which is the closest hint of a weak link
+	if !s.LastAnnounced.IsZero() {
+		fields["lastannounced_secs"] = int64(h.now.Sub(s.LastAnnounced).Seconds())
+	}
+
+	return tags, fields, nil
+}
+
+// healthState is the part of the health of a sensor that triggers a write when it changes
+type healthState struct {
+	reachable bool
+	online    bool
+	battery   uint32
+}
+
+// healthWriter writes the health of sensors when it changes, and the health of all sensors each interval
+type healthWriter struct {
+	out     sink.Sink
+	cfg     config.HealthConfig
+	timeout time.Duration
+	rules   *sensorRules
+
+	last    map[int]healthState
+	lastAll time.Time
+}
+
+// newHealthWriter creates a healthWriter that writes the health of the sensors included by the rules to out
+func newHealthWriter(out sink.Sink, cfg *config.Configuration, rules *sensorRules) *healthWriter {
+	return &healthWriter{
+		out:     out,
+		cfg:     cfg.Health,
+		timeout: cfg.FillValues.LastSeenTimeout,
+		rules:   rules,
+		last:    make(map[int]healthState),
+	}
+}
+
+// reconfigure applies a new configuration, keeping the last written health of the sensors
+func (h *healthWriter) reconfigure(cfg *config.Configuration, rules *sensorRules) {
+	h.cfg = cfg.Health
+	h.timeout = cfg.FillValues.LastSeenTimeout
+	h.rules = rules
+}
+
+// checkProvider fetches the sensors from sp and checks their health, see check
+func (h *healthWriter) checkProvider(sp sensor.Provider, now time.Time) {
+	sensors, err := sp.Sensors()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to fetch sensors for device health: %s", err))
+		return
+	}
+
+	h.check(sensors, now)
+}
+
+// update writes the health of s if it has changed since the last write
+func (h *healthWriter) update(s *sensor.Sensor, now time.Time, source string) {
+	h.write(s, now, source, false)
+}
+
+// check writes the health of all sensors if the interval has passed since the last time, and of sensors whose
+// health has changed otherwise, e.g. because they have not been seen for the timeout.
+// If the interval is zero, the health of all sensors is only written on the first call.
+func (h *healthWriter) check(sensors *sensor.Sensors, now time.Time) {
+	all := h.lastAll.IsZero() || (h.cfg.Interval > 0 && !h.lastAll.Add(h.cfg.Interval).After(now))
+	if all {
+		h.lastAll = now
+	}
+
+	for _, s := range *sensors {
+		h.write(&s, now, "rest", all)
+	}
+
+	// forget sensors that have been deleted
+	for id := range h.last {
+		if _, ok := (*sensors)[id]; !ok {
+			delete(h.last, id)
+		}
+	}
+}
+
+// write writes the health of s if force is set or its health has changed since the last write
+func (h *healthWriter) write(s *sensor.Sensor, now time.Time, source string, force bool) {
+	if !h.rules.included(s) {
+		return
+	}
+
+	health := deviceHealth{sensor: s, now: now, timeout: h.timeout, source: source}
+	state := healthState{reachable: s.Config.Reachable, online: health.online(), battery: s.Config.Battery}
+
+	if last, ok := h.last[s.ID]; ok && last == state && !force {
+		return
+	}
+
+	out := h.out
+	if tags := h.rules.tags(s); tags != nil {
+		out = sink.NewTagSink(out, tags)
+	}
+
+	if writePoint(healthMeasurement, health, out, now) {
+		h.last[s.ID] = state
+	}
+}
@@ -0,0 +1,101 @@
+package deflux
+
+import (
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/sink"
+	"testing"
+	"time"
+)
+
+func TestHealthWriter(t *testing.T) {
+	now := time.Now()
+	out := sink.NewMemorySink()
+	sensors := testSensors(now).store
+	s1 := (*sensors)[1]
+	s1.UniqueID = "00:15:8d:12:34:bd:ff:71-01-0402"
+	s1.Config = sensor.Config{Battery: 90, Reachable: true}
+	s1.LastAnnounced = now.Add(-24 * time.Hour)
+	(*sensors)[1] = s1
+
+	h := newHealthWriter(out, &config.Configuration{
+		FillValues: fillConfig,
+		Health:     config.HealthConfig{Enabled: true, Interval: 3 * time.Hour},
+	}, nil)
+
+	// first check writes all sensors
+	h.check(sensors, now)
+	points := out.Points()
+	if len(points) != 3 {
+		t.Fatalf("expected 3 points, got %d: %v", len(points), points)
+	}
+	for _, p := range points {
+		if p.Measurement != healthMeasurement {
+			t.Fatalf("unexpected measurement: %v", p)
+		}
+		switch p.Tags["id"] {
+		case "1":
+			if p.Tags["device"] != "00:15:8d:12:34:bd:ff:71" || p.Fields["online"] != true ||
+				p.Fields["reachable"] != true || p.Fields["battery"] != 90 || p.Fields["lastseen_secs"] != int64(600) ||
+				p.Fields["lastannounced_secs"] != int64(24*60*60) {
+				t.Fatalf("unexpected health of online sensor: %v", p)
+			}
+		case "2":
+			if p.Fields["online"] != false || p.Fields["lastseen_secs"] != int64(3*60*60) {
+				t.Fatalf("unexpected health of offline sensor: %v", p)
+			}
+		case "3":
+			_, seen := p.Fields["lastseen_secs"]
+			if _, announced := p.Fields["lastannounced_secs"]; seen || announced || p.Fields["online"] != false {
+				t.Fatalf("unexpected health of unseen sensor: %v", p)
+			}
+		}
+	}
+
+	// nothing changed within the interval
+	h.check(sensors, now.Add(time.Minute))
+	if n := len(out.Points()); n != 3 {
+		t.Fatalf("expected no new points, got %d", n-3)
+	}
+
+	// sensor 1 goes offline after the timeout
+	h.check(sensors, now.Add(fillConfig.LastSeenTimeout-5*time.Minute))
+	points = out.Points()
+	if len(points) != 4 || points[3].Tags["id"] != "1" || points[3].Fields["online"] != false {
+		t.Fatalf("expected offline sensor 1, got %v", points[3:])
+	}
+
+	// websocket reports the sensor as unreachable
+	s1.Config.Reachable = false
+	h.update(&s1, now.Add(fillConfig.LastSeenTimeout-4*time.Minute), "websocket")
+	h.update(&s1, now.Add(fillConfig.LastSeenTimeout-3*time.Minute), "websocket")
+	points = out.Points()
+	if len(points) != 5 || points[4].Fields["reachable"] != false || points[4].Tags["source"] != "websocket" {
+		t.Fatalf("expected unreachable sensor 1, got %v", points[4:])
+	}
+
+	// all sensors are written after the interval
+	h.check(sensors, now.Add(3*time.Hour))
+	if n := len(out.Points()); n != 8 {
+		t.Fatalf("expected 3 new points, got %d", n-5)
+	}
+}
+
+func TestHealthWriterWithoutFillValues(t *testing.T) {
+	now := time.Now()
+	out := sink.NewMemorySink()
+	sensors := testSensors(now).store
+
+	// the lastseen timeout applies to the health even if fill values are disabled
+	h := newHealthWriter(out, &config.Configuration{
+		FillValues: config.FillConfig{LastSeenTimeout: fillConfig.LastSeenTimeout},
+		Health:     config.HealthConfig{Enabled: true, Interval: 3 * time.Hour},
+	}, nil)
+
+	h.check(sensors, now)
+	for _, p := range out.Points() {
+		if online := p.Tags["id"] == "1"; p.Fields["online"] != online {
+			t.Errorf("expected online %t, got %v", online, p)
+		}
+	}
+}
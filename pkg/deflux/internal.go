@@ -0,0 +1,90 @@
+package deflux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"github.com/rvk01/deflux/pkg/sink"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// internalMeasurement is the measurement of the self-instrumentation metrics
+const internalMeasurement = "deflux_internal"
+
+// runInternalMetrics writes the self-instrumentation metrics to InfluxDB every internal.interval while they are
+// enabled, until the context is done. The configuration is read from the runner, so reloads take effect.
+func runInternalMetrics(ctx context.Context, r *websocketRunner) {
+	out := r.out.Named(config.SinkInfluxDB)
+
+	for {
+		cfg, _ := r.running()
+		interval := cfg.Internal.Interval
+		if interval <= 0 {
+			interval = 1 * time.Minute
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		if cfg, _ := r.running(); !cfg.Internal.Enabled {
+			continue
+		}
+		if err := writeInternalMetrics(metrics.Registry, out, time.Now()); err != nil {
+			slog.Warn(fmt.Sprintf("Failed to write internal metrics: %s", err))
+		}
+	}
+}
+
+// writeInternalMetrics writes a deflux_internal point for each deflux metric of the gatherer
+// The metric name and its labels are tags. Counters and gauges have the field "value", histograms the fields "count"
+// and "sum". Metrics of the Go runtime and the process are skipped.
+func writeInternalMetrics(g prometheus.Gatherer, out sink.Sink, t time.Time) error {
+	families, err := g.Gather()
+	if err != nil {
+		return fmt.Errorf("unable to gather metrics: %s", err)
+	}
+
+	var errs []error
+	for _, f := range families {
+		if !strings.HasPrefix(f.GetName(), "deflux_") {
+			continue
+		}
+
+		for _, m := range f.GetMetric() {
+			tags := map[string]string{"metric": f.GetName()}
+			for _, l := range m.GetLabel() {
+				tags[l.GetName()] = l.GetValue()
+			}
+
+			var fields map[string]interface{}
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				fields = map[string]interface{}{"value": m.GetCounter().GetValue()}
+			case dto.MetricType_GAUGE:
+				fields = map[string]interface{}{"value": m.GetGauge().GetValue()}
+			case dto.MetricType_HISTOGRAM:
+				fields = map[string]interface{}{
+					"count": int64(m.GetHistogram().GetSampleCount()),
+					"sum":   m.GetHistogram().GetSampleSum(),
+				}
+			default:
+				continue
+			}
+
+			if err := out.Write(internalMeasurement, tags, fields, t); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,52 @@
+package deflux
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rvk01/deflux/pkg/sink"
+	"testing"
+	"time"
+)
+
+func TestWriteInternalMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	received := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "deflux_events_received_total"}, []string{"gateway"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "deflux_rest_request_duration_seconds"},
+		[]string{"gateway", "endpoint"})
+	other := prometheus.NewGauge(prometheus.GaugeOpts{Name: "go_goroutines"})
+	reg.MustRegister(received, duration, other)
+
+	received.WithLabelValues("home").Add(3)
+	duration.WithLabelValues("home", "sensors").Observe(0.25)
+	duration.WithLabelValues("home", "sensors").Observe(0.5)
+	other.Set(10)
+
+	out := sink.NewMemorySink()
+	now := time.Now()
+	if err := writeInternalMetrics(reg, out, now); err != nil {
+		t.Fatalf("failed to write metrics: %s", err)
+	}
+
+	points := out.Points()
+	if len(points) != 2 {
+		t.Fatalf("expected 2 points, got %d: %v", len(points), points)
+	}
+
+	for _, p := range points {
+		if p.Measurement != internalMeasurement || p.Tags["gateway"] != "home" || !p.Time.Equal(now) {
+			t.Errorf("unexpected point %v", p)
+		}
+
+		switch p.Tags["metric"] {
+		case "deflux_events_received_total":
+			if p.Fields["value"] != 3.0 {
+				t.Errorf("expected value 3, got %v", p.Fields)
+			}
+		case "deflux_rest_request_duration_seconds":
+			if p.Tags["endpoint"] != "sensors" || p.Fields["count"] != int64(2) || p.Fields["sum"] != 0.75 {
+				t.Errorf("unexpected histogram point %v", p)
+			}
+		default:
+			t.Errorf("unexpected metric %q", p.Tags["metric"])
+		}
+	}
+}
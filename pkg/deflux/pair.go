@@ -0,0 +1,136 @@
+package deflux
+
+import (
+	"context"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"log/slog"
+	"net/url"
+	"os"
+	"time"
+)
+
+// PairOptions holds the options of RunPair
+type PairOptions struct {
+	// Addr is the address of the deCONZ REST API. If it is empty, the address is taken from the config file, or
+	// the gateway is discovered.
+	Addr string
+
+	// ConfigFile is an existing config file the API key is written to. If it is empty, the key is only printed.
+	ConfigFile string
+
+	// Gateway selects a gateway of the gateways list in ConfigFile by name
+	Gateway string
+
+	// Timeout is the time to wait for the gateway to be unlocked
+	Timeout time.Duration
+
+	// Username and Password are the credentials of the Phoscon App. If set, the gateway does not need to be unlocked.
+	Username string
+	Password string
+
+	// TLS configures the connection to an https:// address. If it is empty, the TLS settings of the gateway in
+	// ConfigFile are used.
+	TLS config.TLSConfig
+}
+
+// pairInterval is the interval of pairing attempts while waiting for the gateway to be unlocked
+const pairInterval = 2 * time.Second
+
+// RunPair pairs with a deCONZ gateway, prints the API key and writes it to the config file, if requested.
+// It returns the program's exit code.
+func RunPair(opts PairOptions) int {
+	gw, err := pairGateway(opts)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Unable to determine gateway address: %s", err))
+		return ExitFailConfig
+	}
+	addr := gw.Addr
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid gateway address %s: %s", addr, err))
+		return ExitFailConfig
+	}
+
+	client, err := gw.Client()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid TLS settings: %s", err))
+		return ExitFailConfig
+	}
+
+	if opts.Username == "" {
+		printf("Pairing with deCONZ at %s. Open the Phoscon App, go to Menu -> Settings -> Gateway -> Advanced\n", addr)
+		printf("and press \"Authenticate app\". Waiting up to %s...\n", opts.Timeout)
+	} else {
+		printf("Pairing with deCONZ at %s as %s...\n", addr, opts.Username)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	key, err := config.PairWait(ctx, client, *u, opts.Username, opts.Password, pairInterval)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Pairing failed: %s", err))
+		return ExitFailConnect
+	}
+
+	printf("Paired successfully\n")
+	fmt.Println(key)
+
+	if opts.ConfigFile != "" {
+		if err := config.SetAPIKey(opts.ConfigFile, opts.Gateway, key); err != nil {
+			slog.Error(fmt.Sprintf("Failed to write API key: %s", err))
+			return ExitFailConfig
+		}
+		printf("API key written to %s\n", opts.ConfigFile)
+	}
+
+	return ExitOK
+}
+
+// pairGateway returns the address and TLS settings of the gateway to pair with
+func pairGateway(opts PairOptions) (config.APIConfig, error) {
+	if opts.Addr != "" {
+		return config.APIConfig{Addr: opts.Addr, TLS: opts.TLS}, nil
+	}
+
+	if opts.ConfigFile != "" {
+		cfg, err := config.LoadConfiguration(opts.ConfigFile)
+		if err != nil {
+			return config.APIConfig{}, err
+		}
+
+		if opts.Gateway == "" && len(cfg.Gateways) > 0 {
+			return config.APIConfig{}, fmt.Errorf("config file lists several gateways, select one with -gateway")
+		}
+
+		gateways, err := cfg.GatewayConfigs()
+		if err != nil {
+			return config.APIConfig{}, err
+		}
+		for _, gw := range gateways {
+			if (opts.Gateway == "" || gw.NameOrDefault() == opts.Gateway) && gw.Addr != "" {
+				if !opts.TLS.IsZero() {
+					gw.TLS = opts.TLS
+				}
+				return gw, nil
+			}
+		}
+	}
+
+	discovered, err := config.Discover()
+	if err != nil {
+		return config.APIConfig{}, err
+	}
+	if len(discovered) > 1 {
+		return config.APIConfig{}, fmt.Errorf("found %d gateways, select one with -addr", len(discovered))
+	}
+
+	return config.APIConfig{Addr: discovered[0].Addr(), TLS: opts.TLS}, nil
+}
+
+// printf prints user instructions to stderr, keeping stdout for the results of a command
+func printf(format string, a ...interface{}) {
+	_, _ = fmt.Fprintf(os.Stderr, format, a...)
+}
@@ -0,0 +1,86 @@
+package deflux
+
+import (
+	"context"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/sink"
+	"log/slog"
+	"time"
+)
+
+// sourceReconcile is the source tag of sensor states written after a websocket reconnect
+const sourceReconcile = "reconcile"
+
+// reconciledSensor is the state of a sensor fetched from the REST API after a websocket reconnect
+type reconciledSensor struct {
+	*sensor.Sensor
+}
+
+// Timeseries returns the tags and fields of the sensor with the source tag "reconcile"
+func (r reconciledSensor) Timeseries() (map[string]string, map[string]interface{}, error) {
+	tags, fields, err := r.Sensor.Timeseries()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tags["source"] = sourceReconcile
+	return tags, fields, nil
+}
+
+// reconciliation holds the sensors fetched from the REST API after a websocket reconnect
+type reconciliation struct {
+	disconnected time.Time
+	sensors      *sensor.Sensors
+}
+
+// fetchReconciliation refreshes the sensors of sp after a websocket reconnect and sends them to ch
+// It queries the REST API, so it runs outside of the event loop of the gateway. Nothing is sent if the sensors
+// cannot be fetched or ctx is done.
+func fetchReconciliation(ctx context.Context, sp sensor.Provider, disconnected time.Time, ch chan<- reconciliation) {
+	if c, ok := sp.(sensor.Cache); ok {
+		if err := c.Refresh(); err != nil {
+			slog.Error(fmt.Sprintf("Failed to refresh sensors after reconnect: %s", err))
+			return
+		}
+	}
+
+	sensors, err := sp.Sensors()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to fetch sensors after reconnect: %s", err))
+		return
+	}
+
+	select {
+	case ch <- reconciliation{disconnected: disconnected, sensors: sensors}:
+	case <-ctx.Done():
+	}
+}
+
+// reconcileSensors writes the state of sensors that have been updated while the websocket was disconnected
+// A sensor is written if its lastupdated time is after the disconnect and after the lastupdated time of the state
+// written last, e.g. by fillValues during the outage or by a websocket event while the sensors were fetched. The
+// state is written with its lastupdated time. It returns the number of written sensors.
+func reconcileSensors(sensors *sensor.Sensors, out sink.Sink, rules *sensorRules, disconnected time.Time, lastWrite sensorWrites, now time.Time) int {
+	n := 0
+	for _, s := range *sensors {
+		updated, ok := lastUpdated(&s)
+		if !ok {
+			continue
+		}
+
+		since := disconnected
+		if w := lastWrite[s.ID]; w != nil && w.lastUpdated.After(since) {
+			since = w.lastUpdated
+		}
+		if !updated.After(since) || !rules.included(&s) {
+			continue
+		}
+
+		writeSensorState(reconciledSensor{&s}, &s, out, rules, config.TimestampLastUpdated, now, lastWrite)
+		n++
+	}
+
+	return n
+}
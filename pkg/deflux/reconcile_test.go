@@ -0,0 +1,183 @@
+package deflux
+
+import (
+	"context"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/sink"
+	"testing"
+	"time"
+)
+
+// reconcileTemperature returns a temperature sensor with the given lastupdated time
+func reconcileTemperature(id int, lastupdated string) sensor.Sensor {
+	return sensor.Sensor{
+		Type:     "ZHATemperature",
+		Name:     "th",
+		StateDef: &sensor.ZHATemperature{State: sensor.State{Lastupdated: lastupdated}, Temperature: 2062},
+		ID:       id,
+	}
+}
+
+func TestReconcileSensors(t *testing.T) {
+	disconnected := time.Date(2022, 1, 9, 18, 0, 0, 0, time.UTC)
+	now := disconnected.Add(30 * time.Minute)
+
+	sp := testSensorProvider{store: &sensor.Sensors{
+		// updated while disconnected
+		1: reconcileTemperature(1, "2022-01-09T18:05:00.000"),
+		// updated before the disconnect
+		2: reconcileTemperature(2, "2022-01-09T17:55:00.000"),
+		// updated while disconnected, but this state has already been written
+		3: reconcileTemperature(3, "2022-01-09T18:10:00.000"),
+		// never updated
+		4: reconcileTemperature(4, "none"),
+	}}
+
+	out := sink.NewMemorySink()
+	lastWrite := sensorWrites{3: {at: disconnected.Add(20 * time.Minute), lastUpdated: disconnected.Add(10 * time.Minute)}}
+
+	if n := reconcileSensors(sp.store, out, nil, disconnected, lastWrite, now); n != 1 {
+		t.Errorf("expected 1 reconciled sensor, got %d", n)
+	}
+
+	points := out.Points()
+	if len(points) != 1 {
+		t.Fatalf("expected 1 point, got %d: %v", len(points), points)
+	}
+
+	p := points[0]
+	if p.Tags["id"] != "1" || p.Tags["source"] != sourceReconcile {
+		t.Errorf("unexpected tags %v", p.Tags)
+	}
+	if want := disconnected.Add(5 * time.Minute); !p.Time.Equal(want) {
+		t.Errorf("expected lastupdated time %s, got %s", want, p.Time)
+	}
+	if w := lastWrite[1]; w == nil || !w.at.Equal(now) || !w.lastUpdated.Equal(p.Time) {
+		t.Errorf("expected the write to be recorded, got %+v", w)
+	}
+}
+
+func TestReconcileSensorsAfterFill(t *testing.T) {
+	disconnected := time.Date(2022, 1, 9, 18, 0, 0, 0, time.UTC)
+	filled := disconnected.Add(20 * time.Minute)
+	now := disconnected.Add(30 * time.Minute)
+
+	store := sensor.Sensors{
+		1: reconcileTemperature(1, "2022-01-09T17:50:00.000"),
+		2: reconcileTemperature(2, "2022-01-09T17:50:00.000"),
+	}
+	for id, s := range store {
+		s.LastSeen = disconnected
+		store[id] = s
+	}
+	sp := testSensorProvider{store: &store}
+
+	out := sink.NewMemorySink()
+	lastWrite := sensorWrites{
+		1: {at: disconnected.Add(-time.Hour)},
+		2: {at: disconnected.Add(-time.Hour)},
+	}
+
+	// sensor 2 has been updated during the outage and the cache has been refreshed before the fill
+	s := store[2]
+	s.StateDef = &sensor.ZHATemperature{State: sensor.State{Lastupdated: "2022-01-09T18:10:00.000"}, Temperature: 2100}
+	store[2] = s
+
+	fillValues(sp, out, nil, config.TimestampReceive, fillConfig, lastWrite, filled)
+	if points := out.Points(); len(points) != 2 {
+		t.Fatalf("expected 2 filled points, got %d: %v", len(points), points)
+	}
+
+	// sensor 1 has been updated during the outage after the fill
+	s = store[1]
+	s.StateDef = &sensor.ZHATemperature{State: sensor.State{Lastupdated: "2022-01-09T18:15:00.000"}, Temperature: 2100}
+	store[1] = s
+
+	out = sink.NewMemorySink()
+	if n := reconcileSensors(sp.store, out, nil, disconnected, lastWrite, now); n != 1 {
+		t.Errorf("expected 1 reconciled sensor, got %d", n)
+	}
+
+	points := out.Points()
+	if len(points) != 1 {
+		t.Fatalf("expected 1 point, got %d: %v", len(points), points)
+	}
+	if p := points[0]; p.Tags["id"] != "1" || !p.Time.Equal(disconnected.Add(15*time.Minute)) {
+		t.Errorf("expected the state of sensor 1 updated after the fill, got %v", p)
+	}
+}
+
+// blockingCache is a sensor.Cache whose Refresh blocks until release is closed
+type blockingCache struct {
+	testSensorProvider
+	refreshing chan struct{}
+	release    chan struct{}
+}
+
+func (c blockingCache) Add(sensor.Sensor) {}
+
+func (c blockingCache) Remove(int) {}
+
+func (c blockingCache) Refresh() error {
+	c.refreshing <- struct{}{}
+	<-c.release
+	return nil
+}
+
+func TestGatewayReconcileInBackground(t *testing.T) {
+	disconnected := time.Date(2022, 1, 9, 18, 0, 0, 0, time.UTC)
+	store := sensor.Sensors{
+		1: reconcileTemperature(1, "2022-01-09T18:05:00.000"),
+		2: reconcileTemperature(2, "2022-01-09T17:55:00.000"),
+	}
+	cache := blockingCache{
+		testSensorProvider: testSensorProvider{store: &store},
+		refreshing:         make(chan struct{}),
+		release:            make(chan struct{}),
+	}
+
+	out := sink.NewMemorySink()
+	g := &gateway{
+		name:           "default",
+		cfg:            &config.Configuration{},
+		sensorProvider: cache,
+		reloadCh:       make(chan *config.Configuration),
+		done:           make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	eventsCh := make(chan deconz.Event)
+	go func() {
+		defer close(g.done)
+		g.run(ctx, eventsCh, out)
+	}()
+	defer func() {
+		cancel()
+		<-g.done
+	}()
+
+	eventsCh <- &deconz.ReconnectEvent{Disconnected: disconnected}
+	<-cache.refreshing
+
+	// events are processed while the REST API is queried
+	s := store[2]
+	select {
+	case eventsCh <- &deconz.SensorEvent{Sensor: &s, Event: deconz.WsEvent{ID: 2, StateDef: s.StateDef}}:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the event loop to process events during the refresh")
+	}
+
+	close(cache.release)
+	for deadline := time.Now().Add(time.Second); len(out.Points()) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the reconciled sensor, got %v", out.Points())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if p := out.Points()[1]; p.Tags["id"] != "1" || p.Tags["source"] != sourceReconcile {
+		t.Errorf("expected sensor 1 to be reconciled, got %v", p)
+	}
+}
@@ -0,0 +1,217 @@
+package deflux
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// recordSensors is the type of a recorded snapshot of the /sensors endpoint
+	recordSensors = "sensors"
+	// recordMessage is the type of a recorded websocket message
+	recordMessage = "message"
+)
+
+// recordFileLayout is the time layout of the default name of a recording
+const recordFileLayout = "20060102-150405"
+
+// RecordOptions holds the options of RunRecord
+type RecordOptions struct {
+	// File is the JSONL file the recording is written to. If it is empty, a file named after the current time is
+	// created in the working directory.
+	File string
+
+	// Gateway restricts the recording to the gateway with that name
+	Gateway string
+
+	// Duration stops the recording after this duration. Zero records until SIGINT or SIGTERM.
+	Duration time.Duration
+}
+
+// recordEntry is a line of a recording
+type recordEntry struct {
+	// Time is the time the message or snapshot has been received
+	Time    time.Time `json:"time"`
+	Gateway string    `json:"gateway"`
+	// Type is recordSensors or recordMessage
+	Type string `json:"type"`
+	// Data is the message or the response of the /sensors endpoint as received
+	Data json.RawMessage `json:"data"`
+}
+
+// recorder writes recordEntry lines, it is safe for concurrent use
+type recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	// entries counts the written entries
+	entries int
+}
+
+// newRecorder returns a recorder writing to w
+func newRecorder(w io.Writer) *recorder {
+	return &recorder{enc: json.NewEncoder(w)}
+}
+
+// record writes data received from a gateway at time t
+// Data that is not valid JSON is recorded as JSON string.
+func (r *recorder) record(gateway, typ string, t time.Time, data []byte) error {
+	if !json.Valid(data) {
+		quoted, err := json.Marshal(string(data))
+		if err != nil {
+			return err
+		}
+		data = quoted
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enc.Encode(recordEntry{Time: t, Gateway: gateway, Type: typ, Data: data}); err != nil {
+		return fmt.Errorf("unable to write recording: %s", err)
+	}
+	r.entries++
+
+	return nil
+}
+
+// RunRecord records the raw websocket messages and a snapshot of the sensors of the configured gateways into a JSONL
+// file, until the duration has passed or the program is interrupted, and returns the program's exit code
+// A new snapshot of the sensors is recorded after every reconnect of the websocket.
+func RunRecord(cfg *config.Configuration, opts RecordOptions) int {
+	gateways, err := cfg.GatewayConfigs()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Invalid gateway configuration: %s", err))
+		return ExitFailConfig
+	}
+
+	var selected []config.APIConfig
+	for _, gw := range gateways {
+		if opts.Gateway == "" || gw.NameOrDefault() == opts.Gateway {
+			selected = append(selected, gw)
+		}
+	}
+	if len(selected) == 0 {
+		slog.Error(fmt.Sprintf("Gateway %s not found", opts.Gateway))
+		return ExitFailConfig
+	}
+
+	file := opts.File
+	if file == "" {
+		file = fmt.Sprintf("deflux-record-%s.jsonl", time.Now().Format(recordFileLayout))
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Could not create recording: %s", err))
+		return ExitFailConfig
+	}
+	defer f.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+
+	rec := newRecorder(f)
+	printf("Recording to %s, stop with Ctrl-C...\n", file)
+
+	code := ExitOK
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, gw := range selected {
+		wg.Add(1)
+		go func(gw config.APIConfig) {
+			defer wg.Done()
+			if err := recordGateway(ctx, cfg, gw, rec); err != nil {
+				slog.Error(fmt.Sprintf("Failed to record gateway %s: %s", gw.NameOrDefault(), err))
+				mu.Lock()
+				code = ExitFailConnect
+				mu.Unlock()
+			}
+		}(gw)
+	}
+	wg.Wait()
+
+	if err := f.Close(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to close recording: %s", err))
+		return ExitFailConfig
+	}
+	printf("Recorded %d entries to %s\n", rec.entries, file)
+
+	return code
+}
+
+// recordGateway records a snapshot of the sensors and the websocket messages of a gateway until ctx is done
+func recordGateway(ctx context.Context, cfg *config.Configuration, gw config.APIConfig, rec *recorder) error {
+	dAPI, err := deconz.NewAPI(gw)
+	if err != nil {
+		return err
+	}
+	name := gw.NameOrDefault()
+
+	snapshot := func() error {
+		b, err := dAPI.SensorsJSON(ctx)
+		if err != nil {
+			return err
+		}
+		return rec.record(name, recordSensors, time.Now(), b)
+	}
+	if err := snapshot(); err != nil {
+		return err
+	}
+
+	sensorProvider, err := deconz.NewCachingSensorProvider(ctx, dAPI, cfg.Cache.RefreshIntervalOrDefault())
+	if err != nil {
+		return err
+	}
+
+	reader, err := deconz.NewWebsocketEventReader(ctx, dAPI, sensorProvider)
+	if err != nil {
+		return err
+	}
+	reader.Config = cfg.Websocket
+	reader.OnMessage = func(message []byte) {
+		if err := rec.record(name, recordMessage, time.Now(), message); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+
+	eventsCh, err := reader.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the events are only decoded to keep the sensor cache up to date
+	for {
+		select {
+		case event := <-eventsCh:
+			if _, ok := event.(*deconz.ReconnectEvent); ok {
+				if err := snapshot(); err != nil && ctx.Err() == nil {
+					slog.Error(fmt.Sprintf("Failed to record sensors of gateway %s after reconnect: %s", name, err))
+				}
+			}
+
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			reader.Shutdown(shutdownCtx)
+			cancel()
+
+			// no more messages are recorded once the reader has closed the channel
+			for range eventsCh {
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package deflux
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/rvk01/deflux/pkg/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordGateway(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/83A0C7D1E2/sensors" {
+			_, _ = w.Write([]byte(`{"4": {"name": "th-sz", "type": "ZHATemperature", "state": {"temperature": 2062}}}`))
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"e": "changed", "id": "4", "r": "sensors", "state": {"temperature": 2100}, "t": "event"}`))
+
+		// keep the connection open until the recording stops
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "recording.jsonl")
+	cfg := &config.Configuration{Deconz: config.APIConfig{
+		Name:   "upstairs",
+		Addr:   srv.URL + "/api",
+		APIKey: "83A0C7D1E2",
+		WsAddr: "ws" + strings.TrimPrefix(srv.URL, "http"),
+	}}
+
+	start := time.Now()
+	if code := RunRecord(cfg, RecordOptions{File: file, Duration: 200 * time.Millisecond}); code != ExitOK {
+		t.Fatalf("expected exit code %d, got %d", ExitOK, code)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("expected the recording to stop after its duration, took %s", d)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("failed to open recording: %s", err)
+	}
+	defer f.Close()
+
+	var types []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid entry %s: %s", scanner.Text(), err)
+		}
+		if e.Gateway != "upstairs" || e.Time.IsZero() {
+			t.Errorf("unexpected entry %+v", e)
+		}
+		types = append(types, e.Type)
+	}
+
+	if strings.Join(types, ",") != "sensors,message" {
+		t.Errorf("expected a snapshot and a message, got %v", types)
+	}
+}
@@ -0,0 +1,141 @@
+package deflux
+
+import (
+	"context"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/sink"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// websocketRunner holds the running gateways and sinks of RunWebsocket
+type websocketRunner struct {
+	ctx context.Context
+	out *sink.Reloadable
+
+	// mu guards cfg and gateways, which are read by the status handler
+	mu       sync.Mutex
+	cfg      *config.Configuration
+	gateways []*gateway
+}
+
+// running returns the current configuration and the running gateways
+func (r *websocketRunner) running() (*config.Configuration, []*gateway) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.cfg, slices.Clone(r.gateways)
+}
+
+// start starts the gateways and adds them to the running gateways
+func (r *websocketRunner) start(gateways []*gateway) error {
+	for _, g := range gateways {
+		if err := g.start(r.out); err != nil {
+			return fmt.Errorf("could not start websocket reader for gateway %s: %s", g.name, err)
+		}
+		slog.Info(fmt.Sprintf("Connected to deCONZ gateway %s at %s", g.name, g.api.Config.Addr))
+
+		r.mu.Lock()
+		r.gateways = append(r.gateways, g)
+		r.mu.Unlock()
+	}
+
+	return nil
+}
+
+// reload loads the configuration from its file again and applies the changes
+// Gateways whose deCONZ, websocket or cache configuration has changed are restarted, sinks whose configuration has
+// changed are replaced, and all other settings are passed to the running gateways. Gateways with TLS files are
+// restarted, so rotated CA and certificate files are read again. If the new configuration is invalid, or a gateway
+// or a sink cannot be created or started, the running configuration is kept.
+func (r *websocketRunner) reload() error {
+	current, gateways := r.running()
+
+	cfg, err := config.LoadConfiguration(current.File)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%s", err)
+	}
+	gatewayConfigs, _ := cfg.GatewayConfigs()
+
+	if cfg.Status.Listen != current.Status.Listen {
+		slog.Warn("The status listen address is applied after a restart")
+	}
+
+	running := make(map[string]*gateway, len(gateways))
+	for _, g := range gateways {
+		running[g.name] = g
+	}
+
+	// create new and changed gateways before anything is stopped
+	var kept, created []*gateway
+	for _, gw := range gatewayConfigs {
+		if g, ok := running[gw.NameOrDefault()]; ok && g.api.Config == gw && !gw.TLS.HasFiles() &&
+			cfg.Websocket == current.Websocket && cfg.Cache == current.Cache {
+			kept = append(kept, g)
+			continue
+		}
+
+		g, err := newGateway(r.ctx, cfg, gw)
+		if err != nil {
+			shutdownGateways(created)
+			return fmt.Errorf("could not create websocket reader for gateway %s: %s", gw.NameOrDefault(), err)
+		}
+		created = append(created, g)
+	}
+
+	return r.apply(cfg, kept, created)
+}
+
+// apply replaces the running configuration and gateways by cfg, the kept gateways and the created gateways
+// The created gateways are opened and the sinks are reloaded before the other gateways are stopped. If either fails,
+// the created gateways are discarded and the running gateways and sinks are left as they are.
+func (r *websocketRunner) apply(cfg *config.Configuration, kept, created []*gateway) error {
+	for _, g := range created {
+		if err := g.open(); err != nil {
+			shutdownGateways(created)
+			return fmt.Errorf("could not start websocket reader for gateway %s: %s", g.name, err)
+		}
+	}
+
+	if err := r.out.Reload(cfg); err != nil {
+		shutdownGateways(created)
+		return fmt.Errorf("could not reload sinks: %s", err)
+	}
+
+	_, gateways := r.running()
+	for _, g := range gateways {
+		if !slices.Contains(kept, g) {
+			slog.Info(fmt.Sprintf("Stopping gateway %s", g.name))
+			g.shutdown()
+		}
+	}
+	for _, g := range kept {
+		g.reload(cfg)
+	}
+
+	r.mu.Lock()
+	r.cfg, r.gateways = cfg, kept
+	r.mu.Unlock()
+
+	// opened gateways do not fail to start
+	return r.start(created)
+}
+
+// shutdown stops all gateways and closes the sinks
+func (r *websocketRunner) shutdown() {
+	_, gateways := r.running()
+	shutdownGateways(gateways)
+	closeSink(r.out)
+}
+
+// shutdownGateways stops the gateways
+func shutdownGateways(gateways []*gateway) {
+	for _, g := range gateways {
+		g.shutdown()
+	}
+}
@@ -0,0 +1,100 @@
+package deflux
+
+import (
+	"context"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz"
+	"github.com/rvk01/deflux/pkg/sink"
+	"testing"
+	"time"
+)
+
+func TestGatewayReload(t *testing.T) {
+	sensors := testSensors(time.Now())
+	s, _ := sensors.Sensor(1)
+	event := &deconz.SensorEvent{Sensor: s, Event: deconz.WsEvent{ID: 1, StateDef: s.StateDef}}
+
+	out := sink.NewMemorySink()
+	g := &gateway{
+		name:           "default",
+		cfg:            &config.Configuration{},
+		sensorProvider: sensors,
+		reloadCh:       make(chan *config.Configuration),
+		done:           make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	eventsCh := make(chan deconz.Event)
+	go func() {
+		defer close(g.done)
+		g.run(ctx, eventsCh, out)
+	}()
+
+	eventsCh <- event
+
+	// the sensor is excluded by the new configuration, without restarting the event loop
+	g.reload(&config.Configuration{
+		Sensors: config.SensorsConfig{Exclude: config.SensorMatch{IDs: []int{1}}},
+		Health:  config.HealthConfig{Enabled: true},
+	})
+	eventsCh <- event
+
+	cancel()
+	<-g.done
+
+	if n := len(out.Points()); n != 1 {
+		t.Errorf("expected 1 point, got %d: %v", n, out.Points())
+	}
+	if !g.cfg.Health.Enabled || len(g.cfg.Sensors.Exclude.IDs) != 1 {
+		t.Errorf("expected new configuration to be applied, got %+v", g.cfg)
+	}
+}
+
+func TestRunnerReloadStartFails(t *testing.T) {
+	cfg := &config.Configuration{
+		Prometheus: config.Prometheus{Listen: "127.0.0.1:0"},
+		Sinks:      []string{config.SinkPrometheus},
+	}
+	out, err := sink.NewReloadable(cfg)
+	if err != nil {
+		t.Fatalf("failed to create sinks: %s", err)
+	}
+	defer out.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	oldCtx, stopOld := context.WithCancel(ctx)
+	defer stopOld()
+	old := &gateway{name: "default", ctx: oldCtx, stop: stopOld, reloadCh: make(chan *config.Configuration)}
+	r := &websocketRunner{ctx: ctx, cfg: cfg, out: out, gateways: []*gateway{old}}
+
+	// the reader of the new gateway is already running, so it cannot be started
+	sensors := testSensors(time.Now())
+	reader := &deconz.WebsocketEventReader{WebsocketAddr: "ws://127.0.0.1:1", SensorProvider: sensors}
+	if _, err := reader.Start(ctx); err != nil {
+		t.Fatalf("failed to start reader: %s", err)
+	}
+	newCtx, stopNew := context.WithCancel(ctx)
+	created := &gateway{name: "other", ctx: newCtx, stop: stopNew, sensorProvider: sensors, reader: reader}
+
+	changed := &config.Configuration{
+		InfluxDB: config.InfluxDB{URL: "http://localhost:8086", Token: "SECRET", Org: "org", Bucket: "default"},
+		Sinks:    []string{config.SinkInfluxDB},
+	}
+	if err := r.apply(changed, nil, []*gateway{created}); err == nil {
+		t.Fatalf("expected error for a gateway that cannot be started")
+	}
+
+	// the running configuration, gateways and sinks are kept
+	current, gateways := r.running()
+	if current != cfg || len(gateways) != 1 || gateways[0] != old || oldCtx.Err() != nil {
+		t.Errorf("expected the running gateway to be kept, got %v", gateways)
+	}
+	if st := out.Status(); len(st) != 1 || st[0].Name != config.SinkPrometheus {
+		t.Errorf("expected the prometheus sink to be kept, got %+v", st)
+	}
+	if newCtx.Err() == nil {
+		t.Errorf("expected the created gateway to be stopped")
+	}
+}
@@ -0,0 +1,193 @@
+package deflux
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz"
+	"github.com/rvk01/deflux/pkg/deconz/sensor"
+	"github.com/rvk01/deflux/pkg/sink"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// ReplayOptions holds the options of RunReplay
+type ReplayOptions struct {
+	// File is the recording created by RunRecord
+	File string
+
+	// Sink restricts the replay to the configured sink with that name. If it is empty, all configured sinks are used.
+	Sink string
+
+	// Realtime set true replays the messages with the delays they have been recorded with, otherwise as fast as
+	// possible
+	Realtime bool
+}
+
+// replayStats counts the replayed messages
+type replayStats struct {
+	messages int
+	// sensorEvents counts the decoded sensor events, which are written unless excluded by the sensor rules
+	sensorEvents int
+	failed       int
+	skipped      int
+}
+
+// replaySensors is the sensor.Provider of a replay, holding the sensors of the last recorded snapshot of a gateway
+type replaySensors sensor.Sensors
+
+// Sensors returns all sensors of the snapshot
+func (r replaySensors) Sensors() (*sensor.Sensors, error) {
+	sensors := sensor.Sensors(r)
+	return &sensors, nil
+}
+
+// Sensor returns the sensor with the given id from the snapshot
+func (r replaySensors) Sensor(id int) (*sensor.Sensor, error) {
+	if s, ok := r[id]; ok {
+		return &s, nil
+	}
+	return nil, sensor.ErrNotFound
+}
+
+// RunReplay decodes the websocket messages of a recording with the recorded sensors, writes the sensor events to the
+// configured sinks with the time they have been recorded, and returns the program's exit code
+// Messages that cannot be decoded are logged with their content. Light, group and scene events are skipped, as the
+// recording holds no lights and groups.
+func RunReplay(cfg *config.Configuration, opts ReplayOptions) int {
+	if opts.Sink != "" {
+		if !slices.Contains(cfg.SinkNames(), opts.Sink) {
+			slog.Error(fmt.Sprintf("Sink %s is not configured", opts.Sink))
+			return ExitFailConfig
+		}
+		cfg.Sinks = []string{opts.Sink}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		slog.Error(fmt.Sprintf("Invalid configuration, run `deflux check-config` for details:\n%s", err))
+		return ExitFailConfig
+	}
+
+	f, err := os.Open(opts.File)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Could not open recording: %s", err))
+		return ExitFailConfig
+	}
+	defer f.Close()
+
+	out, err := sink.New(cfg)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Could not create sink: %s", err))
+		return ExitFailConfig
+	}
+	defer closeSink(out)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	stats, err := replay(ctx, f, cfg, out, opts.Realtime)
+	printf("Replayed %d messages: %d sensor events, %d failed to decode, %d skipped\n", stats.messages,
+		stats.sensorEvents, stats.failed, stats.skipped)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Replay aborted: %s", err))
+		return ExitFailConfig
+	}
+
+	return ExitOK
+}
+
+// replay decodes the entries of a recording read from r and writes the sensor events to out
+// With realtime set, it waits between messages for the duration that passed between them while recording.
+func replay(ctx context.Context, r io.Reader, cfg *config.Configuration, out sink.Sink, realtime bool) (replayStats, error) {
+	var stats replayStats
+	providers := map[string]replaySensors{}
+	rules := map[string]*sensorRules{}
+
+	var last time.Time
+	dec := json.NewDecoder(r)
+	for {
+		var e recordEntry
+		if err := dec.Decode(&e); err != nil {
+			if errors.Is(err, io.EOF) {
+				return stats, nil
+			}
+			return stats, fmt.Errorf("unable to read recording: %s", err)
+		}
+
+		if realtime && !last.IsZero() && e.Time.After(last) {
+			select {
+			case <-time.After(e.Time.Sub(last)):
+			case <-ctx.Done():
+				return stats, ctx.Err()
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		last = e.Time
+
+		switch e.Type {
+		case recordSensors:
+			sensors, err := deconz.ParseSensors(e.Data)
+			if err != nil {
+				return stats, fmt.Errorf("unable to parse sensors of gateway %s recorded at %s: %s", e.Gateway,
+					e.Time, err)
+			}
+			providers[e.Gateway] = replaySensors(*sensors)
+
+		case recordMessage:
+			stats.messages++
+
+			sp, ok := providers[e.Gateway]
+			if !ok {
+				slog.Warn(fmt.Sprintf("Skipping message of gateway %s without recorded sensors: %s", e.Gateway, e.Data))
+				stats.skipped++
+				continue
+			}
+
+			if _, ok := rules[e.Gateway]; !ok {
+				gwRules, err := newSensorRules(cfg.Sensors, e.Gateway)
+				if err != nil {
+					return stats, fmt.Errorf("invalid sensor configuration: %s", err)
+				}
+				rules[e.Gateway] = gwRules
+			}
+
+			// messages that are no valid JSON have been recorded as string
+			message := []byte(e.Data)
+			var invalid string
+			if json.Unmarshal(e.Data, &invalid) == nil {
+				message = []byte(invalid)
+			}
+
+			event, err := deconz.DecodeEvent(sp, message)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Failed to decode message of gateway %s recorded at %s: %s\n%s", e.Gateway,
+					e.Time.Format(time.RFC3339Nano), err, message))
+				stats.failed++
+				continue
+			}
+
+			ev, ok := event.(deconz.SensorEvent)
+			if !ok {
+				slog.Debug(fmt.Sprintf("Skipping %s event of resource %s", event.EventName(), event.Resource()))
+				stats.skipped++
+				continue
+			}
+
+			gwOut := gatewaySink(out, config.APIConfig{Name: e.Gateway})
+			writeSensorState(&ev, ev.Sensor, gwOut, rules[e.Gateway], cfg.Timestamp, e.Time, nil)
+			stats.sensorEvents++
+
+		default:
+			slog.Warn(fmt.Sprintf("Skipping entry of unknown type %q", e.Type))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package deflux
+
+import (
+	"bytes"
+	"context"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/sink"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	recorded := time.Date(2022, 1, 9, 18, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	rec := newRecorder(&buf)
+	entries := []struct {
+		gateway string
+		typ     string
+		data    string
+	}{
+		// a message before the first snapshot
+		{"upstairs", recordMessage, `{"e": "changed", "id": "4", "r": "sensors", "state": {"temperature": 2000}, "t": "event"}`},
+		{"upstairs", recordSensors, `{"4": {"name": "th-sz", "type": "ZHATemperature", "state": {"temperature": 2062}}}`},
+		{"upstairs", recordMessage, `{"e": "changed", "id": "4", "r": "sensors", "state": {"temperature": 2100}, "t": "event"}`},
+		// an unknown sensor
+		{"upstairs", recordMessage, `{"e": "changed", "id": "9", "r": "sensors", "state": {"temperature": 2100}, "t": "event"}`},
+		// invalid JSON is recorded as string
+		{"upstairs", recordMessage, `{"e": "changed", "id"`},
+		// no state
+		{"upstairs", recordMessage, `{"e": "changed", "id": "4", "r": "sensors", "attr": {"name": "th"}, "t": "event"}`},
+	}
+	for i, e := range entries {
+		if err := rec.record(e.gateway, e.typ, recorded.Add(time.Duration(i)*time.Second), []byte(e.data)); err != nil {
+			t.Fatalf("failed to record: %s", err)
+		}
+	}
+	if n := strings.Count(buf.String(), "\n"); n != len(entries) {
+		t.Fatalf("expected %d lines, got %d:\n%s", len(entries), n, buf.String())
+	}
+
+	out := sink.NewMemorySink()
+	stats, err := replay(context.Background(), &buf, &config.Configuration{}, out, false)
+	if err != nil {
+		t.Fatalf("failed to replay: %s", err)
+	}
+
+	want := replayStats{messages: 5, sensorEvents: 1, failed: 2, skipped: 2}
+	if stats != want {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+
+	points := out.Points()
+	if len(points) != 1 {
+		t.Fatalf("expected 1 point, got %d: %v", len(points), points)
+	}
+	p := points[0]
+	if p.Tags["gateway"] != "upstairs" || p.Tags["id"] != "4" || p.Tags["name"] != "th-sz" {
+		t.Errorf("unexpected tags %v", p.Tags)
+	}
+	if p.Fields["temperature"] != float64(21) {
+		t.Errorf("unexpected fields %v", p.Fields)
+	}
+	if want := recorded.Add(2 * time.Second); !p.Time.Equal(want) {
+		t.Errorf("expected recorded time %s, got %s", want, p.Time)
+	}
+}
+
+func TestReplayRealtime(t *testing.T) {
+	recorded := time.Date(2022, 1, 9, 18, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	rec := newRecorder(&buf)
+	_ = rec.record("default", recordSensors, recorded, []byte(`{}`))
+	_ = rec.record("default", recordMessage, recorded.Add(50*time.Millisecond), []byte(`{"e": "added", "id": "1", "r": "sensors", "t": "event"}`))
+
+	start := time.Now()
+	if _, err := replay(context.Background(), bytes.NewReader(buf.Bytes()), &config.Configuration{}, sink.NewMemorySink(), true); err != nil {
+		t.Fatalf("failed to replay: %s", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected the recorded delay, replay took %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := replay(ctx, bytes.NewReader(buf.Bytes()), &config.Configuration{}, sink.NewMemorySink(), true); err == nil {
+		t.Errorf("expected replay to stop when the context is done")
+	}
+}
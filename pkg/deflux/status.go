@@ -0,0 +1,173 @@
+package deflux
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"github.com/rvk01/deflux/pkg/sink"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sensorCacheStatus is implemented by sensor providers that report the state of their cache
+type sensorCacheStatus interface {
+	CacheStatus() (int, time.Time)
+}
+
+// status is the internal state of deflux served on /status
+type status struct {
+	Ready    bool            `json:"ready"`
+	Started  time.Time       `json:"started"`
+	Gateways []gatewayStatus `json:"gateways"`
+	Sinks    []sink.Status   `json:"sinks"`
+}
+
+// gatewayStatus is the state of the websocket and the sensor cache of a gateway
+type gatewayStatus struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+
+	Connected bool `json:"connected"`
+	// Since is the time the websocket has been connected or disconnected
+	Since     time.Time  `json:"since"`
+	LastEvent *time.Time `json:"last_event,omitempty"`
+
+	Sensors        int        `json:"sensors"`
+	SensorsUpdated *time.Time `json:"sensors_updated,omitempty"`
+	// SensorsAgeSecs is the age of the sensor cache in seconds
+	SensorsAgeSecs int64 `json:"sensors_age_secs"`
+}
+
+// statusHandler serves the liveness, readiness and internal state of the websocket mode
+type statusHandler struct {
+	runner  *websocketRunner
+	started time.Time
+	now     func() time.Time
+}
+
+// newStatusHandler returns an http.Handler serving /healthz, /readyz, /status and the internal metrics on /metrics
+func newStatusHandler(r *websocketRunner) http.Handler {
+	h := &statusHandler{runner: r, started: time.Now(), now: time.Now}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/status", h.status)
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+
+	return mux
+}
+
+// healthz reports that deflux is alive
+func (h *statusHandler) healthz(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports whether the websockets of all gateways are connected, or have been disconnected for less than the
+// ready timeout
+func (h *statusHandler) readyz(w http.ResponseWriter, _ *http.Request) {
+	st := h.collect()
+	if st.Ready {
+		fmt.Fprintln(w, "ready")
+		return
+	}
+
+	var reasons []string
+	for _, g := range st.Gateways {
+		if !g.Ready {
+			reasons = append(reasons, fmt.Sprintf("gateway %s: websocket disconnected for %s", g.Name,
+				h.now().Sub(g.Since).Truncate(time.Second)))
+		}
+	}
+
+	http.Error(w, strings.Join(reasons, "\n"), http.StatusServiceUnavailable)
+}
+
+// status serves the internal state as JSON
+func (h *statusHandler) status(w http.ResponseWriter, _ *http.Request) {
+	st := h.collect()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(st); err != nil {
+		slog.Error(fmt.Sprintf("Failed to encode status: %s", err))
+	}
+}
+
+// collect returns the current state of the gateways and sinks
+func (h *statusHandler) collect() status {
+	cfg, gateways := h.runner.running()
+	timeout := cfg.Status.ReadyTimeoutOrDefault()
+	now := h.now()
+
+	st := status{Ready: true, Started: h.started, Gateways: []gatewayStatus{}, Sinks: h.runner.out.Status()}
+	for _, g := range gateways {
+		ws := g.reader.Status()
+		gs := gatewayStatus{
+			Name:      g.name,
+			Connected: ws.Connected,
+			Since:     ws.Since,
+			Ready:     ws.Connected || now.Sub(ws.Since) < timeout,
+		}
+		if !ws.LastEvent.IsZero() {
+			gs.LastEvent = &ws.LastEvent
+		}
+
+		if c, ok := g.sensorProvider.(sensorCacheStatus); ok {
+			n, updated := c.CacheStatus()
+			gs.Sensors = n
+			if !updated.IsZero() {
+				gs.SensorsUpdated = &updated
+				gs.SensorsAgeSecs = int64(now.Sub(updated).Seconds())
+			}
+		}
+
+		st.Ready = st.Ready && gs.Ready
+		st.Gateways = append(st.Gateways, gs)
+	}
+
+	return st
+}
+
+// startStatusServer serves /healthz, /readyz, /status and /metrics on the listen address
+// The server needs to be shut down with stopStatusServer.
+func startStatusServer(listen string, r *websocketRunner) (*http.Server, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for status requests: %s", err)
+	}
+
+	server := &http.Server{Handler: newStatusHandler(r), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			slog.Error(fmt.Sprintf("Status listener failed: %s", err))
+		}
+	}()
+
+	slog.Info(fmt.Sprintf("Serving status on %s", l.Addr()))
+
+	return server, nil
+}
+
+// stopStatusServer shuts the status server down, if it is running
+func stopStatusServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error(fmt.Sprintf("Failed to shut down status listener: %s", err))
+	}
+}
@@ -0,0 +1,82 @@
+package deflux
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/deconz"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"github.com/rvk01/deflux/pkg/sink"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusHandler(t *testing.T) {
+	cfg := &config.Configuration{
+		InfluxDB: config.InfluxDB{URL: "http://localhost:8086", Token: "SECRET", Org: "org", Bucket: "default"},
+		Status:   config.StatusConfig{ReadyTimeout: time.Minute},
+	}
+	out, err := sink.NewReloadable(cfg)
+	if err != nil {
+		t.Fatalf("failed to create sink: %s", err)
+	}
+	defer out.Close()
+
+	sensors := testSensors(time.Now())
+	reader, err := deconz.NewWebsocketEventReader(context.Background(), deconz.API{Config: config.APIConfig{WsAddr: "ws://127.0.0.1:1/"}}, sensors)
+	if err != nil {
+		t.Fatalf("failed to create reader: %s", err)
+	}
+
+	r := &websocketRunner{cfg: cfg, out: out, gateways: []*gateway{{name: "default", reader: reader, sensorProvider: sensors}}}
+	since := reader.Status().Since
+	h := &statusHandler{runner: r, started: since, now: func() time.Time { return since.Add(30 * time.Second) }}
+
+	get := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/", nil))
+		return rec
+	}
+
+	if rec := get(h.healthz); rec.Code != http.StatusOK {
+		t.Errorf("expected healthz to be ok, got %d", rec.Code)
+	}
+
+	// disconnected for less than the ready timeout
+	if rec := get(h.readyz); rec.Code != http.StatusOK {
+		t.Errorf("expected ready, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// disconnected for longer than the ready timeout
+	h.now = func() time.Time { return since.Add(2 * time.Minute) }
+	rec := get(h.readyz)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "gateway default: websocket disconnected for 2m0s") {
+		t.Errorf("expected not ready, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = get(h.status)
+	var st status
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+		t.Fatalf("failed to decode status: %s", err)
+	}
+	if st.Ready || len(st.Gateways) != 1 || st.Gateways[0].Connected || st.Gateways[0].Name != "default" {
+		t.Errorf("unexpected gateway status %+v", st)
+	}
+	if len(st.Sinks) != 1 || st.Sinks[0].Name != config.SinkInfluxDB || st.Sinks[0].WriteErrors != 0 {
+		t.Errorf("unexpected sink status %+v", st.Sinks)
+	}
+}
+
+func TestStatusHandlerMetrics(t *testing.T) {
+	metrics.PointsWritten.WithLabelValues("memory").Inc()
+
+	rec := httptest.NewRecorder()
+	newStatusHandler(&websocketRunner{cfg: &config.Configuration{}}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `deflux_points_written_total{sink="memory"}`) {
+		t.Errorf("expected internal metrics, got %d:\n%s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,94 @@
+// Package metrics holds the self-instrumentation metrics of deflux
+// The metrics are served by the Prometheus sink and the status listener, and can be written as deflux_internal
+// measurement.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons of dropped events
+const (
+	// ReasonDecodeError is an event that could not be decoded
+	ReasonDecodeError = "decode_error"
+	// ReasonUnsupported is an event of a resource or type deflux does not write
+	ReasonUnsupported = "unsupported"
+	// ReasonFiltered is a sensor event excluded by the sensor filters
+	ReasonFiltered = "filtered"
+)
+
+// Registry holds all self-instrumentation metrics
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	// EventsReceived counts the messages received from the deCONZ websockets
+	EventsReceived = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "deflux_events_received_total",
+		Help: "Number of messages received from the deCONZ websocket.",
+	}, []string{"gateway"})
+
+	// EventsDecoded counts the decoded events by resource and type, which is the sensor type for sensor events
+	EventsDecoded = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "deflux_events_decoded_total",
+		Help: "Number of decoded websocket events by resource and sensor type.",
+	}, []string{"gateway", "resource", "type"})
+
+	// EventsDropped counts the events that have not been written by reason and type
+	EventsDropped = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "deflux_events_dropped_total",
+		Help: "Number of websocket events that have not been written, by reason and sensor type or resource.",
+	}, []string{"gateway", "reason", "type"})
+
+	// WebsocketReconnects counts the connections to the deCONZ websocket after the first one
+	WebsocketReconnects = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "deflux_websocket_reconnects_total",
+		Help: "Number of reconnects to the deCONZ websocket.",
+	}, []string{"gateway"})
+
+	// WebsocketConnectErrors counts the failed attempts to connect to the deCONZ websocket
+	WebsocketConnectErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "deflux_websocket_connect_errors_total",
+		Help: "Number of failed attempts to connect to the deCONZ websocket.",
+	}, []string{"gateway"})
+
+	// RESTDuration observes the duration of requests to the deCONZ REST API by endpoint
+	RESTDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "deflux_rest_request_duration_seconds",
+		Help:    "Duration of requests to the deCONZ REST API.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"gateway", "endpoint"})
+
+	// CacheRefreshes counts the refreshes of the sensor, light and group caches by result
+	CacheRefreshes = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "deflux_cache_refreshes_total",
+		Help: "Number of refreshes of the sensor, light and group caches from the REST API.",
+	}, []string{"gateway", "cache", "result"})
+
+	// PointsWritten counts the points written to each sink
+	PointsWritten = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "deflux_points_written_total",
+		Help: "Number of points written to a sink.",
+	}, []string{"sink"})
+
+	// WriteErrors counts the failed writes of each sink
+	WriteErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "deflux_write_errors_total",
+		Help: "Number of failed writes to a sink.",
+	}, []string{"sink"})
+)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Result returns the result label of an operation, "success" or "error"
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,270 @@
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// segmentExt is the file extension of buffer segments
+const segmentExt = ".lp"
+
+// maxSegmentSize is the size in bytes after which a new segment is started
+const maxSegmentSize = 1 << 20
+
+// diskBuffer is a write-ahead buffer persisting InfluxDB line protocol records on disk
+// Records are appended to an active segment file. Sealed segments are read, sent and removed by the InfluxSink.
+// Segments are named after their creation time, so the lexical order of the names is the order of creation.
+// The buffer survives restarts: segments found on disk when the buffer is opened are sealed.
+type diskBuffer struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	now     func() time.Time
+
+	mu         sync.Mutex
+	active     *os.File
+	activeName string
+	activeSize int64
+	// activeCreated is the time the active segment has been created
+	activeCreated time.Time
+}
+
+// openDiskBuffer creates the buffer directory if it does not exist and returns a diskBuffer
+func openDiskBuffer(cfg config.BufferConfig) (*diskBuffer, error) {
+	if err := os.MkdirAll(cfg.DirOrDefault(), 0o750); err != nil {
+		return nil, fmt.Errorf("unable to create buffer directory: %s", err)
+	}
+
+	return &diskBuffer{
+		dir:     cfg.DirOrDefault(),
+		maxSize: cfg.MaxSizeOrDefault(),
+		maxAge:  cfg.MaxAgeOrDefault(),
+		now:     time.Now,
+	}, nil
+}
+
+// Append adds a line protocol record to the active segment
+func (b *diskBuffer) Append(line string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.active == nil {
+		name := b.segmentName()
+		f, err := os.OpenFile(filepath.Join(b.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return fmt.Errorf("unable to create buffer segment: %s", err)
+		}
+		b.active, b.activeName, b.activeSize, b.activeCreated = f, name, 0, b.now()
+	}
+
+	n, err := b.active.WriteString(strings.TrimSuffix(line, "\n") + "\n")
+	b.activeSize += int64(n)
+	if err != nil {
+		return fmt.Errorf("unable to write to buffer segment %s: %s", b.activeName, err)
+	}
+
+	if b.activeSize >= maxSegmentSize {
+		return b.seal()
+	}
+	return nil
+}
+
+// Seal closes the active segment, so it can be sent
+func (b *diskBuffer) Seal() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.seal()
+}
+
+// SealOlder closes the active segment if it has been created at least d ago
+func (b *diskBuffer) SealOlder(d time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.active == nil || b.now().Sub(b.activeCreated) < d {
+		return nil
+	}
+	return b.seal()
+}
+
+func (b *diskBuffer) seal() error {
+	if b.active == nil {
+		return nil
+	}
+
+	f := b.active
+	b.active, b.activeName, b.activeSize = nil, "", 0
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to sync buffer segment: %s", err)
+	}
+	return f.Close()
+}
+
+// segmentName returns a name for a new segment that does not exist yet
+func (b *diskBuffer) segmentName() string {
+	ts := b.now().UnixNano()
+	for {
+		name := fmt.Sprintf("%020d%s", ts, segmentExt)
+		if _, err := os.Stat(filepath.Join(b.dir, name)); os.IsNotExist(err) {
+			return name
+		}
+		ts++
+	}
+}
+
+// Segments returns the names of all sealed segments, oldest first
+func (b *diskBuffer) Segments() ([]string, error) {
+	b.mu.Lock()
+	active := b.activeName
+	b.mu.Unlock()
+
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list buffer segments: %s", err)
+	}
+
+	var segments []string
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != segmentExt || e.Name() == active {
+			continue
+		}
+		segments = append(segments, e.Name())
+	}
+	sort.Strings(segments)
+
+	return segments, nil
+}
+
+// ReadSegment returns the records of a segment sorted by their timestamp
+// Incomplete records, e.g. due to a crash while writing, are skipped.
+func (b *diskBuffer) ReadSegment(name string) ([]string, error) {
+	f, err := os.Open(filepath.Join(b.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open buffer segment: %s", err)
+	}
+	defer f.Close()
+
+	type record struct {
+		line string
+		ts   int64
+	}
+	var records []record
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxSegmentSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		ts, err := recordTimestamp(line)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Skipping invalid record in buffer segment %s: %s", name, err))
+			continue
+		}
+		records = append(records, record{line, ts})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read buffer segment: %s", err)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].ts < records[j].ts
+	})
+
+	lines := make([]string, len(records))
+	for i, r := range records {
+		lines[i] = r.line
+	}
+	return lines, nil
+}
+
+// Remove deletes a segment
+func (b *diskBuffer) Remove(name string) error {
+	return os.Remove(filepath.Join(b.dir, name))
+}
+
+// Size returns the total size in bytes and the number of all segments including the active one
+func (b *diskBuffer) Size() (int64, int, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to list buffer segments: %s", err)
+	}
+
+	var size int64
+	var count int
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != segmentExt {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		size += info.Size()
+		count++
+	}
+	return size, count, nil
+}
+
+// EnforceLimits removes the oldest sealed segments until the buffer is within its size limit,
+// as well as all sealed segments older than the maximum age. It returns the number of removed segments.
+func (b *diskBuffer) EnforceLimits() (int, error) {
+	segments, err := b.Segments()
+	if err != nil {
+		return 0, err
+	}
+
+	size, _, err := b.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	oldest := b.now().Add(-b.maxAge).UnixNano()
+	for _, name := range segments {
+		created, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if size <= b.maxSize && created >= oldest {
+			break
+		}
+
+		info, err := os.Stat(filepath.Join(b.dir, name))
+		if err != nil {
+			continue
+		}
+		if err := b.Remove(name); err != nil {
+			return removed, fmt.Errorf("unable to remove buffer segment: %s", err)
+		}
+		size -= info.Size()
+		removed++
+	}
+
+	return removed, nil
+}
+
+// Close closes the active segment
+func (b *diskBuffer) Close() error {
+	return b.Seal()
+}
+
+// recordTimestamp returns the timestamp of a line protocol record, which is the last element of the line
+func recordTimestamp(line string) (int64, error) {
+	i := strings.LastIndexByte(line, ' ')
+	if i < 0 {
+		return 0, fmt.Errorf("no timestamp in %q", line)
+	}
+	return strconv.ParseInt(line[i+1:], 10, 64)
+}
@@ -0,0 +1,264 @@
+package sink
+
+import (
+	"github.com/rvk01/deflux/pkg/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskBuffer(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2022, 1, 9, 18, 0, 0, 0, time.UTC)
+
+	b, err := openDiskBuffer(config.BufferConfig{Dir: dir, MaxSize: 1 << 20, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to open buffer: %s", err)
+	}
+	b.now = func() time.Time { return now }
+
+	for _, line := range []string{"m v=2i 2000", "m v=1i 1000", "m v=3i 3000\n"} {
+		if err := b.Append(line); err != nil {
+			t.Fatalf("failed to append: %s", err)
+		}
+	}
+
+	// the active segment is not returned
+	if segments, _ := b.Segments(); len(segments) != 0 {
+		t.Fatalf("expected no sealed segments, got %v", segments)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("failed to close buffer: %s", err)
+	}
+
+	// segments survive reopening the buffer
+	b, err = openDiskBuffer(config.BufferConfig{Dir: dir, MaxSize: 1 << 20, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to reopen buffer: %s", err)
+	}
+	b.now = func() time.Time { return now.Add(time.Minute) }
+
+	segments, err := b.Segments()
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("expected 1 segment, got %v (%v)", segments, err)
+	}
+
+	lines, err := b.ReadSegment(segments[0])
+	if err != nil {
+		t.Fatalf("failed to read segment: %s", err)
+	}
+	want := []string{"m v=1i 1000", "m v=2i 2000", "m v=3i 3000"}
+	if !reflect.DeepEqual(want, lines) {
+		t.Fatalf("expected %v, got %v", want, lines)
+	}
+
+	// a second segment, the first one expires
+	b.now = func() time.Time { return now.Add(30 * time.Minute) }
+	if err := b.Append("m v=4i 4000"); err != nil {
+		t.Fatalf("failed to append: %s", err)
+	}
+	if err := b.Seal(); err != nil {
+		t.Fatalf("failed to seal: %s", err)
+	}
+
+	b.now = func() time.Time { return now.Add(70 * time.Minute) }
+	removed, err := b.EnforceLimits()
+	if err != nil || removed != 1 {
+		t.Fatalf("expected 1 removed segment, got %d (%v)", removed, err)
+	}
+
+	// the remaining segment exceeds the size limit
+	b.maxSize = 1
+	removed, err = b.EnforceLimits()
+	if err != nil || removed != 1 {
+		t.Fatalf("expected 1 removed segment, got %d (%v)", removed, err)
+	}
+	if size, count, _ := b.Size(); size != 0 || count != 0 {
+		t.Fatalf("expected empty buffer, got %d segments with %d bytes", count, size)
+	}
+}
+
+func TestDiskBufferSealOlder(t *testing.T) {
+	now := time.Date(2022, 1, 9, 18, 0, 0, 0, time.UTC)
+
+	b, err := openDiskBuffer(config.BufferConfig{Dir: t.TempDir(), MaxSize: 1 << 20, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to open buffer: %s", err)
+	}
+	defer b.Close()
+	b.now = func() time.Time { return now }
+
+	// no active segment
+	if err := b.SealOlder(0); err != nil {
+		t.Fatalf("failed to seal: %s", err)
+	}
+
+	if err := b.Append("m v=1i 1000"); err != nil {
+		t.Fatalf("failed to append: %s", err)
+	}
+	b.now = func() time.Time { return now.Add(5 * time.Second) }
+	if err := b.SealOlder(10 * time.Second); err != nil {
+		t.Fatalf("failed to seal: %s", err)
+	}
+	if segments, _ := b.Segments(); len(segments) != 0 {
+		t.Fatalf("expected the active segment not to be sealed, got %v", segments)
+	}
+
+	b.now = func() time.Time { return now.Add(10 * time.Second) }
+	if err := b.SealOlder(10 * time.Second); err != nil {
+		t.Fatalf("failed to seal: %s", err)
+	}
+	if segments, _ := b.Segments(); len(segments) != 1 {
+		t.Fatalf("expected the active segment to be sealed, got %v", segments)
+	}
+}
+
+// fakeInfluxDB accepts line protocol writes if it is up
+// Requests containing reject are rejected as bad request.
+type fakeInfluxDB struct {
+	mu     sync.Mutex
+	up     bool
+	reject string
+	lines  []string
+}
+
+func (f *fakeInfluxDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.up {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	if f.reject != "" && strings.Contains(string(body), f.reject) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, l := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		f.lines = append(f.lines, l)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeInfluxDB) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.lines...)
+}
+
+func TestBufferedInfluxSink(t *testing.T) {
+	influx := &fakeInfluxDB{}
+	ts := httptest.NewServer(influx)
+	defer ts.Close()
+
+	cfg := &config.Configuration{InfluxDB: config.InfluxDB{
+		URL:    ts.URL,
+		Token:  "token",
+		Org:    "org",
+		Bucket: "bucket",
+		Buffer: config.BufferConfig{Enabled: true, Dir: t.TempDir()},
+	}}
+
+	s, err := NewInfluxSink(cfg)
+	if err != nil {
+		t.Fatalf("failed to create sink: %s", err)
+	}
+
+	tags := map[string]string{"id": "1"}
+	for _, sec := range []int64{20, 10} {
+		if err := s.Write("deflux_test", tags, map[string]interface{}{"v": sec}, time.Unix(sec, 0)); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+
+	// InfluxDB is down, the points stay in the buffer across restarts
+	if err := s.Flush(); err == nil {
+		t.Fatalf("expected flush to fail")
+	}
+	if err := s.Close(); err == nil {
+		t.Fatalf("expected close to fail")
+	}
+
+	influx.mu.Lock()
+	influx.up = true
+	influx.mu.Unlock()
+
+	s, err = NewInfluxSink(cfg)
+	if err != nil {
+		t.Fatalf("failed to create sink: %s", err)
+	}
+	if err := s.Write("deflux_test", tags, map[string]interface{}{"v": int64(30)}, time.Unix(30, 0)); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	want := []string{
+		"deflux_test,id=1 v=10i 10000000000",
+		"deflux_test,id=1 v=20i 20000000000",
+		"deflux_test,id=1 v=30i 30000000000",
+	}
+	if got := influx.received(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestBufferedInfluxSinkRejectedBatch(t *testing.T) {
+	influx := &fakeInfluxDB{up: true, reject: "v=-1i"}
+	ts := httptest.NewServer(influx)
+	defer ts.Close()
+
+	cfg := &config.Configuration{InfluxDB: config.InfluxDB{
+		URL:    ts.URL,
+		Token:  "token",
+		Org:    "org",
+		Bucket: "bucket",
+		Buffer: config.BufferConfig{Enabled: true, Dir: t.TempDir()},
+	}}
+
+	s, err := NewInfluxSink(cfg)
+	if err != nil {
+		t.Fatalf("failed to create sink: %s", err)
+	}
+
+	// three batches, the first one holds a point that is rejected
+	tags := map[string]string{"id": "1"}
+	for sec := int64(1); sec <= 2*bufferBatchSize+200; sec++ {
+		v := sec
+		if sec == 10 {
+			v = -1
+		}
+		if err := s.Write("deflux_test", tags, map[string]interface{}{"v": v}, time.Unix(sec, 0)); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+
+	if err := s.Flush(); err == nil {
+		t.Fatalf("expected flush to report the rejected batch")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	got := influx.received()
+	if len(got) != bufferBatchSize+200 {
+		t.Fatalf("expected the %d points of the other batches, got %d", bufferBatchSize+200, len(got))
+	}
+	if want := "deflux_test,id=1 v=501i 501000000000"; got[0] != want {
+		t.Errorf("expected the second batch first, got %s", got[0])
+	}
+	if size, count, _ := s.buffer.Size(); size != 0 || count != 0 {
+		t.Errorf("expected empty buffer, got %d segments with %d bytes", count, size)
+	}
+}
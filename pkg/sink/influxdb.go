@@ -1,59 +1,401 @@
 package sink
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/rvk01/deflux/pkg/config"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"log/slog"
+	"sync"
 	"time"
 )
 
+const (
+	// bufferSendInterval is the interval in which buffered points are sent to InfluxDB
+	bufferSendInterval = 1 * time.Second
+	// bufferSealAge is the age after which the active segment is sealed, so its points are sent. Segments are sealed
+	// earlier when they reach their maximum size or the sink is flushed.
+	bufferSealAge = 10 * time.Second
+	// bufferRetryMin is the initial delay before sending buffered points is retried after a failure
+	bufferRetryMin = 1 * time.Second
+	// bufferRetryMax is the maximum delay between retries
+	bufferRetryMax = 5 * time.Minute
+	// bufferBatchSize is the number of records sent to InfluxDB in a single request
+	bufferBatchSize = 500
+	// bufferWriteTimeout is the timeout of a single write request
+	bufferWriteTimeout = 30 * time.Second
+)
+
 // InfluxSink writes data to InfluxDB
+// If the disk buffer is enabled, points are persisted on disk and sent by a background go routine.
+// Otherwise, points are written by the non-blocking write API of the InfluxDB client.
 type InfluxSink struct {
 	client influxdb2.Client
 	writer api.WriteAPI
+
+	// errors of the asynchronous writer since the last Flush() or Close()
+	mu   sync.Mutex
+	errs []error
+	// writeErrors counts all write errors, lastError is the most recent one
+	writeErrors uint64
+	lastError   error
+
+	// errorsDone is closed when all errors of the writer have been consumed
+	errorsDone chan struct{}
+	closeOnce  sync.Once
+
+	// buffer holds points until they have been sent with the blocking writer
+	buffer   *diskBuffer
+	blocking api.WriteAPIBlocking
+	flushReq chan chan error
+	stop     chan struct{}
+	sendDone chan struct{}
 }
 
 // NewInfluxSink returns a new instance of InfluxSink
 // The instance needs to be closed with Close()
-func NewInfluxSink(cfg *config.Configuration) *InfluxSink {
+func NewInfluxSink(cfg *config.Configuration) (*InfluxSink, error) {
+	tlsConfig, err := cfg.InfluxDB.TLS.Config()
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB TLS settings: %s", err)
+	}
+
 	influxClient := influxdb2.NewClientWithOptions(
 		cfg.InfluxDB.URL,
 		cfg.InfluxDB.Token,
-		influxdb2.DefaultOptions().SetBatchSize(20))
+		influxdb2.DefaultOptions().SetBatchSize(20).SetTLSConfig(tlsConfig))
+
+	if cfg.InfluxDB.Buffer.Enabled {
+		return newBufferedInfluxSink(cfg, influxClient)
+	}
 
 	// Get non-blocking write client
 	writeAPI := influxClient.WriteAPI(cfg.InfluxDB.Org, cfg.InfluxDB.Bucket)
-	// Get errors channel
-	errorsCh := writeAPI.Errors()
+
+	i := &InfluxSink{
+		client:     influxClient,
+		writer:     writeAPI,
+		errorsDone: make(chan struct{}),
+	}
 
 	// read and log errors in a separate go routine
-	go func() {
+	// the channel is closed when the client is closed
+	go func(errorsCh <-chan error) {
+		defer close(i.errorsDone)
 		for err := range errorsCh {
-			fmt.Printf("write error: %s\n", err.Error())
+			slog.Error(fmt.Sprintf("InfluxDB write error: %s", err))
+			i.addError(err)
 		}
-	}()
+	}(writeAPI.Errors())
+
+	return i, nil
+}
+
+// CheckInfluxDB checks that InfluxDB is reachable and, for InfluxDB v2, that the bucket exists and is accessible
+// with the token. The database of InfluxDB v1 is not checked.
+func CheckInfluxDB(ctx context.Context, cfg config.InfluxDB) error {
+	tlsConfig, err := cfg.TLS.Config()
+	if err != nil {
+		return fmt.Errorf("invalid TLS settings: %s", err)
+	}
+
+	client := influxdb2.NewClientWithOptions(cfg.URL, cfg.Token, influxdb2.DefaultOptions().SetTLSConfig(tlsConfig))
+	defer client.Close()
+
+	ok, err := client.Ping(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to reach InfluxDB at %s: %s", cfg.URL, err)
+	}
+	if !ok {
+		return fmt.Errorf("InfluxDB at %s is not ready", cfg.URL)
+	}
+
+	if cfg.Org == "" {
+		return nil
+	}
+
+	if _, err := client.BucketsAPI().FindBucketByName(ctx, cfg.Bucket); err != nil {
+		return fmt.Errorf("unable to find bucket %s: %s", cfg.Bucket, err)
+	}
+
+	return nil
+}
+
+// newBufferedInfluxSink returns an InfluxSink that persists points in the disk buffer before sending them
+func newBufferedInfluxSink(cfg *config.Configuration, influxClient influxdb2.Client) (*InfluxSink, error) {
+	buffer, err := openDiskBuffer(cfg.InfluxDB.Buffer)
+	if err != nil {
+		influxClient.Close()
+		return nil, err
+	}
+
+	i := &InfluxSink{
+		client:   influxClient,
+		blocking: influxClient.WriteAPIBlocking(cfg.InfluxDB.Org, cfg.InfluxDB.Bucket),
+		buffer:   buffer,
+		flushReq: make(chan chan error),
+		stop:     make(chan struct{}),
+		sendDone: make(chan struct{}),
+	}
 
-	return &InfluxSink{
-		client: influxClient,
-		writer: writeAPI,
+	if size, count, err := buffer.Size(); err == nil && count > 0 {
+		slog.Info(fmt.Sprintf("Replaying %d buffered segments (%d bytes) from %s", count, size, buffer.dir))
 	}
+
+	go i.sendLoop()
+
+	return i, nil
 }
 
 // Write persists a data point to InfluxDB
-// It takes the table name, tags and fields and the time as arguments
-func (i *InfluxSink) Write(table string, tags map[string]string, fields map[string]interface{}, t time.Time) {
-	i.writer.WritePoint(influxdb2.NewPoint(
-		table,
+// Points are written asynchronously. Write errors are reported by Flush() and Close().
+func (i *InfluxSink) Write(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) error {
+	fields = dataFields(fields)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	p := influxdb2.NewPoint(
+		measurement,
 		tags,
 		fields,
 		t,
-	))
+	)
+
+	if i.buffer != nil {
+		return i.buffer.Append(write.PointToLineProtocol(p, time.Nanosecond))
+	}
+
+	i.writer.WritePoint(p)
+	return nil
+}
+
+// Flush writes all buffered points and returns the errors that occurred since the last call
+func (i *InfluxSink) Flush() error {
+	if i.buffer != nil {
+		reply := make(chan error, 1)
+		select {
+		case i.flushReq <- reply:
+			if err := <-reply; err != nil {
+				i.addError(err)
+			}
+		case <-i.sendDone:
+		}
+		return i.takeErrors()
+	}
+
+	i.writer.Flush()
+	return i.takeErrors()
 }
 
 // Close closes the InfluxSink
-func (i *InfluxSink) Close() {
-	// FIXME panics 'send on closed channel'
-	// i.writer.Flush()
-	i.client.Close()
+// Buffered points are written before the connection is closed. Points that cannot be written remain in the
+// disk buffer, if it is enabled. It is safe to call Close more than once.
+func (i *InfluxSink) Close() error {
+	i.closeOnce.Do(func() {
+		if i.buffer != nil {
+			close(i.stop)
+			<-i.sendDone
+
+			// one last attempt to send everything
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := i.buffer.Seal(); err != nil {
+				i.addError(err)
+			} else if err := i.sendBuffered(ctx); err != nil {
+				i.addError(err)
+			}
+			cancel()
+
+			if err := i.buffer.Close(); err != nil {
+				i.addError(err)
+			}
+			i.client.Close()
+			return
+		}
+
+		// closing the client flushes and closes the writer, which closes the errors channel
+		i.client.Close()
+		<-i.errorsDone
+	})
+	return i.takeErrors()
+}
+
+// sendLoop periodically sends the buffered points to InfluxDB
+// When sending fails, it retries with exponential backoff.
+func (i *InfluxSink) sendLoop() {
+	defer close(i.sendDone)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-i.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	wait := bufferSendInterval
+	retry := time.Duration(0)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		var reply chan error
+
+		select {
+		case <-i.stop:
+			return
+		case reply = <-i.flushReq:
+		case <-timer.C:
+		}
+
+		// a flush sends all points, otherwise the active segment is sealed once it is old enough
+		var err error
+		if reply != nil {
+			err = i.buffer.Seal()
+		} else {
+			err = i.buffer.SealOlder(bufferSealAge)
+		}
+		if err == nil {
+			err = i.sendBuffered(ctx)
+		}
+		if reply != nil {
+			reply <- err
+		}
+
+		if err != nil {
+			if retry == 0 {
+				retry = bufferRetryMin
+			} else if retry *= 2; retry > bufferRetryMax {
+				retry = bufferRetryMax
+			}
+			wait = retry
+			slog.Warn(fmt.Sprintf("Failed to send buffered points to InfluxDB, retrying in %s: %s", wait, err))
+		} else {
+			if retry != 0 {
+				slog.Info("Sending buffered points to InfluxDB succeeded")
+			}
+			retry = 0
+			wait = bufferSendInterval
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// sendBuffered sends all sealed segments of the buffer to InfluxDB, oldest first
+// Segments are removed once they have been written. Batches rejected by InfluxDB are dropped, the remaining batches
+// of the segment are still sent.
+func (i *InfluxSink) sendBuffered(ctx context.Context) error {
+	if removed, err := i.buffer.EnforceLimits(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to enforce buffer limits: %s", err))
+	} else if removed > 0 {
+		slog.Warn(fmt.Sprintf("Dropped %d buffered segments exceeding the buffer's size or age limit", removed))
+	}
+
+	segments, err := i.buffer.Segments()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range segments {
+		lines, err := i.buffer.ReadSegment(name)
+		if err != nil {
+			return err
+		}
+
+		for start := 0; start < len(lines); start += bufferBatchSize {
+			end := start + bufferBatchSize
+			if end > len(lines) {
+				end = len(lines)
+			}
+
+			wctx, cancel := context.WithTimeout(ctx, bufferWriteTimeout)
+			err := i.blocking.WriteRecord(wctx, lines[start:end]...)
+			cancel()
+
+			if err != nil && !isPermanent(err) {
+				return err
+			}
+			if err != nil {
+				slog.Error(fmt.Sprintf("InfluxDB rejected %d records of buffered segment %s, dropping them: %s",
+					end-start, name, err))
+				i.addError(err)
+			}
+		}
+
+		if err := i.buffer.Remove(name); err != nil {
+			return fmt.Errorf("unable to remove buffer segment: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// isPermanent returns true if InfluxDB rejected a write request, so it must not be retried
+func isPermanent(err error) bool {
+	var httpErr *http.Error
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+
+	return httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 && httpErr.StatusCode != 429 &&
+		httpErr.StatusCode != 401 && httpErr.StatusCode != 403
+}
+
+// addError records a write error
+func (i *InfluxSink) addError(err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.errs = append(i.errs, err)
+	i.writeErrors++
+	i.lastError = err
+	metrics.WriteErrors.WithLabelValues(config.SinkInfluxDB).Inc()
+}
+
+// status returns the size of the disk buffer and the write errors since the sink has been created
+func (i *InfluxSink) status() Status {
+	st := Status{Name: config.SinkInfluxDB}
+	if i.buffer != nil {
+		if size, _, err := i.buffer.Size(); err == nil {
+			st.BacklogBytes = size
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	st.WriteErrors = i.writeErrors
+	if i.lastError != nil {
+		st.LastError = i.lastError.Error()
+	}
+
+	return st
+}
+
+// takeErrors returns the collected write errors and resets them
+func (i *InfluxSink) takeErrors() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.errs) == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("%d InfluxDB write error(s), last: %s", len(i.errs), i.errs[len(i.errs)-1])
+	i.errs = nil
+	return err
 }
@@ -0,0 +1,76 @@
+package sink
+
+import (
+	"sync"
+	"time"
+)
+
+// Point is a data point as it was written to a Sink
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// MemorySink keeps all data points in memory
+// It is intended for tests and debugging.
+type MemorySink struct {
+	mu     sync.Mutex
+	points []Point
+	closed bool
+}
+
+// NewMemorySink returns an empty MemorySink
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// Write appends the data point to the in-memory list of points
+func (m *MemorySink) Write(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) error {
+	fields = dataFields(fields)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.points = append(m.points, Point{
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        t,
+	})
+	return nil
+}
+
+// Flush does nothing, all points are written immediately
+func (m *MemorySink) Flush() error {
+	return nil
+}
+
+// Close marks the MemorySink as closed; points are retained
+func (m *MemorySink) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	return nil
+}
+
+// Points returns a copy of all points written so far
+func (m *MemorySink) Points() []Point {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Point(nil), m.points...)
+}
+
+// Closed returns true if Close has been called
+func (m *MemorySink) Closed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.closed
+}
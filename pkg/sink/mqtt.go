@@ -0,0 +1,432 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mqttTimeout is the maximum duration to wait for the broker to acknowledge a connection or message
+const mqttTimeout = 10 * time.Second
+
+// mqttQueueSize is the number of messages queued for publishing, further messages are dropped
+const mqttQueueSize = 1024
+
+// mqttPublisher publishes messages to an MQTT broker
+type mqttPublisher interface {
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+	Disconnect()
+}
+
+// mqttMessage is a message queued for publishing
+type mqttMessage struct {
+	topic    string
+	retained bool
+	payload  []byte
+	// failed is called if publishing the queued message fails, if it is set
+	failed func()
+	// flushed is closed when the message is taken from the queue, it marks a Flush() without publishing anything
+	flushed chan struct{}
+}
+
+// MQTTSink publishes data points to an MQTT broker
+// Each sensor gets its own topic <topic>/<gateway>/<measurement>/<id>, e.g. deflux/default/ZHATemperature/1. The
+// gateway is omitted for points without gateway tag. The payload is a JSON
+// object containing fields, tags and the time of the point.
+// Optionally, Home Assistant MQTT discovery configs are published for known sensor types.
+// Messages are published in order by a background go routine, so writes do not wait for the broker. Publish errors
+// are reported by Flush() and Close().
+type MQTTSink struct {
+	cfg       config.MQTT
+	publisher mqttPublisher
+
+	queue chan mqttMessage
+	// stop is closed by Close(), done is closed when the queued messages have been published
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// discovered holds the names of entities with published discovery config, indexed by unique id
+	mu         sync.Mutex
+	discovered map[string]string
+
+	// errs are the publish errors since the last Flush() or Close()
+	errs []error
+	// writeErrors counts all publish errors, lastError is the most recent one
+	writeErrors uint64
+	lastError   error
+}
+
+// NewMQTTSink connects to the configured MQTT broker and returns a new MQTTSink
+// The instance needs to be closed with Close()
+func NewMQTTSink(cfg *config.Configuration) (*MQTTSink, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTT.Broker).
+		SetClientID(cfg.MQTT.ClientIDOrDefault()).
+		SetUsername(cfg.MQTT.Username).
+		SetPassword(cfg.MQTT.Password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(mqttTimeout).
+		SetWriteTimeout(mqttTimeout).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn(fmt.Sprintf("MQTT connection lost: %s", err))
+		}).
+		SetOnConnectHandler(func(_ mqtt.Client) {
+			slog.Info(fmt.Sprintf("MQTT connected to %s", cfg.MQTT.Broker))
+		})
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		return nil, fmt.Errorf("unable to connect to MQTT broker %s: timeout", cfg.MQTT.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("unable to connect to MQTT broker %s: %s", cfg.MQTT.Broker, err)
+	}
+
+	return newMQTTSink(cfg.MQTT, pahoPublisher{client: client, timeout: mqttTimeout}), nil
+}
+
+func newMQTTSink(cfg config.MQTT, p mqttPublisher) *MQTTSink {
+	m := &MQTTSink{
+		cfg:        cfg,
+		publisher:  p,
+		queue:      make(chan mqttMessage, mqttQueueSize),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		discovered: make(map[string]string),
+	}
+
+	go m.publishLoop()
+
+	return m
+}
+
+// Write queues the data point for publishing as retained JSON message on the sensor's topic
+// It returns an error if the queue is full, e.g. because the broker is not reachable.
+func (m *MQTTSink) Write(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) error {
+	fields = dataFields(fields)
+	if len(fields) == 0 {
+		return nil
+	}
+	topic := m.stateTopic(measurement, tags)
+
+	payload := make(map[string]interface{}, len(fields)+len(tags)+1)
+	for k, v := range tags {
+		payload[k] = v
+	}
+	for k, v := range fields {
+		payload[k] = v
+	}
+	payload["time"] = t.UTC().Format(time.RFC3339Nano)
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("unable to marshal MQTT payload: %s", err)
+	}
+
+	if m.cfg.Discovery {
+		if err := m.publishDiscovery(topic, tags, fields); err != nil {
+			return err
+		}
+	}
+
+	return m.enqueue(mqttMessage{topic: topic, retained: m.cfg.Retain, payload: b})
+}
+
+// enqueue queues a message for publishing without waiting
+func (m *MQTTSink) enqueue(msg mqttMessage) error {
+	select {
+	case <-m.stop:
+		return fmt.Errorf("unable to publish to %s: sink is closed", msg.topic)
+	default:
+	}
+
+	select {
+	case m.queue <- msg:
+		return nil
+	default:
+		return fmt.Errorf("unable to publish to %s: %d messages are queued already", msg.topic, mqttQueueSize)
+	}
+}
+
+// publishLoop publishes the queued messages until the sink is closed, then it publishes the remaining messages
+func (m *MQTTSink) publishLoop() {
+	defer close(m.done)
+
+	for {
+		select {
+		case msg := <-m.queue:
+			m.publish(msg)
+		case <-m.stop:
+			for {
+				select {
+				case msg := <-m.queue:
+					m.publish(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// publish publishes a queued message and records the error if it fails
+func (m *MQTTSink) publish(msg mqttMessage) {
+	if msg.flushed != nil {
+		close(msg.flushed)
+		return
+	}
+
+	err := m.publisher.Publish(msg.topic, m.cfg.QoS, msg.retained, msg.payload)
+	if err == nil {
+		return
+	}
+
+	slog.Warn(fmt.Sprintf("MQTT publish failed: %s", err))
+	if msg.failed != nil {
+		msg.failed()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.errs = append(m.errs, err)
+	m.writeErrors++
+	m.lastError = err
+	metrics.WriteErrors.WithLabelValues(config.SinkMQTT).Inc()
+}
+
+// Flush waits until the messages queued so far have been published, at most mqttTimeout, and returns the publish
+// errors that occurred since the last call
+func (m *MQTTSink) Flush() error {
+	flushed := make(chan struct{})
+	timeout := time.NewTimer(mqttTimeout)
+	defer timeout.Stop()
+
+	var err error
+	select {
+	case m.queue <- mqttMessage{flushed: flushed}:
+		select {
+		case <-flushed:
+		case <-m.done:
+		case <-timeout.C:
+			err = errors.New("timeout waiting for queued MQTT messages to be published")
+		}
+	case <-m.done:
+	case <-timeout.C:
+		err = errors.New("timeout waiting for queued MQTT messages to be published")
+	}
+
+	return errors.Join(err, m.takeErrors())
+}
+
+// Close publishes the queued messages, waiting at most mqttTimeout, and disconnects from the broker
+// It is safe to call Close more than once.
+func (m *MQTTSink) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+
+		timeout := time.NewTimer(mqttTimeout)
+		select {
+		case <-m.done:
+		case <-timeout.C:
+			slog.Warn("Timeout publishing the queued MQTT messages, disconnecting")
+		}
+		timeout.Stop()
+
+		// the remaining messages fail once the client is disconnected
+		m.publisher.Disconnect()
+		<-m.done
+	})
+
+	return m.takeErrors()
+}
+
+// status returns the publish errors since the sink has been created
+func (m *MQTTSink) status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := Status{Name: config.SinkMQTT, WriteErrors: m.writeErrors}
+	if m.lastError != nil {
+		st.LastError = m.lastError.Error()
+	}
+
+	return st
+}
+
+// takeErrors returns the collected publish errors and resets them
+func (m *MQTTSink) takeErrors() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.errs) == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("%d MQTT publish error(s), last: %s", len(m.errs), m.errs[len(m.errs)-1])
+	m.errs = nil
+	return err
+}
+
+// stateTopic returns the topic for a measurement of a sensor
+func (m *MQTTSink) stateTopic(measurement string, tags map[string]string) string {
+	parts := []string{m.cfg.TopicOrDefault()}
+	if gw, ok := tags["gateway"]; ok {
+		parts = append(parts, gw)
+	}
+	parts = append(parts, strings.TrimPrefix(measurement, "deflux_"))
+	if id, ok := tags["id"]; ok {
+		parts = append(parts, id)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// haEntity describes how a field is represented in Home Assistant
+type haEntity struct {
+	field       string
+	component   string
+	deviceClass string
+	unit        string
+	stateClass  string
+}
+
+// haEntities maps sensor types to Home Assistant entities
+var haEntities = map[string][]haEntity{
+	"CLIPPresence":      {{field: "presence", component: "binary_sensor", deviceClass: "occupancy"}},
+	"ZHAAirQuality":     {{field: "airqualityppb", component: "sensor", deviceClass: "volatile_organic_compounds_parts", unit: "ppb", stateClass: "measurement"}},
+	"ZHAAlarm":          {{field: "alarm", component: "binary_sensor", deviceClass: "safety"}},
+	"ZHACarbonMonoxide": {{field: "carbonmonoxide", component: "binary_sensor", deviceClass: "carbon_monoxide"}},
+	"ZHAConsumption":    {{field: "consumption", component: "sensor", deviceClass: "energy", unit: "Wh", stateClass: "total_increasing"}},
+	"ZHAFire":           {{field: "fire", component: "binary_sensor", deviceClass: "smoke"}},
+	"ZHAHumidity":       {{field: "humidity", component: "sensor", deviceClass: "humidity", unit: "%", stateClass: "measurement"}},
+	"ZHALightLevel":     {{field: "lux", component: "sensor", deviceClass: "illuminance", unit: "lx", stateClass: "measurement"}},
+	"ZHAOpenClose":      {{field: "open", component: "binary_sensor", deviceClass: "door"}},
+	"ZHAPower": {
+		{field: "power", component: "sensor", deviceClass: "power", unit: "W", stateClass: "measurement"},
+		{field: "voltage", component: "sensor", deviceClass: "voltage", unit: "V", stateClass: "measurement"},
+		{field: "current", component: "sensor", deviceClass: "current", unit: "mA", stateClass: "measurement"},
+	},
+	"ZHAPresence":    {{field: "presence", component: "binary_sensor", deviceClass: "motion"}},
+	"ZHAPressure":    {{field: "pressure", component: "sensor", deviceClass: "pressure", unit: "hPa", stateClass: "measurement"}},
+	"ZHATemperature": {{field: "temperature", component: "sensor", deviceClass: "temperature", unit: "°C", stateClass: "measurement"}},
+	"ZHAVibration":   {{field: "vibration", component: "binary_sensor", deviceClass: "vibration"}},
+	"ZHAWater":       {{field: "water", component: "binary_sensor", deviceClass: "moisture"}},
+}
+
+// batteryEntity is added for all sensors reporting a battery level
+var batteryEntity = haEntity{field: "battery", component: "sensor", deviceClass: "battery", unit: "%", stateClass: "measurement"}
+
+// publishDiscovery publishes Home Assistant discovery configs for all entities of a sensor that
+// have not been published before
+func (m *MQTTSink) publishDiscovery(stateTopic string, tags map[string]string, fields map[string]interface{}) error {
+	entities := haEntities[tags["type"]]
+	if battery, ok := toFloat(fields["battery"]); ok && battery > 0 {
+		entities = append(entities, batteryEntity)
+	}
+
+	objectPrefix := strings.ReplaceAll(stateTopic, "/", "_")
+	name := tags["name"]
+
+	var errs []error
+	for _, e := range entities {
+		if _, ok := fields[e.field]; !ok {
+			continue
+		}
+
+		uniqueID := fmt.Sprintf("%s_%s", objectPrefix, e.field)
+
+		m.mu.Lock()
+		published := m.discovered[uniqueID] == name
+		m.mu.Unlock()
+		if published {
+			continue
+		}
+
+		payload := map[string]interface{}{
+			"name":        fmt.Sprintf("%s %s", name, e.field),
+			"unique_id":   uniqueID,
+			"object_id":   uniqueID,
+			"state_topic": stateTopic,
+			"device": map[string]interface{}{
+				"identifiers":  []string{objectPrefix},
+				"name":         name,
+				"model":        tags["type"],
+				"manufacturer": "deflux",
+			},
+		}
+		if e.component == "binary_sensor" {
+			payload["value_template"] = fmt.Sprintf("{{ 'ON' if value_json.%s else 'OFF' }}", e.field)
+		} else {
+			payload["value_template"] = fmt.Sprintf("{{ value_json.%s }}", e.field)
+		}
+		if e.deviceClass != "" {
+			payload["device_class"] = e.deviceClass
+		}
+		if e.unit != "" {
+			payload["unit_of_measurement"] = e.unit
+		}
+		if e.stateClass != "" {
+			payload["state_class"] = e.stateClass
+		}
+
+		b, err := json.Marshal(payload)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to marshal discovery config: %s", err))
+			continue
+		}
+
+		// the config is published again with the next write if publishing fails
+		m.mu.Lock()
+		m.discovered[uniqueID] = name
+		m.mu.Unlock()
+		failed := func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if m.discovered[uniqueID] == name {
+				delete(m.discovered, uniqueID)
+			}
+		}
+
+		topic := fmt.Sprintf("%s/%s/%s/config", m.cfg.DiscoveryPrefixOrDefault(), e.component, uniqueID)
+		if err := m.enqueue(mqttMessage{topic: topic, retained: true, payload: b, failed: failed}); err != nil {
+			failed()
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// pahoPublisher is a mqttPublisher using the Eclipse Paho MQTT client
+type pahoPublisher struct {
+	client mqtt.Client
+	// timeout is the maximum duration to wait until a message is sent
+	timeout time.Duration
+}
+
+// Publish publishes a message and waits until it is sent, at most the timeout
+func (p pahoPublisher) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	token := p.client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(p.timeout) {
+		return fmt.Errorf("unable to publish to %s: timeout", topic)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("unable to publish to %s: %s", topic, err)
+	}
+	return nil
+}
+
+// Disconnect disconnects from the broker, waiting at most 250ms for outstanding messages
+func (p pahoPublisher) Disconnect() {
+	p.client.Disconnect(250)
+}
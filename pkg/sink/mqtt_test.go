@@ -0,0 +1,262 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rvk01/deflux/pkg/config"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type message struct {
+	topic    string
+	retained bool
+	payload  map[string]interface{}
+}
+
+type fakePublisher struct {
+	mu       sync.Mutex
+	messages []message
+}
+
+func (f *fakePublisher) Publish(topic string, _ byte, retained bool, payload []byte) error {
+	var p map[string]interface{}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, message{topic: topic, retained: retained, payload: p})
+	return nil
+}
+
+func (f *fakePublisher) Disconnect() {}
+
+var mqttTestTime = time.Date(2022, 1, 9, 18, 12, 29, 0, time.UTC)
+
+func TestMQTTSink(t *testing.T) {
+	p := &fakePublisher{}
+	m := newMQTTSink(config.MQTT{Retain: true, Discovery: true}, p)
+
+	tags := map[string]string{"name": "wi-wc", "type": "ZHAOpenClose", "id": "5", "source": "websocket"}
+	fields := map[string]interface{}{"open": true, "tampered": false, "battery": 91}
+
+	defer m.Close()
+
+	// write twice, discovery configs must only be sent once
+	for i := 0; i < 2; i++ {
+		if err := m.Write("deflux_ZHAOpenClose", tags, fields, mqttTestTime); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	if len(p.messages) != 4 {
+		t.Fatalf("expected 4 messages, got %d: %v", len(p.messages), p.messages)
+	}
+
+	door := p.messages[0]
+	if door.topic != "homeassistant/binary_sensor/deflux_ZHAOpenClose_5_open/config" || !door.retained {
+		t.Fatalf("unexpected discovery message: %v", door)
+	}
+	if door.payload["device_class"] != "door" ||
+		door.payload["state_topic"] != "deflux/ZHAOpenClose/5" ||
+		door.payload["value_template"] != "{{ 'ON' if value_json.open else 'OFF' }}" {
+		t.Fatalf("unexpected discovery config: %v", door.payload)
+	}
+
+	battery := p.messages[1]
+	if battery.topic != "homeassistant/sensor/deflux_ZHAOpenClose_5_battery/config" ||
+		battery.payload["device_class"] != "battery" || battery.payload["unit_of_measurement"] != "%" {
+		t.Fatalf("unexpected battery discovery message: %v", battery)
+	}
+
+	state := p.messages[2]
+	want := map[string]interface{}{
+		"name":     "wi-wc",
+		"type":     "ZHAOpenClose",
+		"id":       "5",
+		"source":   "websocket",
+		"open":     true,
+		"tampered": false,
+		"battery":  float64(91),
+		"time":     "2022-01-09T18:12:29Z",
+	}
+	if state.topic != "deflux/ZHAOpenClose/5" || !state.retained || !reflect.DeepEqual(want, state.payload) {
+		t.Fatalf("unexpected state message: %v", state)
+	}
+
+	// a new name triggers new discovery configs
+	tags["name"] = "wi-bad"
+	if err := m.Write("deflux_ZHAOpenClose", tags, fields, mqttTestTime); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if len(p.messages) != 7 || p.messages[4].payload["name"] != "wi-bad open" {
+		t.Fatalf("expected discovery config for new name, got %v", p.messages[4:])
+	}
+
+	// the gateway is part of the topic
+	tags["gateway"] = "building-a"
+	if err := m.Write("deflux_ZHAOpenClose", tags, fields, mqttTestTime); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if last := p.messages[len(p.messages)-1]; last.topic != "deflux/building-a/ZHAOpenClose/5" {
+		t.Fatalf("unexpected topic with gateway: %s", last.topic)
+	}
+}
+
+// blockingPublisher blocks all publishes until release is closed, then they fail
+// The first publish is signalled on started.
+type blockingPublisher struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b blockingPublisher) Publish(topic string, _ byte, _ bool, _ []byte) error {
+	select {
+	case b.started <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return fmt.Errorf("unable to publish to %s: timeout", topic)
+}
+
+func (b blockingPublisher) Disconnect() {}
+
+func TestMQTTSinkBrokerDown(t *testing.T) {
+	p := blockingPublisher{started: make(chan struct{}, 1), release: make(chan struct{})}
+	m := newMQTTSink(config.MQTT{Retain: true, Discovery: true}, p)
+	defer m.Close()
+
+	tags := map[string]string{"name": "th-sz", "type": "ZHATemperature", "id": "1"}
+	fields := map[string]interface{}{"temperature": 20.62}
+
+	// writes do not wait for the broker, messages are dropped once the queue is full
+	start := time.Now()
+	err := m.Write("deflux_ZHATemperature", tags, fields, mqttTestTime)
+	<-p.started
+	for i := 0; i < mqttQueueSize && err == nil; i++ {
+		err = m.Write("deflux_ZHATemperature", tags, fields, mqttTestTime)
+	}
+	if err == nil {
+		t.Errorf("expected an error when the queue is full")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected writes not to block, took %s", d)
+	}
+
+	close(p.release)
+	if err := m.Flush(); err == nil {
+		t.Errorf("expected flush to report the failed publishes")
+	}
+	// the publishing message and the queued ones fail
+	if st := m.status(); st.WriteErrors != mqttQueueSize+1 || st.LastError == "" {
+		t.Errorf("expected %d publish errors, got %+v", mqttQueueSize+1, st)
+	}
+
+	// the failed discovery config is published again
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.discovered) != 0 {
+		t.Errorf("expected no published discovery config, got %v", m.discovered)
+	}
+}
+
+// pendingClient is a mqtt.Client whose messages are never sent
+type pendingClient struct {
+	mqtt.Client
+}
+
+func (pendingClient) Publish(string, byte, bool, interface{}) mqtt.Token {
+	return pendingToken{}
+}
+
+// pendingToken is a mqtt.Token that never completes
+type pendingToken struct{}
+
+func (pendingToken) Wait() bool { select {} }
+
+func (pendingToken) WaitTimeout(d time.Duration) bool {
+	time.Sleep(d)
+	return false
+}
+
+func (pendingToken) Done() <-chan struct{} { return make(chan struct{}) }
+
+func (pendingToken) Error() error { return nil }
+
+func TestPahoPublisherTimeout(t *testing.T) {
+	p := pahoPublisher{client: pendingClient{}, timeout: 20 * time.Millisecond}
+
+	start := time.Now()
+	err := p.Publish("deflux/ZHATemperature/1", 0, true, []byte(`{}`))
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected publish to give up after the timeout, took %s", d)
+	}
+}
+
+// TestMQTTBroker publishes to a real broker, e.g. a local mosquitto instance.
+// Set DEFLUX_TEST_MQTT_BROKER=tcp://localhost:1883 to run it.
+func TestMQTTBroker(t *testing.T) {
+	broker := os.Getenv("DEFLUX_TEST_MQTT_BROKER")
+	if broker == "" {
+		t.Skip("DEFLUX_TEST_MQTT_BROKER not set")
+	}
+
+	cfg := &config.Configuration{MQTT: config.MQTT{Broker: broker, Topic: "deflux-test", Retain: true}}
+	m, err := NewMQTTSink(cfg)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer m.Close()
+
+	received := make(chan mqtt.Message, 1)
+	sub := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID("deflux-test-sub"))
+	if token := sub.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("failed to connect subscriber: %s", token.Error())
+	}
+	defer sub.Disconnect(250)
+
+	tags := map[string]string{"name": "th-sz", "type": "ZHATemperature", "id": "1"}
+	if err := m.Write("deflux_ZHATemperature", tags, map[string]interface{}{"temperature": 20.62}, mqttTestTime); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	// the retained message is delivered on subscription
+	token := sub.Subscribe("deflux-test/ZHATemperature/1", 0, func(_ mqtt.Client, msg mqtt.Message) {
+		received <- msg
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("failed to subscribe: %s", token.Error())
+	}
+
+	select {
+	case msg := <-received:
+		var payload map[string]interface{}
+		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+			t.Fatalf("failed to decode payload: %s", err)
+		}
+		if payload["temperature"] != 20.62 || !msg.Retained() {
+			t.Fatalf("unexpected message: %s", msg.Payload())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
@@ -0,0 +1,313 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prometheusPruneInterval is the interval in which stale series are removed
+const prometheusPruneInterval = 1 * time.Minute
+
+// PrometheusSink keeps the most recent value of each field and exposes them as Prometheus gauges
+// Every field of a measurement becomes a gauge named <measurement>_<field>, e.g. deflux_zhatemperature_temperature.
+// Tags except "source" are used as labels. Booleans are exported as 0 or 1, strings are omitted.
+type PrometheusSink struct {
+	mu     sync.Mutex
+	series map[string]*promSeries
+
+	// timeout is the duration after which series of sensors that have not been seen, or series without updates if
+	// the lastseen time is unknown, are stale and removed; zero keeps them forever, see config.Configuration.Validate
+	timeout time.Duration
+	now     func() time.Time
+	// pruned is the time stale series have been removed last
+	pruned time.Time
+
+	registry *prometheus.Registry
+	server   *http.Server
+}
+
+// promSeries holds the values of a single measurement and tag set
+type promSeries struct {
+	measurement string
+	labels      map[string]string
+	values      map[string]float64
+
+	// updated is the wallclock time of the last write
+	updated time.Time
+	// lastSeen is the time deCONZ has last seen the sensor, zero if it is unknown
+	lastSeen time.Time
+}
+
+// NewPrometheusSink returns a PrometheusSink that serves metrics on the configured listen address
+// The instance needs to be closed with Close()
+func NewPrometheusSink(cfg *config.Configuration) (*PrometheusSink, error) {
+	p := newPrometheusSink(cfg.FillValues.LastSeenTimeout)
+
+	l, err := net.Listen("tcp", cfg.Prometheus.ListenAddr())
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for prometheus requests: %s", err)
+	}
+
+	// serve the internal metrics of deflux next to the sensor values
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{p.registry, metrics.Registry}, promhttp.HandlerOpts{}))
+	p.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := p.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			slog.Error(fmt.Sprintf("Prometheus listener failed: %s", err))
+		}
+	}()
+
+	slog.Info(fmt.Sprintf("Serving Prometheus metrics on %s/metrics", l.Addr()))
+
+	return p, nil
+}
+
+func newPrometheusSink(timeout time.Duration) *PrometheusSink {
+	p := &PrometheusSink{
+		series:   make(map[string]*promSeries),
+		timeout:  timeout,
+		now:      time.Now,
+		registry: prometheus.NewRegistry(),
+	}
+	p.registry.MustRegister(p)
+
+	return p
+}
+
+// Handler returns the HTTP handler serving the metrics written to the sink
+func (p *PrometheusSink) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+// Write updates the values of the series identified by measurement and tags
+// Fields that are not part of the point keep their previous value. A point holding only FieldLastSeen updates the
+// lastseen time of an existing series. Stale series are removed every prometheusPruneInterval.
+func (p *PrometheusSink) Write(measurement string, tags map[string]string, fields map[string]interface{}, _ time.Time) error {
+	labels := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if k == "source" {
+			continue
+		}
+		labels[sanitizeMetricName(k)] = v
+	}
+
+	key := seriesKey(measurement, labels)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data := dataFields(fields)
+
+	s, ok := p.series[key]
+	if !ok && len(data) == 0 {
+		return nil
+	}
+	if !ok {
+		s = &promSeries{
+			measurement: measurement,
+			values:      make(map[string]float64),
+		}
+		p.series[key] = s
+	}
+
+	now := p.now()
+	if t, ok := fields[FieldLastSeen].(time.Time); ok {
+		s.lastSeen = t
+	}
+	if len(data) > 0 {
+		s.labels = labels
+		s.updated = now
+	}
+	for k, v := range data {
+		if f, ok := toFloat(v); ok {
+			s.values[k] = f
+		}
+	}
+
+	if now.Sub(p.pruned) >= prometheusPruneInterval {
+		p.prune(now)
+	}
+
+	return nil
+}
+
+// prune removes the stale series
+// It must be called with mu held.
+func (p *PrometheusSink) prune(now time.Time) {
+	for key, s := range p.series {
+		if p.stale(s, now) {
+			delete(p.series, key)
+		}
+	}
+	p.pruned = now
+}
+
+// stale returns true if the sensor of the series has not been seen for the timeout
+// If the lastseen time of the series is unknown, e.g. for lights and groups, the time of the last write is used.
+func (p *PrometheusSink) stale(s *promSeries, now time.Time) bool {
+	if p.timeout <= 0 {
+		return false
+	}
+
+	seen := s.updated
+	if !s.lastSeen.IsZero() {
+		seen = s.lastSeen
+	}
+	return now.Sub(seen) > p.timeout
+}
+
+// Flush does nothing, metrics are computed on request
+func (p *PrometheusSink) Flush() error {
+	return nil
+}
+
+// Close shuts down the HTTP listener
+func (p *PrometheusSink) Close() error {
+	if p.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	return p.server.Shutdown(ctx)
+}
+
+// Describe implements prometheus.Collector
+// It sends no descriptors, because the metrics depend on the written measurements.
+func (p *PrometheusSink) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector and sends the current value of all series that are not stale
+// Stale series are removed, so they are dropped even if no more points are written.
+func (p *PrometheusSink) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+
+	// all metrics with the same name must have the same label names
+	type metric struct {
+		labels map[string]string
+		value  float64
+	}
+	metrics := make(map[string][]metric)
+	labelNames := make(map[string]map[string]bool)
+	help := make(map[string]string)
+
+	for key, s := range p.series {
+		if p.stale(s, now) {
+			delete(p.series, key)
+			continue
+		}
+
+		for field, v := range s.values {
+			// the age of the data increases until the next update
+			if field == "age_secs" {
+				v += now.Sub(s.updated).Seconds()
+			}
+
+			name := sanitizeMetricName(strings.ToLower(s.measurement) + "_" + field)
+			metrics[name] = append(metrics[name], metric{labels: s.labels, value: v})
+			help[name] = fmt.Sprintf("Field %s of measurement %s", field, s.measurement)
+
+			if labelNames[name] == nil {
+				labelNames[name] = make(map[string]bool)
+			}
+			for l := range s.labels {
+				labelNames[name][l] = true
+			}
+		}
+	}
+
+	for name, ms := range metrics {
+		var names []string
+		for l := range labelNames[name] {
+			names = append(names, l)
+		}
+		sort.Strings(names)
+
+		desc := prometheus.NewDesc(name, help[name], names, nil)
+		for _, m := range ms {
+			values := make([]string, len(names))
+			for i, l := range names {
+				values[i] = m.labels[l]
+			}
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, m.value, values...)
+		}
+	}
+}
+
+// seriesKey returns a unique key for a measurement and its labels
+func seriesKey(measurement string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(measurement)
+	for _, k := range keys {
+		b.WriteString(fmt.Sprintf(",%s=%s", k, labels[k]))
+	}
+	return b.String()
+}
+
+// sanitizeMetricName replaces all characters that are not allowed in Prometheus metric and label names
+func sanitizeMetricName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// toFloat converts numeric and boolean field values to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,126 @@
+package sink
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, p *PrometheusSink) string {
+	rec := httptest.NewRecorder()
+	p.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	return string(body)
+}
+
+func TestPrometheusSink(t *testing.T) {
+	now := time.Date(2022, 1, 9, 18, 0, 0, 0, time.UTC)
+	p := newPrometheusSink(2 * time.Hour)
+	p.now = func() time.Time { return now }
+
+	tags := map[string]string{"name": "wi-wc", "type": "ZHAOpenClose", "id": "5", "source": "websocket"}
+	err := p.Write("deflux_ZHAOpenClose", tags, map[string]interface{}{
+		"open":     true,
+		"tampered": false,
+		"battery":  91,
+		"age_secs": int64(10),
+	}, now)
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	err = p.Write("deflux_ZHAAirQuality", map[string]string{"name": "air", "type": "ZHAAirQuality", "id": "6"},
+		map[string]interface{}{"airquality": "good", "airqualityppb": 79}, now)
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	now = now.Add(5 * time.Second)
+	body := scrape(t, p)
+
+	for _, want := range []string{
+		`deflux_zhaopenclose_open{id="5",name="wi-wc",type="ZHAOpenClose"} 1`,
+		`deflux_zhaopenclose_tampered{id="5",name="wi-wc",type="ZHAOpenClose"} 0`,
+		`deflux_zhaopenclose_battery{id="5",name="wi-wc",type="ZHAOpenClose"} 91`,
+		`deflux_zhaopenclose_age_secs{id="5",name="wi-wc",type="ZHAOpenClose"} 15`,
+		`deflux_zhaairquality_airqualityppb{id="6",name="air",type="ZHAAirQuality"} 79`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in response:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "deflux_zhaairquality_airquality{") {
+		t.Errorf("string fields must not be exported:\n%s", body)
+	}
+
+	// a partial update keeps the other values
+	if err := p.Write("deflux_ZHAOpenClose", tags, map[string]interface{}{"open": false}, now); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	body = scrape(t, p)
+	if !strings.Contains(body, `deflux_zhaopenclose_open{id="5",name="wi-wc",type="ZHAOpenClose"} 0`) ||
+		!strings.Contains(body, `deflux_zhaopenclose_battery{id="5",name="wi-wc",type="ZHAOpenClose"} 91`) {
+		t.Errorf("unexpected response after partial update:\n%s", body)
+	}
+
+	// stale series are removed
+	now = now.Add(3 * time.Hour)
+	if body := scrape(t, p); strings.Contains(body, "deflux_") {
+		t.Errorf("expected no series after timeout:\n%s", body)
+	}
+}
+
+func TestPrometheusSinkLastSeen(t *testing.T) {
+	now := time.Date(2022, 1, 9, 18, 0, 0, 0, time.UTC)
+	p := newPrometheusSink(2 * time.Hour)
+	p.now = func() time.Time { return now }
+
+	door := map[string]string{"name": "door", "type": "ZHAOpenClose", "id": "5"}
+	window := map[string]string{"name": "window", "type": "ZHAOpenClose", "id": "6"}
+	for _, tags := range []map[string]string{door, window} {
+		err := p.Write("deflux_ZHAOpenClose", tags, map[string]interface{}{"open": false, FieldLastSeen: now}, now)
+		if err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+
+	// the door has not changed, but is still seen by deCONZ, the window is offline
+	now = now.Add(3 * time.Hour)
+	if err := p.Write("deflux_ZHAOpenClose", door, map[string]interface{}{FieldLastSeen: now.Add(-time.Minute)}, now); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	// the lastseen time of an unknown series creates no series
+	unknown := map[string]string{"name": "unknown", "type": "ZHAOpenClose", "id": "7"}
+	if err := p.Write("deflux_ZHAOpenClose", unknown, map[string]interface{}{FieldLastSeen: now}, now); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	body := scrape(t, p)
+	if !strings.Contains(body, `deflux_zhaopenclose_open{id="5",name="door",type="ZHAOpenClose"} 0`) {
+		t.Errorf("expected the door that has been seen recently:\n%s", body)
+	}
+	if strings.Contains(body, `name="window"`) {
+		t.Errorf("expected no offline window:\n%s", body)
+	}
+	if strings.Contains(body, FieldLastSeen) {
+		t.Errorf("expected no lastseen gauge:\n%s", body)
+	}
+	if n := len(p.series); n != 1 {
+		t.Errorf("expected the stale window to be removed by the write, got %d series", n)
+	}
+
+	// scrapes remove stale series, even if nothing is written anymore
+	now = now.Add(3 * time.Hour)
+	if body := scrape(t, p); strings.Contains(body, "deflux_") {
+		t.Errorf("expected no series after timeout:\n%s", body)
+	}
+	if n := len(p.series); n != 0 {
+		t.Errorf("expected the stale door to be removed by the scrape, got %d series", n)
+	}
+}
@@ -0,0 +1,271 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloadable is a Sink that writes to the sinks selected in the configuration
+// Reload replaces the sinks whose configuration has changed, while the other sinks keep running.
+type Reloadable struct {
+	// mu guards cfg, names and sinks. Writes hold a read lock, so they block while the sinks are replaced.
+	mu    sync.RWMutex
+	cfg   *config.Configuration
+	names []string
+	sinks []Sink
+
+	// errors holds the errors returned by Write for each sink name. Entries are only added under the write lock.
+	errors map[string]*sinkErrors
+}
+
+// sinkErrors counts the errors returned by Write and keeps the most recent one
+type sinkErrors struct {
+	count atomic.Uint64
+	last  atomic.Value
+}
+
+// NewReloadable creates the sinks selected in the configuration
+// The instance needs to be closed with Close()
+func NewReloadable(cfg *config.Configuration) (*Reloadable, error) {
+	names := cfg.SinkNames()
+	sinks, err := openSinks(names, cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reloadable{
+		cfg:    cfg,
+		names:  names,
+		sinks:  sinks,
+		errors: make(map[string]*sinkErrors),
+	}
+	r.addErrorCounters(names)
+
+	return r, nil
+}
+
+// Reload replaces the sinks whose configuration differs in cfg, adds new and closes removed sinks
+// Changed sinks are closed before they are created again, so they can take over resources like the listen address.
+// If a sink cannot be created, the previous sinks are restored and an error is returned.
+func (r *Reloadable) Reload(cfg *config.Configuration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := cfg.SinkNames()
+
+	kept := make(map[string]Sink)
+	for i, name := range r.names {
+		if slices.Contains(names, name) && sinkConfigEqual(name, r.cfg, cfg) {
+			kept[name] = r.sinks[i]
+			continue
+		}
+
+		slog.Info(fmt.Sprintf("Closing sink %s", name))
+		if err := r.sinks[i].Close(); err != nil {
+			slog.Error(fmt.Sprintf("Failed to close sink %s: %s", name, err))
+		}
+	}
+
+	sinks, err := openSinks(names, cfg, kept)
+	if err != nil {
+		restored, restoreErr := openSinks(r.names, r.cfg, kept)
+		if restoreErr != nil {
+			// keep the sinks that are still running
+			names := r.names
+			r.names, r.sinks = nil, nil
+			for _, name := range names {
+				if s, ok := kept[name]; ok {
+					r.names = append(r.names, name)
+					r.sinks = append(r.sinks, s)
+				}
+			}
+			return errors.Join(err, fmt.Errorf("unable to restore sinks: %s", restoreErr))
+		}
+
+		r.sinks = restored
+		return err
+	}
+
+	r.cfg, r.names, r.sinks = cfg, names, sinks
+	r.addErrorCounters(names)
+	return nil
+}
+
+// addErrorCounters adds the missing error counters of the named sinks
+func (r *Reloadable) addErrorCounters(names []string) {
+	for _, name := range names {
+		if _, ok := r.errors[name]; !ok {
+			r.errors[name] = new(sinkErrors)
+		}
+	}
+}
+
+// Status returns the state of all sinks
+// Write errors are counted since the start, even if the sink has been replaced in between.
+func (r *Reloadable) Status() []Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	statuses := make([]Status, 0, len(r.sinks))
+	for i, name := range r.names {
+		var st Status
+		if sr, ok := r.sinks[i].(statusReporter); ok {
+			st = sr.status()
+		}
+		st.Name = name
+		st.WriteErrors += r.errors[name].count.Load()
+		if err, ok := r.errors[name].last.Load().(string); ok && st.LastError == "" {
+			st.LastError = err
+		}
+
+		statuses = append(statuses, st)
+	}
+
+	return statuses
+}
+
+// Write writes the data point to all sinks
+func (r *Reloadable) Write(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var errs []error
+	for i, s := range r.sinks {
+		err := s.Write(measurement, tags, fields, t)
+		r.countWrite(r.names[i], fields, err)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// countWrite counts a point written to the named sink, or the error returned by its Write
+// Points without data fields, which only update the FieldLastSeen of a sensor, are not counted as written.
+// The caller must hold the read lock.
+func (r *Reloadable) countWrite(name string, fields map[string]interface{}, err error) {
+	if err != nil {
+		r.errors[name].count.Add(1)
+		r.errors[name].last.Store(err.Error())
+		metrics.WriteErrors.WithLabelValues(name).Inc()
+		return
+	}
+	if len(dataFields(fields)) > 0 {
+		metrics.PointsWritten.WithLabelValues(name).Inc()
+	}
+}
+
+// Flush flushes all sinks
+func (r *Reloadable) Flush() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return Multi(r.sinks).Flush()
+}
+
+// Close closes all sinks
+func (r *Reloadable) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return Multi(r.sinks).Close()
+}
+
+// Named returns a Sink that writes to the named sink only, e.g. to write points that are specific to InfluxDB
+// Points are dropped while the named sink is not configured. Closing the returned Sink has no effect.
+func (r *Reloadable) Named(name string) Sink {
+	return &namedSink{r: r, name: name}
+}
+
+// namedSink writes to a single sink of a Reloadable
+type namedSink struct {
+	r    *Reloadable
+	name string
+}
+
+// sink returns the index of the sink, or -1 if it is not configured. The caller must hold the read lock.
+func (n *namedSink) sink() int {
+	return slices.Index(n.r.names, n.name)
+}
+
+// Write writes the data point to the named sink
+func (n *namedSink) Write(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) error {
+	n.r.mu.RLock()
+	defer n.r.mu.RUnlock()
+
+	i := n.sink()
+	if i < 0 {
+		return nil
+	}
+
+	err := n.r.sinks[i].Write(measurement, tags, fields, t)
+	n.r.countWrite(n.name, fields, err)
+	return err
+}
+
+// Flush flushes the named sink
+func (n *namedSink) Flush() error {
+	n.r.mu.RLock()
+	defer n.r.mu.RUnlock()
+
+	i := n.sink()
+	if i < 0 {
+		return nil
+	}
+	return n.r.sinks[i].Flush()
+}
+
+// Close does nothing, the sink is closed by the Reloadable
+func (n *namedSink) Close() error {
+	return nil
+}
+
+// openSinks returns the named sinks, taken from kept or created from the configuration
+// If a sink cannot be created, the sinks created so far are closed again.
+func openSinks(names []string, cfg *config.Configuration, kept map[string]Sink) ([]Sink, error) {
+	var sinks []Sink
+	var created Multi
+
+	for _, name := range names {
+		if s, ok := kept[name]; ok {
+			sinks = append(sinks, s)
+			continue
+		}
+
+		s, err := newSink(name, cfg)
+		if err != nil {
+			if closeErr := created.Close(); closeErr != nil {
+				slog.Error(fmt.Sprintf("Failed to close sinks: %s", closeErr))
+			}
+			return nil, err
+		}
+
+		created = append(created, s)
+		sinks = append(sinks, s)
+	}
+
+	return sinks, nil
+}
+
+// sinkConfigEqual returns true if the named sink is configured the same in a and b
+func sinkConfigEqual(name string, a, b *config.Configuration) bool {
+	switch name {
+	case config.SinkInfluxDB:
+		// the sink is created again to read rotated TLS files
+		return a.InfluxDB == b.InfluxDB && !b.InfluxDB.TLS.HasFiles()
+	case config.SinkPrometheus:
+		// series are removed after the lastseen timeout
+		return a.Prometheus == b.Prometheus && a.FillValues.LastSeenTimeout == b.FillValues.LastSeenTimeout
+	case config.SinkMQTT:
+		return a.MQTT == b.MQTT
+	}
+
+	return false
+}
@@ -0,0 +1,131 @@
+package sink
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rvk01/deflux/pkg/config"
+	"github.com/rvk01/deflux/pkg/metrics"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReloadable(t *testing.T) {
+	cfg := &config.Configuration{
+		InfluxDB:   config.InfluxDB{URL: "http://localhost:8086", Token: "SECRET", Org: "org", Bucket: "default"},
+		Prometheus: config.Prometheus{Listen: "127.0.0.1:0"},
+		Sinks:      []string{config.SinkInfluxDB, config.SinkPrometheus},
+	}
+
+	r, err := NewReloadable(cfg)
+	if err != nil {
+		t.Fatalf("failed to create sinks: %s", err)
+	}
+	defer r.Close()
+
+	influx, prom := r.sinks[0], r.sinks[1]
+
+	// unchanged configuration keeps all sinks
+	same := *cfg
+	if err := r.Reload(&same); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if r.sinks[0] != influx || r.sinks[1] != prom {
+		t.Errorf("expected sinks to be kept")
+	}
+
+	// changed InfluxDB configuration replaces the InfluxDB sink only
+	changed := *cfg
+	changed.InfluxDB.Bucket = "other"
+	if err := r.Reload(&changed); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if r.sinks[0] == influx || r.sinks[1] != prom {
+		t.Errorf("expected only the InfluxDB sink to be replaced")
+	}
+	influx = r.sinks[0]
+
+	// a sink that cannot be created restores the previous sinks
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer l.Close()
+
+	broken := changed
+	broken.Prometheus.Listen = l.Addr().String()
+	if err := r.Reload(&broken); err == nil {
+		t.Errorf("expected error for occupied listen address")
+	}
+	if len(r.sinks) != 2 || r.sinks[0] != influx || r.cfg != &changed {
+		t.Errorf("expected previous sinks to be restored")
+	}
+	if err := r.Write("deflux_test", nil, map[string]interface{}{"value": 1}, time.Now()); err != nil {
+		t.Errorf("failed to write after restore: %s", err)
+	}
+
+	// removed sinks are closed
+	removed := changed
+	removed.Sinks = []string{config.SinkPrometheus}
+	if err := r.Reload(&removed); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if len(r.sinks) != 1 || r.names[0] != config.SinkPrometheus {
+		t.Errorf("expected only the prometheus sink, got %v", r.names)
+	}
+}
+
+func TestReloadableNamed(t *testing.T) {
+	influx, prom := NewMemorySink(), NewMemorySink()
+	r := &Reloadable{
+		cfg:    &config.Configuration{},
+		names:  []string{config.SinkInfluxDB, config.SinkPrometheus},
+		sinks:  []Sink{influx, prom},
+		errors: make(map[string]*sinkErrors),
+	}
+	r.addErrorCounters(r.names)
+
+	named := r.Named(config.SinkInfluxDB)
+	if err := named.Write("deflux_internal", nil, map[string]interface{}{"value": 1}, time.Now()); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if len(influx.Points()) != 1 || len(prom.Points()) != 0 {
+		t.Errorf("expected the point in the InfluxDB sink only, got %d and %d points", len(influx.Points()),
+			len(prom.Points()))
+	}
+
+	// a sink that is not configured drops the point
+	if err := r.Named(config.SinkMQTT).Write("deflux_internal", nil, map[string]interface{}{"value": 1}, time.Now()); err != nil {
+		t.Errorf("expected no error for missing sink, got %s", err)
+	}
+
+	if err := named.Close(); err != nil || influx.Closed() {
+		t.Errorf("expected the named sink to be left open")
+	}
+}
+
+func TestReloadableCountsDataPoints(t *testing.T) {
+	r := &Reloadable{
+		cfg:    &config.Configuration{},
+		names:  []string{"counted"},
+		sinks:  []Sink{NewMemorySink()},
+		errors: make(map[string]*sinkErrors),
+	}
+	r.addErrorCounters(r.names)
+
+	now := time.Now()
+	if err := r.Write("temperature", nil, map[string]interface{}{"temperature": 21.5, FieldLastSeen: now}, now); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	// a point that only updates the lastseen of a sensor is not written
+	if err := r.Write("temperature", nil, map[string]interface{}{FieldLastSeen: now}, now); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	var m dto.Metric
+	if err := metrics.PointsWritten.WithLabelValues("counted").Write(&m); err != nil {
+		t.Fatalf("failed to read metric: %s", err)
+	}
+	if n := m.GetCounter().GetValue(); n != 1 {
+		t.Errorf("expected 1 point written, got %v", n)
+	}
+}
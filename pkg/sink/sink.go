@@ -0,0 +1,133 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rvk01/deflux/pkg/config"
+	"log/slog"
+	"time"
+)
+
+// Sink persists data points, e.g. in a time series database
+type Sink interface {
+	// Write adds a data point to the sink.
+	// It takes the measurement name, tags and fields and the time as arguments
+	Write(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) error
+
+	// Flush forces all buffered data points to be written
+	Flush() error
+
+	// Close flushes all buffered data points and releases the resources of the sink
+	Close() error
+}
+
+// FieldLastSeen is the field holding the time.Time a sensor has last been seen by deCONZ
+// It is no data of the point and not written by the sinks. The Prometheus sink removes the series of sensors that have
+// not been seen for the last seen timeout. A point holding no other field only updates the lastseen time, it is
+// ignored by the other sinks.
+const FieldLastSeen = "_lastseen"
+
+// Status is the internal state of a sink
+type Status struct {
+	Name string `json:"name"`
+	// BacklogBytes is the size of the points that have not been sent yet, if the sink buffers them on disk
+	BacklogBytes int64 `json:"backlog_bytes"`
+	// WriteErrors is the number of failed writes
+	WriteErrors uint64 `json:"write_errors"`
+	// LastError is the most recent write error
+	LastError string `json:"last_error,omitempty"`
+}
+
+// statusReporter is implemented by sinks that report their backlog and write errors
+type statusReporter interface {
+	status() Status
+}
+
+// New creates the sinks selected in the configuration.
+// If more than one sink is configured, the returned Sink writes to all of them.
+func New(cfg *config.Configuration) (Sink, error) {
+	var sinks Multi
+
+	for _, name := range cfg.SinkNames() {
+		s, err := newSink(name, cfg)
+		if err != nil {
+			if closeErr := sinks.Close(); closeErr != nil {
+				slog.Error(fmt.Sprintf("Failed to close sinks: %s", closeErr))
+			}
+			return nil, err
+		}
+
+		sinks = append(sinks, s)
+	}
+
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+
+	return sinks, nil
+}
+
+// newSink creates a single sink by name
+func newSink(name string, cfg *config.Configuration) (Sink, error) {
+	switch name {
+	case config.SinkInfluxDB:
+		return NewInfluxSink(cfg)
+	case config.SinkPrometheus:
+		return NewPrometheusSink(cfg)
+	case config.SinkMQTT:
+		return NewMQTTSink(cfg)
+	}
+
+	return nil, fmt.Errorf("unknown sink %q", name)
+}
+
+// Multi is a Sink that passes data points to several other sinks
+type Multi []Sink
+
+// Write writes the data point to all sinks
+func (m Multi) Write(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Write(measurement, tags, fields, t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Flush flushes all sinks
+func (m Multi) Flush() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes all sinks
+func (m Multi) Close() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dataFields returns the fields without FieldLastSeen
+func dataFields(fields map[string]interface{}) map[string]interface{} {
+	if _, ok := fields[FieldLastSeen]; !ok {
+		return fields
+	}
+
+	data := make(map[string]interface{}, len(fields)-1)
+	for k, v := range fields {
+		if k != FieldLastSeen {
+			data[k] = v
+		}
+	}
+	return data
+}
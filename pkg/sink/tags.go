@@ -0,0 +1,30 @@
+package sink
+
+import (
+	"time"
+)
+
+// TagSink is a Sink that adds static tags to every data point before passing it to another sink
+// Tags of the data point take precedence over the static tags.
+type TagSink struct {
+	Sink
+	tags map[string]string
+}
+
+// NewTagSink returns a TagSink that adds tags to all data points written to s
+func NewTagSink(s Sink, tags map[string]string) *TagSink {
+	return &TagSink{Sink: s, tags: tags}
+}
+
+// Write adds the static tags and writes the data point to the underlying sink
+func (s *TagSink) Write(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) error {
+	merged := make(map[string]string, len(tags)+len(s.tags))
+	for k, v := range s.tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+
+	return s.Sink.Write(measurement, merged, fields, t)
+}
@@ -0,0 +1,31 @@
+package sink
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTagSink(t *testing.T) {
+	m := NewMemorySink()
+	s := NewTagSink(m, map[string]string{"gateway": "building-a", "id": "static"})
+
+	tags := map[string]string{"name": "th-sz", "id": "4"}
+	if err := s.Write("deflux_ZHATemperature", tags, map[string]interface{}{"temperature": 20.62}, time.Now()); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	points := m.Points()
+	if len(points) != 1 {
+		t.Fatalf("expected 1 point, got %d", len(points))
+	}
+	if p := points[0]; p.Tags["gateway"] != "building-a" || p.Tags["id"] != "4" || p.Tags["name"] != "th-sz" {
+		t.Fatalf("unexpected tags: %v", p.Tags)
+	}
+	if _, ok := tags["gateway"]; ok {
+		t.Fatalf("tags of the caller must not be modified")
+	}
+
+	if err := s.Close(); err != nil || !m.Closed() {
+		t.Fatalf("expected underlying sink to be closed, err: %v", err)
+	}
+}